@@ -69,8 +69,6 @@ func initPrompt(privateKeyName string) {
 	cancelOrderArguments := []terminal.Argument{
 		{Name: "order_id", Value: "1"},
 		{Name: "pair_name", Value: "TOMO/WETH"},
-		{Name: "side", Value: orderbook.Ask},
-		{Name: "price", Value: "100"},
 	}
 
 	orderArguments := []terminal.Argument{
@@ -268,13 +266,20 @@ func processOrder(payload map[string]string) error {
 	}
 	msg, err := protocol.NewOrderbookMsg(payload)
 	if err == nil {
+		quote, err := orderbook.NewQuote(payload)
+		if err != nil {
+			return err
+		}
 		// try to store into model, if success then process at local and broad cast
-		trades, orderInBook := orderbookEngine.ProcessOrder(payload)
-		demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook)
+		trades, orderInBook, err := orderbookEngine.ProcessOrder(quote)
+		demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook, "err", err)
 
 		// broad cast message
-		service.OutC <- msg
+		if err == nil {
+			service.OutC <- msg
+		}
 
+		return err
 	}
 
 	return err
@@ -284,10 +289,14 @@ func cancelOrder(payload map[string]string) error {
 	// add order at this current node first
 	// get timestamp in milliseconds
 	payload["timestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
-	msg, err := protocol.NewOrderbookMsg(payload)
+	msg, err := protocol.NewOrderbookCancelMsg(payload)
 	if err == nil {
+		quote, err := orderbook.NewQuote(payload)
+		if err != nil {
+			return err
+		}
 		// try to store into model, if success then process at local and broad cast
-		err := orderbookEngine.CancelOrder(payload)
+		err = orderbookEngine.CancelOrder(quote)
 		demo.LogInfo("Orderbook cancel result", "err", err, "msg", msg)
 
 		// broad cast message
@@ -369,11 +378,11 @@ func startup(p2pPort int, httpPort int, wsPort int, name string, privateKey stri
 	}
 	dataDir := fmt.Sprintf("%s%d", demo.DatadirPrefix, p2pPort)
 	orderbookDir := path.Join(dataDir, "orderbook")
-	allowedPairs := map[string]*big.Int{
-		"TOMO/WETH": big.NewInt(10e9),
-		"NOVA/WETH": big.NewInt(10e9),
+	instruments := map[string]*orderbook.Instrument{
+		"TOMO/WETH": {BaseAsset: "TOMO", QuoteAsset: "WETH", TickSize: big.NewInt(1), LotSize: big.NewInt(1), MaxQuantity: big.NewInt(10e9)},
+		"NOVA/WETH": {BaseAsset: "NOVA", QuoteAsset: "WETH", TickSize: big.NewInt(1), LotSize: big.NewInt(1), MaxQuantity: big.NewInt(10e9)},
 	}
-	orderbookEngine = orderbook.NewEngine(orderbookDir, allowedPairs)
+	orderbookEngine = orderbook.NewEngine(orderbookDir, instruments)
 
 	thisNode, err = demo.NewServiceNodeWithPrivateKeyAndDataDir(privkey, dataDir, p2pPort, httpPort, wsPort, rpcapi...)
 
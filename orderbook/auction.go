@@ -0,0 +1,270 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	// trading phase of a pair
+	// PhaseContinuous : orders are matched on arrival, this is the default
+	PhaseContinuous = "continuous"
+	// PhaseAuction : orders collect in the book without matching until the auction ends
+	PhaseAuction = "auction"
+	// PhaseClosed : no new order is accepted, only cancels
+	PhaseClosed = "closed"
+)
+
+var (
+	ErrInvalidPhase        = errors.New("trading phase is not supported")
+	ErrMarketClosed        = errors.New("pair is closed, only cancels are accepted")
+	ErrNotAllowedInAuction = errors.New("only limit orders that can rest are accepted during the auction")
+	ErrNotInAuction        = errors.New("pair is not in the auction phase")
+	ErrAuctionInProgress   = errors.New("auction must be ended to go back to continuous trading")
+	ErrBookCrossed         = errors.New("book is crossed, it must be uncrossed by an auction")
+)
+
+// phaseCodes : index of each phase is its code in the stored orderbook item
+var phaseCodes = []string{PhaseContinuous, PhaseAuction, PhaseClosed}
+
+func isPhase(phase string) bool {
+	for _, value := range phaseCodes {
+		if value == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Phase : trading phase of the pair
+func (orderBook *Orderbook) Phase() string {
+	if orderBook.Item.Phase == "" {
+		return PhaseContinuous
+	}
+	return orderBook.Item.Phase
+}
+
+// SetPhase : move the pair to the trading phase, an auction can only be left through EndAuction so
+// that the book is uncrossed first, and a crossed closed book can only reopen through an auction
+func (orderBook *Orderbook) SetPhase(phase string) error {
+	if !isPhase(phase) {
+		return ErrInvalidPhase
+	}
+	current := orderBook.Phase()
+	if current == PhaseAuction && phase != PhaseAuction {
+		return ErrAuctionInProgress
+	}
+	if current != PhaseContinuous && phase == PhaseContinuous && orderBook.isCrossed() {
+		return ErrBookCrossed
+	}
+	orderBook.Item.Phase = phase
+	return orderBook.Save()
+}
+
+// isCrossed : the best bid is at or above the best ask
+func (orderBook *Orderbook) isCrossed() bool {
+	return orderBook.Bids.NotEmpty() && orderBook.Asks.NotEmpty() &&
+		IsEqualOrGreaterThan(orderBook.BestBid(), orderBook.BestAsk())
+}
+
+// checkPhase : reject the quote that the current phase does not accept
+func (orderBook *Orderbook) checkPhase(quote *Quote) error {
+	switch orderBook.Phase() {
+	case PhaseClosed:
+		return ErrMarketClosed
+	case PhaseAuction:
+		if quote.IsMarket() || quote.TimeInForce == IOC || quote.TimeInForce == FOK {
+			return ErrNotAllowedInAuction
+		}
+	}
+	return nil
+}
+
+// collectAuctionOrder : rest the limit order in the book without matching
+func (orderBook *Orderbook) collectAuctionOrder(quote *Quote) (*Quote, error) {
+	orderTree := orderBook.Asks
+	if quote.Side == Bid {
+		orderTree = orderBook.Bids
+	}
+	if err := orderBook.insertOrder(orderTree, quote); err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+// EquilibriumPrice : price that executes the most volume when the book is uncrossed, ties are broken
+// by the smallest imbalance, then by the distance to the reference price, then by the lowest price.
+// It returns nil when the book is not crossed. Only the displayed quantity is counted
+func (orderBook *Orderbook) EquilibriumPrice(referencePrice *big.Int) (*big.Int, *big.Int) {
+	if !orderBook.Bids.NotEmpty() || !orderBook.Asks.NotEmpty() {
+		return nil, Zero()
+	}
+	bestBid := orderBook.BestBid()
+	bestAsk := orderBook.BestAsk()
+	if IsStrictlySmallerThan(bestBid, bestAsk) {
+		return nil, Zero()
+	}
+
+	var price, volume, imbalance, distance *big.Int
+	for _, candidate := range orderBook.crossedPrices(bestAsk, bestBid) {
+		demand := orderBook.Bids.VolumeToPrice(candidate, false)
+		supply := orderBook.Asks.VolumeToPrice(candidate, true)
+		candidateVolume := minBigInt(demand, supply)
+		candidateImbalance := new(big.Int).Abs(Sub(demand, supply))
+		candidateDistance := Zero()
+		if referencePrice != nil {
+			candidateDistance = new(big.Int).Abs(Sub(candidate, referencePrice))
+		}
+
+		better := price == nil
+		if !better {
+			switch {
+			case candidateVolume.Cmp(volume) != 0:
+				better = candidateVolume.Cmp(volume) > 0
+			case candidateImbalance.Cmp(imbalance) != 0:
+				better = candidateImbalance.Cmp(imbalance) < 0
+			default:
+				better = candidateDistance.Cmp(distance) < 0
+			}
+		}
+		if better {
+			price, volume, imbalance, distance = candidate, candidateVolume, candidateImbalance, candidateDistance
+		}
+	}
+	return price, volume
+}
+
+// crossedPrices : price levels of both sides between low and high, in ascending order
+func (orderBook *Orderbook) crossedPrices(low, high *big.Int) []*big.Int {
+	var prices []*big.Int
+	for _, orderTree := range []*OrderTree{orderBook.Bids, orderBook.Asks} {
+		iterator := orderTree.PriceTree.Iterator()
+		for found := iterator.First(); found; found = iterator.Next() {
+			price := orderTree.getOrderListItem(iterator.Value()).Price
+			if IsStrictlyGreaterThan(price, high) {
+				break
+			}
+			if IsEqualOrGreaterThan(price, low) {
+				prices = append(prices, CloneBigInt(price))
+			}
+		}
+	}
+
+	// merge the two sorted lists, keeping the lowest price on ties
+	sorted := make([]*big.Int, 0, len(prices))
+	for _, price := range prices {
+		i := len(sorted)
+		for i > 0 && IsStrictlyGreaterThan(sorted[i-1], price) {
+			i--
+		}
+		if i > 0 && sorted[i-1].Cmp(price) == 0 {
+			continue
+		}
+		sorted = append(sorted, nil)
+		copy(sorted[i+1:], sorted[i:])
+		sorted[i] = price
+	}
+	return sorted
+}
+
+// EndAuction : uncross the book at the equilibrium price and go back to continuous trading.
+// Orders are filled in price then time priority, the later of the two orders is reported as taker.
+// Orders of the same owner are handled by the self-trade prevention mode of the pair, the mode of a
+// resting order is not stored
+func (orderBook *Orderbook) EndAuction(referencePrice *big.Int, verbose bool) ([]*Trade, error) {
+	if orderBook.Phase() != PhaseAuction {
+		return nil, ErrNotInAuction
+	}
+	orderBook.UpdateTime()
+
+	var trades []*Trade
+	price, _ := orderBook.EquilibriumPrice(referencePrice)
+	for price != nil && orderBook.Bids.NotEmpty() && orderBook.Asks.NotEmpty() &&
+		IsEqualOrGreaterThan(orderBook.BestBid(), price) && IsEqualOrSmallerThan(orderBook.BestAsk(), price) {
+		bidList := orderBook.Bids.MaxPriceList()
+		askList := orderBook.Asks.MinPriceList()
+		bid := bidList.Head()
+		ask := askList.Head()
+		quantity := minBigInt(bid.Item.Quantity, ask.Item.Quantity)
+
+		maker, taker := bid, ask
+		aggressorSide := Ask
+		if new(big.Int).SetBytes(bid.Key).Cmp(new(big.Int).SetBytes(ask.Key)) > 0 {
+			maker, taker = ask, bid
+			aggressorSide = Bid
+		}
+		// orders of the same owner do not trade with each other, like in continuous trading, and the
+		// price is found again without the orders that left the book
+		if orderBook.preventAuctionSelfTrade(bidList, bid, askList, ask, taker == bid) {
+			price, _ = orderBook.EquilibriumPrice(referencePrice)
+			continue
+		}
+		trade := &Trade{
+			PairName:      orderBook.Item.Name,
+			Timestamp:     orderBook.Item.Timestamp,
+			Price:         CloneBigInt(price),
+			Quantity:      quantity,
+			AggressorSide: aggressorSide,
+			MakerOrderID:  new(big.Int).SetBytes(maker.Key).Uint64(),
+			TakerOrderID:  new(big.Int).SetBytes(taker.Key).Uint64(),
+			MakerTradeID:  maker.Item.TradeID,
+			TakerTradeID:  taker.Item.TradeID,
+		}
+		orderBook.computeFees(trade)
+		// the order whose owner can not pay for the fill is cancelled and the uncrossing goes on
+		if makerPays, takerPays := orderBook.canSettle(trade); !makerPays || !takerPays {
+			bidPays, askPays := makerPays, takerPays
+			if maker == ask {
+				bidPays, askPays = takerPays, makerPays
+			}
+			if !bidPays {
+				orderBook.cancelResting(orderBook.Bids, bidList, bid, ErrInsufficientFunds.Error())
+			}
+			if !askPays {
+				orderBook.cancelResting(orderBook.Asks, askList, ask, ErrInsufficientFunds.Error())
+			}
+			price, _ = orderBook.EquilibriumPrice(referencePrice)
+			continue
+		}
+		// funds move before the orders do, a settlement that fails stops the uncrossing and the pair
+		// stays in auction
+		if err := orderBook.settleTrade(trade); err != nil {
+			orderBook.Save()
+			return trades, err
+		}
+
+		bidRemaining := orderBook.fillOrder(orderBook.Bids, bidList, bid, quantity)
+		askRemaining := orderBook.fillOrder(orderBook.Asks, askList, ask, quantity)
+
+		if verbose {
+			fmt.Printf("UNCROSS: Timestamp - %d, Price - %s, Quantity - %s, Bid TradeID - %s, Ask TradeID - %s\n",
+				orderBook.Item.Timestamp, price, quantity, bid.Item.TradeID, ask.Item.TradeID)
+		}
+
+		makerRemaining, takerRemaining := bidRemaining, askRemaining
+		if maker == ask {
+			makerRemaining, takerRemaining = askRemaining, bidRemaining
+		}
+
+		orderBook.Item.NextExecutionID++
+		trade.ExecutionID = orderBook.Item.NextExecutionID
+		trade.MakerRemaining = makerRemaining
+		trade.TakerRemaining = takerRemaining
+		trade.MakerFilled = makerRemaining.Sign() == 0
+		trade.TakerFilled = takerRemaining.Sign() == 0
+		orderBook.chargeFees(trade)
+		orderBook.recordTrade(trade)
+		orderBook.appendTrade(trade)
+		trades = append(trades, trade)
+	}
+
+	orderBook.Item.Phase = PhaseContinuous
+	// stop orders see the auction price like any other trade
+	if len(trades) > 0 {
+		orderBook.triggerStopOrders(price)
+		trades = append(trades, orderBook.processTriggeredOrders(verbose)...)
+	}
+
+	return trades, orderBook.Save()
+}
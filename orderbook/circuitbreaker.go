@@ -0,0 +1,288 @@
+package orderbook
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	demo "github.com/novaprotocolio/orderbook/common"
+)
+
+var (
+	ErrPriceOutOfBand = errors.New("price is outside the price band of the pair")
+	ErrTradingHalted  = errors.New("trading is halted, only cancels are accepted")
+)
+
+// PriceBand : price band and circuit breaker of a pair, zero values disable each part
+type PriceBand struct {
+	// limit orders priced further than this from the reference price are rejected
+	BandBps uint64 `json:"bandBps"`
+	// the pair halts when trades move the price more than HaltBps within HaltWindow seconds
+	HaltBps    uint64 `json:"haltBps"`
+	HaltWindow uint64 `json:"haltWindow"`
+	// seconds before trading resumes by itself, 0 means it waits for the operator
+	HaltDuration uint64 `json:"haltDuration"`
+	// seconds of the auction that reopens the pair after a halt, 0 reopens straight into continuous trading
+	ReopenAuction uint64 `json:"reopenAuction"`
+}
+
+// PairStateItem : stored price band state of a pair, so that a halt and its reopening auction
+// survive a restart. Zero prices mean none, the trades within the halt window are not stored
+type PairStateItem struct {
+	Band         PriceBand `json:"band"`
+	IndexPrice   *big.Int  `json:"indexPrice"`
+	LastPrice    *big.Int  `json:"lastPrice"`
+	Halted       bool      `json:"halted"`
+	HaltUntil    uint64    `json:"haltUntil"`
+	AuctionUntil uint64    `json:"auctionUntil"`
+}
+
+// pairState : price band state of a pair, stored under the key of the pair every time it changes
+type pairState struct {
+	db  *BatchDatabase
+	key []byte
+
+	band *PriceBand
+	// reference price given by the operator, the last trade price is used when it is not set
+	indexPrice *big.Int
+	lastPrice  *big.Int
+	// trades within the halt window
+	recentTrades []*Trade
+	halted       bool
+	// unix time in seconds when the halt times out, 0 means no timeout
+	haltUntil uint64
+	// unix time in seconds when the reopening auction ends, 0 means no auction is scheduled
+	auctionUntil uint64
+}
+
+// nonZero : nil for a price that was stored as none
+func nonZero(price *big.Int) *big.Int {
+	if price == nil || price.Sign() == 0 {
+		return nil
+	}
+	return CloneBigInt(price)
+}
+
+func (state *pairState) load() {
+	val, err := state.db.Get(state.key, &PairStateItem{})
+	if err != nil || val == nil {
+		return
+	}
+	item := val.(*PairStateItem)
+	// zero values disable each part of the band
+	if item.Band != (PriceBand{}) {
+		band := item.Band
+		state.band = &band
+	}
+	state.indexPrice = nonZero(item.IndexPrice)
+	state.lastPrice = nonZero(item.LastPrice)
+	state.halted = item.Halted
+	state.haltUntil = item.HaltUntil
+	state.auctionUntil = item.AuctionUntil
+}
+
+func (state *pairState) save() error {
+	if state.db == nil {
+		return nil
+	}
+	item := &PairStateItem{
+		IndexPrice:   cloneOptional(state.indexPrice),
+		LastPrice:    cloneOptional(state.lastPrice),
+		Halted:       state.halted,
+		HaltUntil:    state.haltUntil,
+		AuctionUntil: state.auctionUntil,
+	}
+	if state.band != nil {
+		item.Band = *state.band
+	}
+	return state.db.Put(state.key, item)
+}
+
+func (state *pairState) referencePrice() *big.Int {
+	if state.indexPrice != nil {
+		return state.indexPrice
+	}
+	return state.lastPrice
+}
+
+// checkBand : limit price must be within the band around the reference price
+func (state *pairState) checkBand(quote *Quote) error {
+	if state.band == nil || state.band.BandBps == 0 || quote.IsMarket() || quote.Price == nil {
+		return nil
+	}
+	reference := state.referencePrice()
+	if reference == nil {
+		return nil
+	}
+
+	band := new(big.Int).SetUint64(state.band.BandBps)
+	denominator := big.NewInt(BpsDenominator)
+	lower := Zero()
+	if state.band.BandBps < BpsDenominator {
+		lower = Div(Mul(reference, Sub(denominator, band)), denominator)
+	}
+	upper := Div(Mul(reference, Add(denominator, band)), denominator)
+	if IsStrictlySmallerThan(quote.Price, lower) || IsStrictlyGreaterThan(quote.Price, upper) {
+		return ErrPriceOutOfBand
+	}
+	return nil
+}
+
+// recordTrades : update the last price and halt the pair when the price moved too much within the window
+func (state *pairState) recordTrades(trades []*Trade) {
+	for _, trade := range trades {
+		state.lastPrice = CloneBigInt(trade.Price)
+		if state.band == nil || state.band.HaltBps == 0 || state.halted {
+			continue
+		}
+
+		state.recentTrades = append(state.recentTrades, trade)
+		// forget the trades older than the window
+		for trade.Timestamp > state.recentTrades[0].Timestamp+state.band.HaltWindow {
+			state.recentTrades = state.recentTrades[1:]
+		}
+
+		first := state.recentTrades[0].Price
+		move := new(big.Int).Abs(Sub(trade.Price, first))
+		if IsStrictlyGreaterThan(Mul(move, big.NewInt(BpsDenominator)), Mul(first, new(big.Int).SetUint64(state.band.HaltBps))) {
+			state.halted = true
+			state.recentTrades = nil
+			if state.band.HaltDuration > 0 {
+				state.haltUntil = trade.Timestamp + state.band.HaltDuration
+			}
+		}
+	}
+	if len(trades) > 0 {
+		state.save()
+	}
+}
+
+// getPairState : state of the pair, loaded from the database of its orderbook the first time
+func (engine *Engine) getPairState(name string) *pairState {
+	state, ok := engine.pairStates[name]
+	if !ok {
+		state = &pairState{}
+		if ob, found := engine.Orderbooks[name]; found {
+			state.db, state.key = ob.db, ob.pairStateKey
+			state.load()
+		}
+		engine.pairStates[name] = state
+	}
+	return state
+}
+
+// SetPriceBand : price band and circuit breaker of the pair, nil disables them
+func (engine *Engine) SetPriceBand(pairName string, band *PriceBand) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return err
+	}
+	state := engine.getPairState(ob.Item.Name)
+	state.band = band
+	return state.save()
+}
+
+// SetIndexPrice : reference price of the price band, nil goes back to the last trade price
+func (engine *Engine) SetIndexPrice(pairName string, price *big.Int) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return err
+	}
+	state := engine.getPairState(ob.Item.Name)
+	state.indexPrice = price
+	return state.save()
+}
+
+// refreshState : lift the halt that timed out and end the reopening auction that is over,
+// returns the trades of the auction
+func (engine *Engine) refreshState(ob *Orderbook, state *pairState) []*Trade {
+	now := uint64(time.Now().Unix())
+	if state.halted && state.haltUntil > 0 && now >= state.haltUntil {
+		engine.resume(ob, state, now)
+	}
+	if state.auctionUntil > 0 && now >= state.auctionUntil {
+		trades, err := engine.endAuction(ob, state)
+		if err != nil {
+			demo.LogError("End auction failed", "pair", ob.Item.Name, "err", err)
+		}
+		return trades
+	}
+	return nil
+}
+
+// resume : lift the halt, through an auction when the price band asks for it
+func (engine *Engine) resume(ob *Orderbook, state *pairState, now uint64) {
+	state.halted = false
+	state.haltUntil = 0
+	state.recentTrades = nil
+	defer state.save()
+	if state.band != nil && state.band.ReopenAuction > 0 && ob.Phase() == PhaseContinuous {
+		if err := ob.SetPhase(PhaseAuction); err != nil {
+			demo.LogError("Start reopening auction failed", "pair", ob.Item.Name, "err", err)
+			return
+		}
+		state.auctionUntil = now + state.band.ReopenAuction
+	}
+}
+
+func (engine *Engine) endAuction(ob *Orderbook, state *pairState) ([]*Trade, error) {
+	state.auctionUntil = 0
+	trades, err := ob.EndAuction(state.referencePrice(), true)
+	state.recordTrades(trades)
+	state.save()
+	engine.queueTrades(trades)
+	return trades, err
+}
+
+// IsHalted : only cancels are accepted for the pair
+func (engine *Engine) IsHalted(pairName string) (bool, error) {
+	defer engine.sendEvents()
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return false, err
+	}
+	state := engine.getPairState(ob.Item.Name)
+	engine.refreshState(ob, state)
+	return state.halted, nil
+}
+
+// ResumeTrading : lift the halt of the pair
+func (engine *Engine) ResumeTrading(pairName string) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return err
+	}
+	engine.resume(ob, engine.getPairState(ob.Item.Name), uint64(time.Now().Unix()))
+	return nil
+}
+
+// SetTradingPhase : move the pair to continuous trading, auction or closed
+func (engine *Engine) SetTradingPhase(pairName string, phase string) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return err
+	}
+	return ob.SetPhase(phase)
+}
+
+// EndAuction : uncross the pair at the equilibrium price and go back to continuous trading
+func (engine *Engine) EndAuction(pairName string) ([]*Trade, error) {
+	defer engine.sendEvents()
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return nil, err
+	}
+	return engine.endAuction(ob, engine.getPairState(ob.Item.Name))
+}
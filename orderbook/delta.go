@@ -0,0 +1,79 @@
+package orderbook
+
+import (
+	"math/big"
+)
+
+// kinds of book delta, a level is created before its first order is added and deleted after
+// its last order is removed
+const (
+	// DeltaLevelCreate : new price level, empty
+	DeltaLevelCreate = "level_create"
+	// DeltaLevelDelete : the price level is gone, it has no order left
+	DeltaLevelDelete = "level_delete"
+	// DeltaAdd : order added at the tail of its level
+	DeltaAdd = "add"
+	// DeltaUpdate : displayed quantity of the order changed, it keeps its place in the queue
+	DeltaUpdate = "update"
+	// DeltaMove : order moved to the tail of its level, it loses its time priority
+	DeltaMove = "move"
+	// DeltaRemove : order left its level
+	DeltaRemove = "remove"
+)
+
+// BookDelta : one change of the bids or asks of a pair. The sequence increases by one for every
+// delta of the pair, so a consumer applies the deltas with a greater sequence than its snapshot
+// and knows it missed one when there is a gap. Deltas are order by order, their base is the L3
+// Snapshot (see Engine.GetSnapshot), not the aggregated Depth: an update carries the quantity of
+// the order, not of its level. Only what the book shows is published, the owner, the hidden
+// reserve of an iceberg and the trigger book are not
+type BookDelta struct {
+	PairName  string   `json:"pairName"`
+	Sequence  uint64   `json:"sequence"`
+	Timestamp uint64   `json:"timestamp"`
+	Kind      string   `json:"kind"`
+	Side      string   `json:"side"`
+	Price     *big.Int `json:"price"`
+	// zero for level deltas
+	OrderID uint64 `json:"orderID,omitempty"`
+	// displayed quantity of the order after the change
+	Quantity *big.Int `json:"quantity,omitempty"`
+}
+
+// emitDelta : publish the change of the order tree, order is nil for level deltas
+func (orderTree *OrderTree) emitDelta(kind string, price *big.Int, order *Order) {
+	if orderTree.orderBook != nil {
+		orderTree.orderBook.emitDelta(orderTree, kind, price, order)
+	}
+}
+
+func (orderBook *Orderbook) emitDelta(orderTree *OrderTree, kind string, price *big.Int, order *Order) {
+	var side string
+	switch orderTree {
+	case orderBook.Bids:
+		side = Bid
+	case orderBook.Asks:
+		side = Ask
+	default:
+		// stop orders are not shown until they are triggered
+		return
+	}
+
+	orderBook.Item.Sequence++
+	if orderBook.OnDelta == nil {
+		return
+	}
+	delta := &BookDelta{
+		PairName:  orderBook.Item.Name,
+		Sequence:  orderBook.Item.Sequence,
+		Timestamp: orderBook.Item.Timestamp,
+		Kind:      kind,
+		Side:      side,
+		Price:     CloneBigInt(price),
+	}
+	if order != nil {
+		delta.OrderID = new(big.Int).SetBytes(order.Key).Uint64()
+		delta.Quantity = CloneBigInt(order.Item.Quantity)
+	}
+	orderBook.OnDelta(delta)
+}
@@ -0,0 +1,89 @@
+package orderbook
+
+import (
+	"math/big"
+)
+
+// DepthLevel : displayed volume and number of orders at one price, or in one group of prices
+type DepthLevel struct {
+	Price  *big.Int `json:"price"`
+	Volume *big.Int `json:"volume"`
+	Count  uint64   `json:"count"`
+}
+
+// Depth : aggregated levels of both sides of the book, best price first. Sequence is the sequence of
+// the last book delta it shows, book deltas are applied on a Snapshot and not on the depth
+type Depth struct {
+	PairName  string        `json:"pairName"`
+	Timestamp uint64        `json:"timestamp"`
+	Sequence  uint64        `json:"sequence"`
+	Bids      []*DepthLevel `json:"bids"`
+	Asks      []*DepthLevel `json:"asks"`
+}
+
+// groupPrice : bucket of the price, bids are rounded down and asks are rounded up to a multiple
+// of the grouping so that a bucket never shows a better price than its orders
+func groupPrice(price, grouping *big.Int, roundUp bool) *big.Int {
+	if grouping == nil || grouping.Cmp(big.NewInt(1)) <= 0 {
+		return CloneBigInt(price)
+	}
+	bucket := Mul(Div(price, grouping), grouping)
+	if roundUp && bucket.Cmp(price) != 0 {
+		bucket = Add(bucket, grouping)
+	}
+	return bucket
+}
+
+// depthLevels : walk the price tree from the best price and merge the price levels into at most
+// levels groups, 0 means all of them
+func (orderTree *OrderTree) depthLevels(levels int, grouping *big.Int, descending bool) []*DepthLevel {
+	var result []*DepthLevel
+	iterator := orderTree.PriceTree.Iterator()
+	next, found := iterator.Next, iterator.First()
+	if descending {
+		next, found = iterator.Prev, iterator.Last()
+	}
+
+	for ; found; found = next() {
+		item := orderTree.getOrderListItem(iterator.Value())
+		price := groupPrice(item.Price, grouping, !descending)
+		if last := len(result) - 1; last >= 0 && result[last].Price.Cmp(price) == 0 {
+			result[last].Volume = Add(result[last].Volume, item.Volume)
+			result[last].Count += item.Length
+			continue
+		}
+		if levels > 0 && len(result) == levels {
+			break
+		}
+		result = append(result, &DepthLevel{
+			Price:  price,
+			Volume: CloneBigInt(item.Volume),
+			Count:  item.Length,
+		})
+	}
+	return result
+}
+
+// Depth : the best levels of both sides with their displayed volume and number of orders, prices are
+// grouped by the grouping when it is greater than 1. Hidden iceberg reserves and stop orders are not shown
+func (orderBook *Orderbook) Depth(levels int, grouping *big.Int) *Depth {
+	return &Depth{
+		PairName:  orderBook.Item.Name,
+		Timestamp: orderBook.Item.Timestamp,
+		Sequence:  orderBook.Item.Sequence,
+		Bids:      orderBook.Bids.depthLevels(levels, grouping, true),
+		Asks:      orderBook.Asks.depthLevels(levels, grouping, false),
+	}
+}
+
+// GetDepth : aggregated depth of the pair, see Orderbook.Depth
+func (engine *Engine) GetDepth(pairName string, levels int, grouping *big.Int) (*Depth, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, err
+	}
+	return ob.Depth(levels, grouping), nil
+}
@@ -77,7 +77,10 @@ func EncodeBytesOrderItem(item *OrderItem) ([]byte, error) {
 	start := 2 * common.HashLength
 	totalLength := start + 3*common.HashLength // next, prev, orderlist
 	// uint64 is 8 byte
-	totalLength += 8 // timestamp
+	totalLength += 8                     // timestamp
+	totalLength += 2                     // marker and version
+	totalLength += 8                     // expireTime
+	totalLength += 2 * common.HashLength // peak size and reserve
 	// the left is tradeID, maybe fix byte
 	totalLength += len(item.TradeID)
 
@@ -102,6 +105,23 @@ func EncodeBytesOrderItem(item *OrderItem) ([]byte, error) {
 	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.Timestamp)
 	start += 8
 
+	returnBytes[start] = layoutMarker
+	returnBytes[start+1] = layoutVersion
+	start += 2
+
+	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.ExpireTime)
+	start += 8
+
+	if item.PeakSize != nil {
+		copy(returnBytes[start:start+common.HashLength], common.BigToHash(item.PeakSize).Bytes())
+	}
+	start += common.HashLength
+
+	if item.Reserve != nil {
+		copy(returnBytes[start:start+common.HashLength], common.BigToHash(item.Reserve).Bytes())
+	}
+	start += common.HashLength
+
 	// returnBytes[start] = bool2byte(item.Deleted)
 	// start++
 	if start < totalLength {
@@ -152,6 +172,29 @@ func DecodeBytesOrderItem(bytes []byte, item *OrderItem) error {
 	item.Timestamp = binary.BigEndian.Uint64(bytes[start : start+8])
 	start += 8
 
+	// an order stored before the expiry and iceberg fields never expires and shows all its quantity
+	item.ExpireTime = 0
+	if item.PeakSize == nil {
+		item.PeakSize = new(big.Int)
+	}
+	item.PeakSize.SetUint64(0)
+	if item.Reserve == nil {
+		item.Reserve = new(big.Int)
+	}
+	item.Reserve.SetUint64(0)
+	if hasLayoutVersion(bytes, start) && totalLength >= start+2+8+2*common.HashLength {
+		start += 2
+
+		item.ExpireTime = binary.BigEndian.Uint64(bytes[start : start+8])
+		start += 8
+
+		item.PeakSize.SetBytes(bytes[start : start+common.HashLength])
+		start += common.HashLength
+
+		item.Reserve.SetBytes(bytes[start : start+common.HashLength])
+		start += common.HashLength
+	}
+
 	if start < totalLength {
 		item.TradeID = string(bytes[start:])
 	}
@@ -294,10 +337,25 @@ func DecodeBytesOrderTreeItem(bytes []byte, item *OrderTreeItem) error {
 }
 
 // order book item
+// the fields added to a stored item after its first layout follow the fixed fields of that layout,
+// behind a zero byte that a pair name or a trade id never starts with and the version of the layout.
+// An item of the first layout has none of them and keeps their zero value
+const (
+	layoutMarker  = 0
+	layoutVersion = 1
+)
+
+// hasLayoutVersion : the item was stored with the fields added after its first layout
+func hasLayoutVersion(bytes []byte, fixedLength int) bool {
+	return len(bytes) >= fixedLength+2 && bytes[fixedLength] == layoutMarker && bytes[fixedLength+1] >= layoutVersion
+}
+
 func EncodeBytesOrderbookItem(item *OrderbookItem) ([]byte, error) {
 	// try with zero
 	start := 0
 	totalLength := start + 2*8 // Timestamp and NextOrderID
+	totalLength += 2           // marker and version
+	totalLength += 2*8 + 1     // NextExecutionID, Sequence and Phase
 	totalLength += len(item.Name)
 
 	returnBytes := make([]byte, totalLength)
@@ -307,6 +365,21 @@ func EncodeBytesOrderbookItem(item *OrderbookItem) ([]byte, error) {
 	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.NextOrderID)
 	start += 8
 
+	returnBytes[start] = layoutMarker
+	returnBytes[start+1] = layoutVersion
+	start += 2
+	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.NextExecutionID)
+	start += 8
+	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.Sequence)
+	start += 8
+	// phase is stored as its index, 0 is continuous
+	for i, phase := range phaseCodes {
+		if phase == item.Phase {
+			returnBytes[start] = byte(i)
+		}
+	}
+	start++
+
 	if start < totalLength {
 		copy(returnBytes[start:], item.Name)
 	}
@@ -325,6 +398,24 @@ func DecodeBytesOrderbookItem(bytes []byte, item *OrderbookItem) error {
 	item.NextOrderID = binary.BigEndian.Uint64(bytes[start : start+8])
 	start += 8
 
+	item.NextExecutionID = 0
+	item.Sequence = 0
+	item.Phase = PhaseContinuous
+	if hasLayoutVersion(bytes, start) && totalLength >= start+2+2*8+1 {
+		start += 2
+
+		item.NextExecutionID = binary.BigEndian.Uint64(bytes[start : start+8])
+		start += 8
+
+		item.Sequence = binary.BigEndian.Uint64(bytes[start : start+8])
+		start += 8
+
+		if int(bytes[start]) < len(phaseCodes) {
+			item.Phase = phaseCodes[bytes[start]]
+		}
+		start++
+	}
+
 	if start < totalLength {
 		item.Name = string(bytes[start:])
 	}
@@ -2,9 +2,11 @@ package orderbook
 
 import (
 	"fmt"
-	"math/big"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/event"
 
 	demo "github.com/novaprotocolio/orderbook/common"
 )
@@ -13,33 +15,155 @@ import (
 type Engine struct {
 	Orderbooks map[string]*Orderbook
 	db         *BatchDatabase
-	// pair and max volume ...
-	allowedPairs map[string]*big.Int
+	// trading rules of each allowed pair
+	instruments map[string]*Instrument
+	// fee schedule of each pair
+	feeSchedules map[string]*FeeSchedule
+	// price band and halt state of each pair
+	pairStates map[string]*pairState
+	// balances of the accounts, orders lock funds once it is enabled
+	ledger        *Ledger
+	ledgerEnabled bool
+
+	// orders are processed one at a time, the expiry scheduler runs concurrently
+	mu         sync.Mutex
+	cancelFeed event.Feed
+	quitC      chan struct{}
+	// events queued while the engine is locked, eventMu keeps them in order while they are sent
+	deltas    []*BookDelta
+	trades    []*Trade
+	records   []*OrderRecord
+	eventMu   sync.Mutex
+	deltaFeed eventFeed
+	tradeFeed eventFeed
+	orderFeed eventFeed
 }
 
-func NewEngine(datadir string, allowedPairs map[string]*big.Int) *Engine {
+// NewEngine : only pairs with a valid instrument can be traded
+func NewEngine(datadir string, instruments map[string]*Instrument) *Engine {
 	// demo.LogDebug("Creating model", "signerAddress", signer.Address().Hex())
 	batchDB := NewBatchDatabaseWithEncode(datadir, 0, 0,
 		EncodeBytesItem, DecodeBytesItem)
 
-	fixAllowedPairs := make(map[string]*big.Int)
-	for key, value := range allowedPairs {
-		fixAllowedPairs[strings.ToLower(key)] = value
+	fixInstruments := make(map[string]*Instrument)
+	for key, value := range instruments {
+		if err := value.Validate(); err != nil {
+			demo.LogError("Invalid instrument", "pair", key, "err", err)
+			continue
+		}
+		fixInstruments[strings.ToLower(key)] = value
 	}
 
 	orderbooks := &Engine{
 		Orderbooks:   make(map[string]*Orderbook),
 		db:           batchDB,
-		allowedPairs: fixAllowedPairs,
+		instruments:  fixInstruments,
+		feeSchedules: make(map[string]*FeeSchedule),
+		pairStates:   make(map[string]*pairState),
+		ledger:       NewLedger(batchDB),
 	}
 
 	return orderbooks
 }
 
 func (engine *Engine) GetOrderbook(pairName string) (*Orderbook, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
 	return engine.getAndCreateIfNotExisted(pairName)
 }
 
+// GetInstrument : trading rules of the pair
+func (engine *Engine) GetInstrument(pairName string) (*Instrument, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	instrument, ok := engine.instruments[strings.ToLower(pairName)]
+	if !ok {
+		return nil, fmt.Errorf("Orderbook not found for pair :%s", pairName)
+	}
+	return instrument, nil
+}
+
+// SetPostOnlyMode : choose whether crossing post-only orders of the pair are rejected or repriced
+func (engine *Engine) SetPostOnlyMode(pairName, mode string) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	if mode != PostOnlyReject && mode != PostOnlyReprice {
+		return ErrInvalidPostOnlyMode
+	}
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return err
+	}
+	ob.PostOnlyMode = mode
+	return nil
+}
+
+// SetSelfTradeMode : default self-trade prevention mode of the pair
+func (engine *Engine) SetSelfTradeMode(pairName, mode string) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	if !isSelfTradeMode(mode) {
+		return ErrInvalidSelfTradeMode
+	}
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return err
+	}
+	ob.SelfTradeMode = mode
+	return nil
+}
+
+// SetMatchingPolicy : choose how the orders at one price level of the pair are filled
+func (engine *Engine) SetMatchingPolicy(pairName string, policy MatchingPolicy) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	if policy == nil {
+		return fmt.Errorf("Matching policy is empty for pair :%s", pairName)
+	}
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return err
+	}
+	ob.MatchingPolicy = policy
+	return nil
+}
+
+// SetFeeSchedule : maker and taker fees of the pair, nil removes the fees
+func (engine *Engine) SetFeeSchedule(pairName string, schedule *FeeSchedule) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	if schedule != nil {
+		if err := schedule.Validate(); err != nil {
+			return err
+		}
+	}
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return err
+	}
+	engine.feeSchedules[ob.Item.Name] = schedule
+	ob.FeeSchedule = schedule
+	return nil
+}
+
+// GetAccountFees : traded amount, fees and rebates of the account on the pair
+func (engine *Engine) GetAccountFees(pairName, account string) (*AccountFeeItem, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if err != nil {
+		return nil, err
+	}
+	return ob.GetAccountFees(account), nil
+}
+
 func (engine *Engine) hasOrderbook(name string) bool {
 	_, ok := engine.Orderbooks[name]
 	return ok
@@ -56,7 +180,8 @@ func (engine *Engine) getAndCreateIfNotExisted(pairName string) (*Orderbook, err
 
 	if !engine.hasOrderbook(name) {
 		// check allow pair
-		if _, ok := engine.allowedPairs[name]; !ok {
+		instrument, ok := engine.instruments[name]
+		if !ok {
 			return nil, fmt.Errorf("Orderbook not found for pair :%s", pairName)
 		}
 
@@ -64,6 +189,16 @@ func (engine *Engine) getAndCreateIfNotExisted(pairName string) (*Orderbook, err
 		ob := NewOrderbook(name, engine.db)
 		if ob != nil {
 			ob.Restore()
+			ob.FeeSchedule = engine.feeSchedules[name]
+			// post-only orders are repriced by the tick of the instrument
+			ob.TickSize = CloneBigInt(instrument.TickSize)
+			ob.BaseAsset = instrument.BaseAsset
+			ob.QuoteAsset = instrument.QuoteAsset
+			if engine.ledgerEnabled {
+				ob.Ledger = engine.ledger
+			}
+			ob.OnDelta = engine.queueDelta
+			ob.OnOrderUpdate = engine.queueOrderUpdate
 			engine.Orderbooks[name] = ob
 		}
 	}
@@ -72,60 +207,155 @@ func (engine *Engine) getAndCreateIfNotExisted(pairName string) (*Orderbook, err
 	return engine.Orderbooks[name], nil
 }
 
+// GetOrder : copy of the resting order, found by its id alone
 func (engine *Engine) GetOrder(pairName, orderID string) *Order {
-	ob, _ := engine.getAndCreateIfNotExisted(pairName)
+	id, err := strconv.ParseUint(orderID, 10, 64)
+	if err != nil {
+		return nil
+	}
+	order, _, _ := engine.GetOrderByID(pairName, id)
+	return order
+}
+
+// GetOrderByID : copy of the resting order of the pair and where it rests, nil when it is not resting
+func (engine *Engine) GetOrderByID(pairName string, orderID uint64) (*Order, *OrderLocation, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, nil, err
+	}
+	order, location := ob.GetOrderByID(orderID)
+	if order == nil {
+		return nil, nil, nil
+	}
+	return order.Clone(), &OrderLocation{Side: location.Side, Price: CloneBigInt(location.Price), Stop: location.Stop}, nil
+}
+
+// GetBestAskList : copies of the orders at the lowest ask of the pair, head of the queue first
+func (engine *Engine) GetBestAskList(pairName string) ([]*Order, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
 	if ob == nil {
+		return nil, err
+	}
+	return cloneOrders(ob.Asks.MinPriceList()), nil
+}
+
+// GetBestBidList : copies of the orders at the highest bid of the pair, head of the queue first
+func (engine *Engine) GetBestBidList(pairName string) ([]*Order, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, err
+	}
+	return cloneOrders(ob.Bids.MaxPriceList()), nil
+}
+
+// cloneOrders : copies of the orders of the list, they can be read once the engine is unlocked
+func cloneOrders(orderList *OrderList) []*Order {
+	if orderList == nil {
 		return nil
 	}
-	key := GetKeyFromString(orderID)
-	return ob.GetOrder(key)
+	var result []*Order
+	for _, order := range orderList.Orders() {
+		result = append(result, order.Clone())
+	}
+	return result
 }
 
-func (engine *Engine) ProcessOrder(quote map[string]string) ([]map[string]string, map[string]string) {
+// ProcessOrder : process the order of an allowed pair, the trades of a reopening auction that ended
+// are returned before the trades of the order
+func (engine *Engine) ProcessOrder(quote *Quote) ([]*Trade, *Quote, error) {
+	defer engine.sendEvents()
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
 
-	ob, _ := engine.getAndCreateIfNotExisted(quote["pair_name"])
-	var trades []map[string]string
-	var orderInBook map[string]string
+	ob, err := engine.getAndCreateIfNotExisted(quote.PairName)
+	var trades []*Trade
+	var orderInBook *Quote
 
 	if ob != nil {
-		// get map as general input, we can set format later to make sure there is no problem
-		orderID, err := strconv.ParseUint(quote["order_id"], 10, 64)
-		if err == nil {
-			// insert
-			if orderID == 0 {
-				demo.LogInfo("Process order")
-				trades, orderInBook = ob.ProcessOrder(quote, true)
+		state := engine.getPairState(ob.Item.Name)
+		// the reopening auction that is over is uncrossed before this order
+		trades = engine.refreshState(ob, state)
+		if state.halted {
+			return trades, nil, ErrTradingHalted
+		}
+
+		// amend only needs the order id
+		if quote.OrderID != 0 {
+			if err = ob.completeAmend(quote); err != nil {
+				return trades, nil, err
+			}
+		}
+
+		// reject before touching the book
+		if err = quote.Validate(); err != nil {
+			demo.LogInfo("Invalid order", "quote", quote, "err", err)
+			return trades, nil, err
+		}
+		if reason := engine.instruments[ob.Item.Name].Check(quote); reason != nil {
+			err = &RejectError{PairName: quote.PairName, Reason: reason}
+			demo.LogInfo("Order does not conform to the instrument", "quote", quote, "err", err)
+			return trades, nil, err
+		}
+		if err = state.checkBand(quote); err != nil {
+			demo.LogInfo("Order is outside the price band", "quote", quote, "err", err)
+			return trades, nil, err
+		}
+
+		// insert
+		if quote.OrderID == 0 {
+			demo.LogInfo("Process order")
+			var newTrades []*Trade
+			newTrades, orderInBook, err = ob.ProcessOrder(quote, true)
+			if err != nil {
+				demo.LogInfo("Process order rejected", "quote", quote, "err", err)
+			} else {
 				demo.LogInfo("Updated order", "quote", quote)
+				state.recordTrades(newTrades)
+			}
+			engine.queueTrades(newTrades)
+			trades = append(trades, newTrades...)
+		} else {
+			demo.LogInfo("Update order")
+			var newTrades []*Trade
+			newTrades, orderInBook, err = ob.UpdateOrder(quote)
+			if err != nil {
+				demo.LogInfo("Update order failed", "quote", quote, "err", err)
 			} else {
-				demo.LogInfo("Update order")
-				err = ob.UpdateOrder(quote)
-				if err != nil {
-					demo.LogInfo("Update order failed", "quote", quote, "err", err)
-				}
+				state.recordTrades(newTrades)
 			}
+			engine.queueTrades(newTrades)
+			trades = append(trades, newTrades...)
 		}
 
 	} else {
 		demo.LogError("Market is not allowed")
 	}
 
-	return trades, orderInBook
+	return trades, orderInBook, err
 
 }
 
-func (engine *Engine) CancelOrder(quote map[string]string) error {
-	ob, err := engine.getAndCreateIfNotExisted(quote["pair_name"])
-	if ob != nil {
-		orderID, err := strconv.ParseUint(quote["order_id"], 10, 64)
-		if err == nil {
-
-			price, ok := new(big.Int).SetString(quote["price"], 10)
-			if !ok {
-				return fmt.Errorf("Price is not correct :%s", quote["price"])
-			}
+// CancelOrder : cancel the order identified by pair name and order id of the quote
+func (engine *Engine) CancelOrder(quote *Quote) error {
+	defer engine.sendEvents()
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	return engine.cancelOrder(quote)
+}
 
-			return ob.CancelOrder(quote["side"], orderID, price)
-		}
+func (engine *Engine) cancelOrder(quote *Quote) error {
+	ob, err := engine.getAndCreateIfNotExisted(quote.PairName)
+	if ob != nil {
+		return ob.CancelOrder(quote.OrderID)
 	}
 
 	return err
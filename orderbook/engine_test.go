@@ -0,0 +1,635 @@
+package orderbook
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestEngine() (*Engine, func()) {
+	dir, _ := ioutil.TempDir("", "engine")
+	engine := NewEngine(dir, map[string]*Instrument{
+		"TOMO/WETH": {
+			BaseAsset:   "TOMO",
+			QuoteAsset:  "WETH",
+			TickSize:    ToBigInt("5"),
+			LotSize:     ToBigInt("10"),
+			MinQuantity: ToBigInt("10"),
+			MaxQuantity: ToBigInt("1000"),
+			MinNotional: ToBigInt("2000"),
+		},
+	})
+	return engine, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEngineInstrument(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	if _, err := engine.GetOrderbook("NOVA/WETH"); err == nil {
+		t.Errorf("pair without instrument should not be allowed")
+	}
+
+	tests := []struct {
+		price    string
+		quantity string
+		reason   error
+	}{
+		{"101", "20", ErrPriceNotOnTick},
+		{"100", "25", ErrQuantityNotOnLot},
+		{"1000", "0", ErrInvalidQuantity},
+		{"100", "2000", ErrQuantityTooLarge},
+		{"100", "10", ErrNotionalTooSmall},
+		{"100", "20", nil},
+	}
+	for i, test := range tests {
+		quote := newTestQuote(Bid, test.price, test.quantity, "1")
+		quote.PairName = "TOMO/WETH"
+		_, _, err := engine.ProcessOrder(quote)
+		if test.reason == nil {
+			if err != nil {
+				t.Errorf("case %d: order should be accepted, got: %v", i, err)
+			}
+			continue
+		}
+		if rejectErr, ok := err.(*RejectError); ok {
+			err = rejectErr.Reason
+		}
+		if err != test.reason {
+			t.Errorf("case %d: got error %v, want %v", i, err, test.reason)
+		}
+	}
+
+	// post-only orders are repriced by the tick of the instrument
+	ob, _ := engine.GetOrderbook("tomo/weth")
+	if ob.TickSize.Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("tick size should come from the instrument, got: %v", ob.TickSize)
+	}
+}
+
+func TestEnginePriceBand(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	process := func(side, price, quantity string) (*Quote, error) {
+		quote := newTestQuote(side, price, quantity, "1")
+		quote.PairName = "TOMO/WETH"
+		_, orderInBook, err := engine.ProcessOrder(quote)
+		return orderInBook, err
+	}
+
+	if err := engine.SetPriceBand("TOMO/WETH", &PriceBand{BandBps: 1000, HaltBps: 500, HaltWindow: 60}); err != nil {
+		t.Fatalf("price band should be set, got: %v", err)
+	}
+
+	// band around the index price
+	engine.SetIndexPrice("TOMO/WETH", ToBigInt("100"))
+	if _, err := process(Bid, "120", "20"); err != ErrPriceOutOfBand {
+		t.Errorf("order outside the band should be rejected, got: %v", err)
+	}
+	engine.SetIndexPrice("TOMO/WETH", nil)
+
+	resting, err := process(Bid, "95", "30")
+	if err != nil {
+		t.Fatalf("order should be accepted, got: %v", err)
+	}
+
+	// 100 then 110 within the window is a 10% move
+	process(Ask, "100", "20")
+	process(Bid, "100", "20")
+	if halted, _ := engine.IsHalted("TOMO/WETH"); halted {
+		t.Fatalf("pair should not be halted after the first trade")
+	}
+	process(Ask, "110", "20")
+	process(Bid, "110", "20")
+	if halted, _ := engine.IsHalted("TOMO/WETH"); !halted {
+		t.Fatalf("pair should be halted after the price moved too much")
+	}
+
+	// only cancels are accepted during the halt
+	if _, err = process(Ask, "110", "20"); err != ErrTradingHalted {
+		t.Errorf("new order should be rejected during the halt, got: %v", err)
+	}
+	cancel := newTestQuote(Bid, "95", "30", "1")
+	cancel.PairName = "TOMO/WETH"
+	cancel.OrderID = resting.OrderID
+	if err = engine.CancelOrder(cancel); err != nil {
+		t.Errorf("cancel should be accepted during the halt, got: %v", err)
+	}
+
+	engine.ResumeTrading("TOMO/WETH")
+	if _, err = process(Ask, "110", "20"); err != nil {
+		t.Errorf("order should be accepted after the operator resumed, got: %v", err)
+	}
+
+	// the halt is lifted by itself once it timed out
+	state := engine.getPairState("tomo/weth")
+	state.halted = true
+	state.haltUntil = 1
+	if halted, _ := engine.IsHalted("TOMO/WETH"); halted {
+		t.Errorf("halt should time out")
+	}
+}
+
+func TestEngineReopenAuction(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	process := func(side, price, quantity string) ([]*Trade, error) {
+		quote := newTestQuote(side, price, quantity, "1")
+		quote.PairName = "TOMO/WETH"
+		trades, _, err := engine.ProcessOrder(quote)
+		return trades, err
+	}
+
+	engine.SetPriceBand("TOMO/WETH", &PriceBand{HaltBps: 500, HaltWindow: 60, ReopenAuction: 60})
+	process(Ask, "100", "20")
+	process(Bid, "100", "20")
+	process(Ask, "110", "20")
+	process(Bid, "110", "20")
+	if halted, _ := engine.IsHalted("TOMO/WETH"); !halted {
+		t.Fatalf("pair should be halted")
+	}
+	// a restarted engine loads the pairs and their state again
+	restart := func() {
+		engine.Orderbooks = make(map[string]*Orderbook)
+		engine.pairStates = make(map[string]*pairState)
+	}
+	restart()
+	if halted, _ := engine.IsHalted("TOMO/WETH"); !halted {
+		t.Fatalf("pair should still be halted after a restart")
+	}
+
+	// the pair reopens through an auction
+	engine.ResumeTrading("TOMO/WETH")
+	restart()
+	ob, _ := engine.GetOrderbook("TOMO/WETH")
+	if ob.Phase() != PhaseAuction || engine.getPairState("tomo/weth").auctionUntil == 0 {
+		t.Fatalf("pair should reopen in auction, got: %s", ob.Phase())
+	}
+	process(Bid, "110", "20")
+	if trades, err := process(Ask, "100", "20"); err != nil || len(trades) != 0 {
+		t.Fatalf("orders should collect during the auction, got: %d trades, %v", len(trades), err)
+	}
+
+	// the auction is over, it is uncrossed at the price closest to the last trade before the next order
+	state := engine.getPairState("tomo/weth")
+	state.auctionUntil = 1
+	trades, err := process(Bid, "95", "30")
+	if err != nil || len(trades) != 1 || trades[0].Price.Cmp(ToBigInt("110")) != 0 {
+		t.Fatalf("auction should be uncrossed at 110, got: %s, %v", ToJSON(trades), err)
+	}
+	if ob.Phase() != PhaseContinuous {
+		t.Errorf("pair should be continuous after the auction, got: %s", ob.Phase())
+	}
+}
+
+func TestEngineExpireOrders(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	events := make(chan *CancelEvent, 10)
+	sub := engine.SubscribeCancelEvent(events)
+	defer sub.Unsubscribe()
+
+	expireTime := uint64(time.Now().Unix()) + 3600
+	gtd := func(quote *Quote) *Quote {
+		quote.PairName = "TOMO/WETH"
+		quote.TimeInForce = GTD
+		quote.ExpireTime = expireTime
+		return quote
+	}
+
+	resting := gtd(newTestQuote(Bid, "100", "20", "1"))
+	stop := gtd(&Quote{Type: StopLimit, Side: Ask, StopPrice: ToBigInt("90"), Price: ToBigInt("90"), Quantity: ToBigInt("30"), TradeID: "2"})
+	filled := gtd(newTestQuote(Ask, "200", "20", "3"))
+	for _, quote := range []*Quote{resting, stop, filled} {
+		if _, _, err := engine.ProcessOrder(quote); err != nil {
+			t.Fatalf("order should be accepted, got: %v", err)
+		}
+	}
+	taker := newTestQuote(Bid, "200", "20", "4")
+	taker.PairName = "TOMO/WETH"
+	engine.ProcessOrder(taker)
+
+	if expired := engine.ExpireOrders(expireTime - 1); len(expired) != 0 {
+		t.Fatalf("nothing should expire yet, got: %s", ToJSON(expired))
+	}
+	expired := engine.ExpireOrders(expireTime)
+	if len(expired) != 2 || expired[0].OrderID != resting.OrderID || expired[1].OrderID != stop.OrderID {
+		t.Fatalf("resting and stop orders should expire, got: %s", ToJSON(expired))
+	}
+	ob, _ := engine.GetOrderbook("TOMO/WETH")
+	if ob.Bids.NotEmpty() || ob.StopAsks.NotEmpty() {
+		t.Errorf("expired orders should be cancelled")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-events:
+			if ev.Reason != CancelReasonExpired {
+				t.Errorf("cancel event should be for expiry, got: %s", ev.Reason)
+			}
+		default:
+			t.Fatalf("a cancel event should be sent for each expired order")
+		}
+	}
+	if expired = engine.ExpireOrders(expireTime + 3600); len(expired) != 0 {
+		t.Errorf("expired orders should leave the index, got: %s", ToJSON(expired))
+	}
+}
+
+func TestEngineCancelAll(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	for _, quote := range []*Quote{
+		newTestQuote(Bid, "100", "20", "1"),
+		newTestQuote(Ask, "200", "20", "1"),
+		newTestQuote(Bid, "95", "30", "2"),
+		{Type: StopMarket, Side: Bid, StopPrice: ToBigInt("250"), Quantity: ToBigInt("20"), TradeID: "2"},
+	} {
+		quote.PairName = "TOMO/WETH"
+		if _, _, err := engine.ProcessOrder(quote); err != nil {
+			t.Fatalf("order should be accepted, got: %v", err)
+		}
+	}
+
+	if _, err := engine.CancelAll(&CancelFilter{}); err != ErrEmptyCancelFilter {
+		t.Errorf("empty filter should be rejected, got: %v", err)
+	}
+	if _, err := engine.CancelAll(&CancelFilter{PairName: "TOMO/WETH", Side: "buy"}); err != ErrInvalidSide {
+		t.Errorf("invalid side should be rejected, got: %v", err)
+	}
+
+	tests := []struct {
+		filter *CancelFilter
+		prices []string
+	}{
+		{&CancelFilter{PairName: "TOMO/WETH", TradeID: "1", Side: Bid}, []string{"100"}},
+		// every pair of the owner
+		{&CancelFilter{TradeID: "1"}, []string{"200"}},
+		// kill switch of the pair, stop orders included
+		{&CancelFilter{PairName: "TOMO/WETH"}, []string{"95", "250"}},
+	}
+	for i, test := range tests {
+		cancelled, err := engine.CancelAll(test.filter)
+		if err != nil || len(cancelled) != len(test.prices) {
+			t.Fatalf("case %d: got %d cancelled orders, want %d, err: %v", i, len(cancelled), len(test.prices), err)
+		}
+		for j, price := range test.prices {
+			if cancelled[j].Price.Cmp(ToBigInt(price)) != 0 {
+				t.Errorf("case %d: cancelled order at %v, want %s", i, cancelled[j].Price, price)
+			}
+		}
+	}
+
+	ob, _ := engine.GetOrderbook("TOMO/WETH")
+	if ob.Bids.NotEmpty() || ob.Asks.NotEmpty() || ob.StopBids.NotEmpty() {
+		t.Errorf("every order should be cancelled")
+	}
+}
+
+func TestEngineLedger(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+	engine.EnableLedger()
+
+	engine.Deposit("1", "WETH", ToBigInt("10000"))
+	engine.Deposit("2", "TOMO", ToBigInt("100"))
+	if err := engine.Deposit("2", "TOMO", ToBigInt("0")); err != ErrInvalidAmount {
+		t.Errorf("empty deposit should be refused, got: %v", err)
+	}
+
+	checkBalance := func(account, asset, available, locked string) {
+		t.Helper()
+		balance := engine.GetBalance(account, asset)
+		if balance.Available.Cmp(ToBigInt(available)) != 0 || balance.Locked.Cmp(ToBigInt(locked)) != 0 {
+			t.Errorf("%s of %s should be %s available and %s locked, got: %s", asset, account, available, locked, ToJSON(balance))
+		}
+	}
+	process := func(side, price, quantity, tradeID string) (*Quote, error) {
+		quote := newTestQuote(side, price, quantity, tradeID)
+		quote.PairName = "TOMO/WETH"
+		_, _, err := engine.ProcessOrder(quote)
+		return quote, err
+	}
+
+	bid, _ := process(Bid, "100", "50", "1")
+	checkBalance("1", "WETH", "5000", "5000")
+	rejected, err := process(Bid, "100", "60", "1")
+	if err != ErrInsufficientFunds {
+		t.Fatalf("order above the available balance should be rejected, got: %v", err)
+	}
+	checkBalance("1", "WETH", "5000", "5000")
+	if record, _ := engine.GetOrderRecord("TOMO/WETH", rejected.OrderID); record == nil || record.Status != OrderStatusRejected {
+		t.Errorf("order without funds should be recorded as rejected")
+	}
+
+	// fills move the funds from the locks, cancel releases the rest
+	process(Ask, "100", "30", "2")
+	checkBalance("1", "WETH", "5000", "2000")
+	checkBalance("1", "TOMO", "30", "0")
+	checkBalance("2", "TOMO", "70", "0")
+	checkBalance("2", "WETH", "3000", "0")
+	engine.CancelOrder(&Quote{PairName: "TOMO/WETH", OrderID: bid.OrderID})
+	checkBalance("1", "WETH", "7000", "0")
+
+	// price improvement is given back when the order is filled
+	process(Ask, "95", "30", "2")
+	checkBalance("2", "TOMO", "40", "30")
+	process(Bid, "100", "30", "1")
+	checkBalance("1", "WETH", "4150", "0")
+	checkBalance("1", "TOMO", "60", "0")
+	checkBalance("2", "TOMO", "40", "0")
+	checkBalance("2", "WETH", "5850", "0")
+
+	// amend locks the difference or is refused
+	bid, _ = process(Bid, "100", "20", "1")
+	amend := &Quote{PairName: "TOMO/WETH", Type: Limit, OrderID: bid.OrderID, Quantity: ToBigInt("50")}
+	if _, _, err = engine.ProcessOrder(amend); err != ErrInsufficientFunds {
+		t.Errorf("amend above the available balance should be refused, got: %v", err)
+	}
+	checkBalance("1", "WETH", "2150", "2000")
+	amend = &Quote{PairName: "TOMO/WETH", Type: Limit, OrderID: bid.OrderID, Quantity: ToBigInt("40")}
+	if _, _, err = engine.ProcessOrder(amend); err != nil {
+		t.Fatalf("amend should be accepted, got: %v", err)
+	}
+	checkBalance("1", "WETH", "150", "4000")
+
+	// a rejected post-only amend keeps the lock of the order
+	ask, _ := process(Ask, "105", "20", "2")
+	amend = &Quote{PairName: "TOMO/WETH", Type: Limit, OrderID: bid.OrderID, Price: ToBigInt("105"), Quantity: ToBigInt("20"), PostOnly: true}
+	if _, _, err = engine.ProcessOrder(amend); err != ErrPostOnlyWouldCross {
+		t.Errorf("post-only amend crossing the book should be refused, got: %v", err)
+	}
+	checkBalance("1", "WETH", "150", "4000")
+	engine.CancelOrder(&Quote{PairName: "TOMO/WETH", OrderID: ask.OrderID})
+
+	if err = engine.Withdraw("2", "TOMO", ToBigInt("50")); err != ErrInsufficientFunds {
+		t.Errorf("withdraw above the available balance should be refused, got: %v", err)
+	}
+	engine.Withdraw("2", "TOMO", ToBigInt("40"))
+	checkBalance("2", "TOMO", "0", "0")
+}
+
+func TestEngineBookDelta(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	deltas := make(chan *BookDelta, 10)
+	sub := engine.SubscribeBookDelta(deltas)
+	defer sub.Unsubscribe()
+
+	maker := newTestQuote(Ask, "100", "30", "1")
+	maker.PairName = "TOMO/WETH"
+	taker := newTestQuote(Bid, "100", "20", "2")
+	taker.PairName = "TOMO/WETH"
+	engine.ProcessOrder(maker)
+	// the snapshot is the base of the deltas that follow it
+	snapshot, err := engine.GetSnapshot("TOMO/WETH")
+	if err != nil || snapshot.Sequence != 2 || len(snapshot.Asks) != 1 || snapshot.Asks[0].OrderID != maker.OrderID {
+		t.Fatalf("snapshot should hold the maker at sequence 2, got: %s, %v", ToJSON(snapshot), err)
+	}
+	engine.ProcessOrder(taker)
+	engine.CancelOrder(maker)
+
+	want := []string{DeltaLevelCreate, DeltaAdd, DeltaUpdate, DeltaRemove, DeltaLevelDelete}
+	for i, kind := range want {
+		select {
+		case delta := <-deltas:
+			if delta.Kind != kind || delta.Sequence != uint64(i+1) || delta.Side != Ask || delta.PairName != "tomo/weth" {
+				t.Errorf("delta %d should be %s, got: %s", i, kind, ToJSON(delta))
+			}
+			if kind == DeltaUpdate && (delta.OrderID != maker.OrderID || delta.Quantity.Cmp(ToBigInt("10")) != 0) {
+				t.Errorf("update should show the rest of the maker, got: %s", ToJSON(delta))
+			}
+		default:
+			t.Fatalf("delta %d should be sent once the engine is unlocked", i)
+		}
+	}
+}
+
+func TestEngineTradeAndOrderEvents(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	trades := make(chan *Trade, 10)
+	tradeSub := engine.SubscribeTrades(trades)
+	defer tradeSub.Unsubscribe()
+	records := make(chan *OrderRecord, 10)
+	orderSub := engine.SubscribeOrderUpdates(records)
+	defer orderSub.Unsubscribe()
+
+	maker := newTestQuote(Ask, "100", "30", "1")
+	maker.PairName = "TOMO/WETH"
+	taker := newTestQuote(Bid, "100", "20", "2")
+	taker.PairName = "TOMO/WETH"
+	engine.ProcessOrder(maker)
+	engine.ProcessOrder(taker)
+
+	select {
+	case trade := <-trades:
+		if trade.MakerOrderID != maker.OrderID || trade.TakerOrderID != taker.OrderID || trade.Quantity.Cmp(ToBigInt("20")) != 0 {
+			t.Errorf("trade should be between the maker and the taker, got: %s", ToJSON(trade))
+		}
+	default:
+		t.Fatalf("trade should be sent once the engine is unlocked")
+	}
+
+	status := map[uint64]string{}
+	for len(records) > 0 {
+		record := <-records
+		status[record.OrderID] = record.Status
+	}
+	if status[maker.OrderID] != OrderStatusPartiallyFilled || status[taker.OrderID] != OrderStatusFilled {
+		t.Errorf("last update of each order should show its state, got: %v", status)
+	}
+}
+
+func TestEngineBestLists(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	var ids []uint64
+	for _, order := range []struct{ side, price, trader string }{
+		{Ask, "110", "1"}, {Ask, "105", "2"}, {Ask, "105", "3"}, {Bid, "95", "4"}, {Bid, "100", "5"},
+	} {
+		quote := newTestQuote(order.side, order.price, "30", order.trader)
+		quote.PairName = "TOMO/WETH"
+		_, orderInBook, err := engine.ProcessOrder(quote)
+		if err != nil {
+			t.Fatalf("order should be accepted, got: %v", err)
+		}
+		ids = append(ids, orderInBook.OrderID)
+	}
+
+	asks, err := engine.GetBestAskList("TOMO/WETH")
+	if err != nil || len(asks) != 2 || asks[0].Item.TradeID != "2" || asks[1].Item.TradeID != "3" {
+		t.Fatalf("best ask list should be the orders at 105 in queue order, got: %v %v", asks, err)
+	}
+	bids, _ := engine.GetBestBidList("TOMO/WETH")
+	if len(bids) != 1 || bids[0].Item.Price.Cmp(ToBigInt("100")) != 0 {
+		t.Fatalf("best bid list should be the order at 100, got: %v", bids)
+	}
+
+	// the copies do not change with the book
+	asks[0].Item.Quantity = ToBigInt("1")
+	order, location, _ := engine.GetOrderByID("TOMO/WETH", ids[1])
+	if order == nil || location.Side != Ask || order.Item.Quantity.Cmp(ToBigInt("30")) != 0 {
+		t.Fatalf("order should be found with its quantity, got: %v %v", order, location)
+	}
+	if order, _, _ = engine.GetOrderByID("TOMO/WETH", 100); order != nil {
+		t.Errorf("unknown order should not be found, got: %v", order)
+	}
+
+	// readers run while orders are processed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			engine.GetBestBidList("TOMO/WETH")
+			engine.GetOrder("TOMO/WETH", "1")
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		quote := newTestQuote(Bid, "90", "30", "6")
+		quote.PairName = "TOMO/WETH"
+		engine.ProcessOrder(quote)
+	}
+	<-done
+}
+
+func TestEngineAmend(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	iceberg := newTestQuote(Bid, "100", "300", "1")
+	iceberg.PairName = "TOMO/WETH"
+	iceberg.DisplayQuantity = ToBigInt("100")
+	_, orderInBook, err := engine.ProcessOrder(iceberg)
+	if err != nil || orderInBook == nil {
+		t.Fatalf("iceberg should rest, got: %v", err)
+	}
+
+	// an amend without quantity keeps the hidden reserve
+	for _, price := range []string{"105", "105"} {
+		amend := &Quote{PairName: "TOMO/WETH", Type: Limit, OrderID: orderInBook.OrderID, Price: ToBigInt(price)}
+		if _, _, err = engine.ProcessOrder(amend); err != nil {
+			t.Fatalf("amend should succeed, got: %v", err)
+		}
+		order, _, _ := engine.GetOrderByID("TOMO/WETH", orderInBook.OrderID)
+		if order == nil || order.RemainingQuantity().Cmp(ToBigInt("300")) != 0 || order.Item.Quantity.Cmp(ToBigInt("100")) != 0 {
+			t.Fatalf("amend at %s should keep the iceberg, got: %v", price, order)
+		}
+	}
+	stop := &Quote{PairName: "TOMO/WETH", Type: StopLimit, Side: Ask, StopPrice: ToBigInt("90"), Price: ToBigInt("90"), Quantity: ToBigInt("30"), TradeID: "1"}
+	if _, _, err = engine.ProcessOrder(stop); err != nil {
+		t.Fatalf("stop order should be accepted, got: %v", err)
+	}
+	amend := &Quote{PairName: "TOMO/WETH", Type: Limit, OrderID: stop.OrderID, Price: ToBigInt("95")}
+	if _, _, err = engine.ProcessOrder(amend); err != ErrAmendStopOrder {
+		t.Errorf("stop order should not be amended, got: %v", err)
+	}
+}
+
+func TestEngineSlowSubscriber(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	// nobody reads the slow channel, the engine must go on and drop it
+	slow := make(chan *BookDelta, 1)
+	slowSub := engine.SubscribeBookDelta(slow)
+	defer slowSub.Unsubscribe()
+	deltas := make(chan *BookDelta, 10)
+	sub := engine.SubscribeBookDelta(deltas)
+	defer sub.Unsubscribe()
+
+	quote := newTestQuote(Ask, "100", "30", "1")
+	quote.PairName = "TOMO/WETH"
+	done := make(chan struct{})
+	go func() {
+		engine.ProcessOrder(quote)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("engine should not wait for a slow subscriber")
+	}
+
+	if err := <-slowSub.Err(); err != ErrSubscriberTooSlow {
+		t.Errorf("slow subscriber should be dropped, got: %v", err)
+	}
+	if len(slow) != 1 || len(deltas) != 2 {
+		t.Errorf("subscribers that keep up should get every delta, got: %d %d", len(slow), len(deltas))
+	}
+	select {
+	case err := <-sub.Err():
+		t.Errorf("subscriber that keeps up should not be dropped, got: %v", err)
+	default:
+	}
+}
+
+func TestEngineLedgerSettlement(t *testing.T) {
+	engine, cleanup := newTestEngine()
+	defer cleanup()
+
+	process := func(side, price, quantity, tradeID string) *Quote {
+		quote := newTestQuote(side, price, quantity, tradeID)
+		quote.PairName = "TOMO/WETH"
+		engine.ProcessOrder(quote)
+		return quote
+	}
+	checkBalance := func(account, asset, available, locked string) {
+		t.Helper()
+		balance := engine.GetBalance(account, asset)
+		if balance.Available.Cmp(ToBigInt(available)) != 0 || balance.Locked.Cmp(ToBigInt(locked)) != 0 {
+			t.Errorf("%s of %s should be %s available and %s locked, got: %s", asset, account, available, locked, ToJSON(balance))
+		}
+	}
+
+	// resting before the ledger, its owner has nothing to deliver
+	unfunded := process(Ask, "100", "30", "3")
+	engine.EnableLedger()
+	engine.Deposit("1", "WETH", ToBigInt("10000"))
+	bid := process(Bid, "100", "30", "1")
+	if record, _ := engine.GetOrderRecord("TOMO/WETH", unfunded.OrderID); record == nil ||
+		record.Status != OrderStatusCancelled || record.Reason != ErrInsufficientFunds.Error() {
+		t.Fatalf("maker that can not pay should be cancelled, got: %s", ToJSON(record))
+	}
+	checkBalance("1", "WETH", "7000", "3000")
+	checkBalance("1", "TOMO", "0", "0")
+	checkBalance("3", "WETH", "0", "0")
+
+	// the rebate of the maker is more than the fee of the taker, the fee account pays the rest
+	engine.SetFeeSchedule("TOMO/WETH", &FeeSchedule{Tiers: []FeeTier{{MinVolume: Zero(), MakerBps: -20, TakerBps: 10}}})
+	engine.Deposit("2", "TOMO", ToBigInt("30"))
+	ask := process(Ask, "100", "20", "2")
+	if record, _ := engine.GetOrderRecord("TOMO/WETH", ask.OrderID); record == nil || record.Status != OrderStatusCancelled {
+		t.Fatalf("taker should be cancelled when the rebate can not be paid, got: %s", ToJSON(record))
+	}
+	checkBalance("2", "TOMO", "30", "0")
+
+	engine.Deposit(FeeAccount, "WETH", ToBigInt("10"))
+	process(Ask, "100", "20", "2")
+	checkBalance("1", "WETH", "7004", "1000")
+	checkBalance("1", "TOMO", "20", "0")
+	checkBalance("2", "WETH", "1998", "0")
+	checkBalance("2", "TOMO", "10", "0")
+	checkBalance(FeeAccount, "WETH", "8", "0")
+
+	// nothing is created or lost
+	total := Zero()
+	for _, account := range []string{"1", "2", "3", FeeAccount} {
+		balance := engine.GetBalance(account, "WETH")
+		total = Add(total, Add(balance.Available, balance.Locked))
+	}
+	if total.Cmp(ToBigInt("10010")) != 0 {
+		t.Errorf("quote currency should be conserved, got: %v", total)
+	}
+	engine.CancelOrder(&Quote{PairName: "TOMO/WETH", OrderID: bid.OrderID})
+	checkBalance("1", "WETH", "8004", "0")
+}
@@ -0,0 +1,151 @@
+package orderbook
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// ErrSubscriberTooSlow : the channel of the subscriber was full, it is unsubscribed and misses the
+// events from then on
+var ErrSubscriberTooSlow = errors.New("subscriber is too slow, events were dropped")
+
+// eventFeed : sends every event to its subscribers without ever waiting for them, so that a slow
+// subscriber can not hold up the engine. A subscriber whose channel is full is dropped and its
+// subscription fails with ErrSubscriberTooSlow
+type eventFeed struct {
+	mu   sync.Mutex
+	subs map[*feedSub]struct{}
+}
+
+type feedSub struct {
+	feed *eventFeed
+	// send : deliver the event unless the channel is full
+	send func(value interface{}) bool
+	err  chan error
+	once sync.Once
+}
+
+func (feed *eventFeed) subscribe(send func(value interface{}) bool) event.Subscription {
+	sub := &feedSub{feed: feed, send: send, err: make(chan error, 1)}
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	if feed.subs == nil {
+		feed.subs = make(map[*feedSub]struct{})
+	}
+	feed.subs[sub] = struct{}{}
+	return sub
+}
+
+// send : deliver the event to every subscriber that keeps up and drop the others
+func (feed *eventFeed) send(value interface{}) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	for sub := range feed.subs {
+		if !sub.send(value) {
+			delete(feed.subs, sub)
+			sub.close(ErrSubscriberTooSlow)
+		}
+	}
+}
+
+func (feed *eventFeed) remove(sub *feedSub) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	delete(feed.subs, sub)
+}
+
+func (sub *feedSub) close(err error) {
+	sub.once.Do(func() {
+		if err != nil {
+			sub.err <- err
+		}
+		close(sub.err)
+	})
+}
+
+// Unsubscribe : stop the events, Err is closed
+func (sub *feedSub) Unsubscribe() {
+	sub.feed.remove(sub)
+	sub.close(nil)
+}
+
+// Err : receives ErrSubscriberTooSlow when the subscriber is dropped, closed once it is unsubscribed
+func (sub *feedSub) Err() <-chan error {
+	return sub.err
+}
+
+// queueDelta : keep the delta until the engine is unlocked
+func (engine *Engine) queueDelta(delta *BookDelta) {
+	engine.deltas = append(engine.deltas, delta)
+}
+
+func (engine *Engine) queueTrades(trades []*Trade) {
+	engine.trades = append(engine.trades, trades...)
+}
+
+func (engine *Engine) queueOrderUpdate(record *OrderRecord) {
+	engine.records = append(engine.records, record)
+}
+
+// sendEvents : send the queued events in the order they happened, deferred before the engine is
+// locked so that subscribers are called once it is unlocked and can call the engine themselves
+func (engine *Engine) sendEvents() {
+	engine.eventMu.Lock()
+	defer engine.eventMu.Unlock()
+
+	engine.mu.Lock()
+	deltas, trades, records := engine.deltas, engine.trades, engine.records
+	engine.deltas, engine.trades, engine.records = nil, nil, nil
+	engine.mu.Unlock()
+
+	for _, delta := range deltas {
+		engine.deltaFeed.send(delta)
+	}
+	for _, trade := range trades {
+		engine.tradeFeed.send(trade)
+	}
+	for _, record := range records {
+		engine.orderFeed.send(record)
+	}
+}
+
+// SubscribeBookDelta : receive every change of the books in sequence order, the subscription fails
+// with ErrSubscriberTooSlow when the channel is full
+func (engine *Engine) SubscribeBookDelta(ch chan<- *BookDelta) event.Subscription {
+	return engine.deltaFeed.subscribe(func(value interface{}) bool {
+		select {
+		case ch <- value.(*BookDelta):
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// SubscribeTrades : receive the execution report of every fill of every pair, the subscription fails
+// with ErrSubscriberTooSlow when the channel is full
+func (engine *Engine) SubscribeTrades(ch chan<- *Trade) event.Subscription {
+	return engine.tradeFeed.subscribe(func(value interface{}) bool {
+		select {
+		case ch <- value.(*Trade):
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// SubscribeOrderUpdates : receive the record of every order every time its state or its fills change,
+// the subscription fails with ErrSubscriberTooSlow when the channel is full
+func (engine *Engine) SubscribeOrderUpdates(ch chan<- *OrderRecord) event.Subscription {
+	return engine.orderFeed.subscribe(func(value interface{}) bool {
+		select {
+		case ch <- value.(*OrderRecord):
+			return true
+		default:
+			return false
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package orderbook
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/event"
+	demo "github.com/novaprotocolio/orderbook/common"
+)
+
+// CancelReasonExpired : good till date order reached its expire time
+const CancelReasonExpired = "expired"
+
+// CancelEvent : order cancelled by the engine instead of its owner
+type CancelEvent struct {
+	Quote  *Quote
+	Reason string
+}
+
+// expiryIndex : good till date orders in a tree keyed by expire time then order id, so that
+// the orders to expire are always at the min of the tree. The tree is stored like a price tree
+type expiryIndex struct {
+	db   *BatchDatabase
+	tree *RedBlackTreeExtended
+	Key  []byte
+	slot *big.Int
+	Item *OrderTreeItem
+}
+
+func newExpiryIndex(db *BatchDatabase, key []byte) *expiryIndex {
+	return &expiryIndex{
+		db:   db,
+		tree: NewRedBlackTreeExtended(db),
+		Key:  key,
+		slot: new(big.Int).SetBytes(key),
+		Item: &OrderTreeItem{Volume: Zero()},
+	}
+}
+
+func (index *expiryIndex) Save() error {
+	root := index.tree.Root()
+	if root != nil {
+		index.Item.PriceTreeKey = root.Key
+	}
+	index.Item.PriceTreeSize = index.tree.Size()
+	return index.db.Put(index.Key, index.Item)
+}
+
+func (index *expiryIndex) Restore() error {
+	val, err := index.db.Get(index.Key, index.Item)
+	if err == nil {
+		index.Item = val.(*OrderTreeItem)
+		index.tree.SetRootKey(index.Item.PriceTreeKey, index.Item.PriceTreeSize)
+	}
+	return err
+}
+
+func (index *expiryIndex) getKey(expireTime, orderID uint64) []byte {
+	offset := new(big.Int).Lsh(new(big.Int).SetUint64(expireTime), 64)
+	return GetKeyFromBig(Add(index.slot, offset.Or(offset, new(big.Int).SetUint64(orderID))))
+}
+
+// put : add the order, the location of the order is kept by the order index
+func (index *expiryIndex) put(expireTime, orderID uint64) error {
+	if err := index.tree.Put(index.getKey(expireTime, orderID), []byte{}); err != nil {
+		return err
+	}
+	return index.Save()
+}
+
+// popExpired : remove and return the ids of the orders that expire at or before now, in expiry then id order
+func (index *expiryIndex) popExpired(now uint64) []uint64 {
+	var orderIDs []uint64
+	for !index.tree.Empty() {
+		node, found := index.tree.getMinFromNode(index.tree.Root())
+		if !found || node == nil {
+			break
+		}
+		offset := Sub(new(big.Int).SetBytes(node.Key), index.slot)
+		if new(big.Int).Rsh(offset, 64).Uint64() > now {
+			break
+		}
+		orderIDs = append(orderIDs, offset.Uint64())
+		index.tree.Remove(node.Key)
+	}
+	index.Save()
+	return orderIDs
+}
+
+// addExpiry : index the resting good till date order by its expire time
+func (orderBook *Orderbook) addExpiry(quote *Quote) error {
+	if quote.TimeInForce != GTD {
+		return nil
+	}
+	return orderBook.expiries.put(quote.ExpireTime, quote.OrderID)
+}
+
+// popExpiredOrders : remove the orders that expire at or before now from the index and return
+// the ones still resting, as quotes that can be used to cancel them. An order that can not be
+// cancelled must be added to the index again
+func (orderBook *Orderbook) popExpiredOrders(now uint64) []*Quote {
+	var quotes []*Quote
+	for _, orderID := range orderBook.expiries.popExpired(now) {
+		order, location := orderBook.GetOrderByID(orderID)
+		// filled or cancelled meanwhile, nothing to expire
+		if order == nil {
+			continue
+		}
+		quotes = append(quotes, &Quote{
+			PairName:    orderBook.Item.Name,
+			OrderID:     orderID,
+			Side:        location.Side,
+			Price:       CloneBigInt(location.Price),
+			TradeID:     order.Item.TradeID,
+			TimeInForce: GTD,
+			ExpireTime:  order.Item.ExpireTime,
+		})
+	}
+	return quotes
+}
+
+// ExpireOrders : cancel the good till date orders of every pair that expire at or before now through
+// CancelOrder, a cancel event is sent for each of them
+func (engine *Engine) ExpireOrders(now uint64) []*Quote {
+	defer engine.sendEvents()
+	expired := engine.expireOrders(now)
+	// subscribers may call the engine, so the events are sent after it is unlocked
+	for _, quote := range expired {
+		engine.cancelFeed.Send(&CancelEvent{Quote: quote, Reason: CancelReasonExpired})
+	}
+	return expired
+}
+
+func (engine *Engine) expireOrders(now uint64) []*Quote {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	var expired []*Quote
+	// pairs that were not loaded since the restart may have expired orders as well
+	for name := range engine.instruments {
+		ob, err := engine.getAndCreateIfNotExisted(name)
+		if ob == nil {
+			demo.LogError("Load orderbook for expiry failed", "pair", name, "err", err)
+			continue
+		}
+		for _, quote := range ob.popExpiredOrders(now) {
+			if err = ob.ExpireOrder(quote.OrderID); err != nil {
+				demo.LogError("Cancel expired order failed", "quote", quote, "err", err)
+				// the order is still resting, it is expired again at the next run
+				if err = ob.addExpiry(quote); err != nil {
+					demo.LogError("Index expired order failed", "quote", quote, "err", err)
+				}
+				continue
+			}
+			expired = append(expired, quote)
+		}
+		ob.Save()
+	}
+	return expired
+}
+
+// StartExpiryScheduler : cancel the expired orders every interval until StopExpiryScheduler
+func (engine *Engine) StartExpiryScheduler(interval time.Duration) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if engine.quitC != nil {
+		return
+	}
+	quitC := make(chan struct{})
+	engine.quitC = quitC
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				engine.ExpireOrders(uint64(time.Now().Unix()))
+			case <-quitC:
+				return
+			}
+		}
+	}()
+}
+
+// StopExpiryScheduler : stop the scheduler started by StartExpiryScheduler
+func (engine *Engine) StopExpiryScheduler() {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if engine.quitC != nil {
+		close(engine.quitC)
+		engine.quitC = nil
+	}
+}
+
+// SubscribeCancelEvent : receive the orders cancelled by the engine itself
+func (engine *Engine) SubscribeCancelEvent(ch chan<- *CancelEvent) event.Subscription {
+	return engine.cancelFeed.Subscribe(ch)
+}
@@ -0,0 +1,137 @@
+package orderbook
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	ErrInvalidFeeSchedule = errors.New("fee tiers must start at zero volume, be sorted and have non-negative taker fee")
+)
+
+// FeeTier : fee rates in bps of the traded amount (price * quantity, in quote currency), applied to an
+// account once its traded amount on the pair reaches MinVolume, negative maker rate is a rebate
+type FeeTier struct {
+	MinVolume *big.Int `json:"minVolume"`
+	MakerBps  int64    `json:"makerBps"`
+	TakerBps  int64    `json:"takerBps"`
+}
+
+// FeeSchedule : fee tiers of a pair sorted by MinVolume
+type FeeSchedule struct {
+	Tiers []FeeTier `json:"tiers"`
+}
+
+// AccountFeeItem : fee totals of an account on one pair, fees and rebates are kept apart
+// so that the stored values are never negative
+type AccountFeeItem struct {
+	Volume          *big.Int `json:"volume"`
+	FeesPaid        *big.Int `json:"feesPaid"`
+	RebatesReceived *big.Int `json:"rebatesReceived"`
+}
+
+// Validate : check the tiers can be used
+func (schedule *FeeSchedule) Validate() error {
+	if len(schedule.Tiers) == 0 || schedule.Tiers[0].MinVolume == nil || schedule.Tiers[0].MinVolume.Sign() != 0 {
+		return ErrInvalidFeeSchedule
+	}
+	for i, tier := range schedule.Tiers {
+		if tier.MinVolume == nil || tier.TakerBps < 0 {
+			return ErrInvalidFeeSchedule
+		}
+		if i > 0 && !IsStrictlyGreaterThan(tier.MinVolume, schedule.Tiers[i-1].MinVolume) {
+			return ErrInvalidFeeSchedule
+		}
+	}
+	return nil
+}
+
+// Tier : the highest tier reached by the traded amount
+func (schedule *FeeSchedule) Tier(volume *big.Int) FeeTier {
+	tier := schedule.Tiers[0]
+	for _, next := range schedule.Tiers[1:] {
+		if IsStrictlySmallerThan(volume, next.MinVolume) {
+			break
+		}
+		tier = next
+	}
+	return tier
+}
+
+// MaxBps : highest rate an account may pay, zero when every tier pays rebates
+func (schedule *FeeSchedule) MaxBps() int64 {
+	var bps int64
+	for _, tier := range schedule.Tiers {
+		if tier.MakerBps > bps {
+			bps = tier.MakerBps
+		}
+		if tier.TakerBps > bps {
+			bps = tier.TakerBps
+		}
+	}
+	return bps
+}
+
+func computeFee(amount *big.Int, bps int64) *big.Int {
+	return Div(Mul(amount, big.NewInt(bps)), big.NewInt(BpsDenominator))
+}
+
+func (orderBook *Orderbook) getAccountFeeKey(account string) []byte {
+	return crypto.Keccak256(orderBook.feeKey, []byte(account))
+}
+
+// GetAccountFees : fee totals of the account, zero when it has not traded yet
+func (orderBook *Orderbook) GetAccountFees(account string) *AccountFeeItem {
+	val, err := orderBook.db.Get(orderBook.getAccountFeeKey(account), &AccountFeeItem{})
+	if err != nil || val == nil {
+		return &AccountFeeItem{
+			Volume:          Zero(),
+			FeesPaid:        Zero(),
+			RebatesReceived: Zero(),
+		}
+	}
+	return val.(*AccountFeeItem)
+}
+
+// computeFees : put the maker and taker fees of the fill in the trade, the tier is decided by the
+// traded amount of the account before this fill
+func (orderBook *Orderbook) computeFees(trade *Trade) {
+	trade.MakerFee = Zero()
+	trade.TakerFee = Zero()
+	if orderBook.FeeSchedule == nil {
+		return
+	}
+
+	amount := Mul(trade.Price, trade.Quantity)
+	makerFees := orderBook.GetAccountFees(trade.MakerTradeID)
+	takerFees := orderBook.GetAccountFees(trade.TakerTradeID)
+	trade.MakerFee = computeFee(amount, orderBook.FeeSchedule.Tier(makerFees.Volume).MakerBps)
+	trade.TakerFee = computeFee(amount, orderBook.FeeSchedule.Tier(takerFees.Volume).TakerBps)
+}
+
+// chargeFees : add the fees of the fill to the account totals
+func (orderBook *Orderbook) chargeFees(trade *Trade) {
+	if orderBook.FeeSchedule == nil {
+		return
+	}
+	amount := Mul(trade.Price, trade.Quantity)
+	orderBook.addAccountFee(trade.MakerTradeID, orderBook.GetAccountFees(trade.MakerTradeID), amount, trade.MakerFee)
+	// loaded after the maker part is saved, the same account may be on both sides
+	orderBook.addAccountFee(trade.TakerTradeID, orderBook.GetAccountFees(trade.TakerTradeID), amount, trade.TakerFee)
+}
+
+func (orderBook *Orderbook) addAccountFee(account string, item *AccountFeeItem, amount, fee *big.Int) {
+	// orders without owner have no account
+	if account == "" {
+		return
+	}
+	item.Volume = Add(item.Volume, amount)
+	if fee.Sign() >= 0 {
+		item.FeesPaid = Add(item.FeesPaid, fee)
+	} else {
+		item.RebatesReceived = Sub(item.RebatesReceived, fee)
+	}
+	orderBook.db.Put(orderBook.getAccountFeeKey(account), item)
+}
@@ -0,0 +1,204 @@
+package orderbook
+
+import (
+	"errors"
+	"math/big"
+)
+
+var ErrOrderRecordNotFound = errors.New("order is unknown")
+
+// lifecycle states of an order
+const (
+	// OrderStatusNew : accepted, resting in the book or in the trigger book without any fill
+	OrderStatusNew = "new"
+	// OrderStatusPartiallyFilled : filled in part, the rest still resting
+	OrderStatusPartiallyFilled = "partially_filled"
+	// OrderStatusFilled : filled completely
+	OrderStatusFilled = "filled"
+	// OrderStatusCancelled : the rest was cancelled by the owner, by self-trade prevention or
+	// because it could not rest (IOC, market order)
+	OrderStatusCancelled = "cancelled"
+	// OrderStatusExpired : the rest of a good till date order was cancelled at its expire time
+	OrderStatusExpired = "expired"
+	// OrderStatusRejected : refused after it got its order id, e.g. FOK not filled or post-only crossing
+	OrderStatusRejected = "rejected"
+)
+
+// OrderRecord : lifecycle of one order, kept in the history keyspace of the pair so that the order
+// can still be queried after it leaves the book
+type OrderRecord struct {
+	OrderID   uint64   `json:"orderID"`
+	PairName  string   `json:"pairName"`
+	Type      string   `json:"type"`
+	Side      string   `json:"side"`
+	Price     *big.Int `json:"price"`
+	StopPrice *big.Int `json:"stopPrice"`
+	// filled plus remaining quantity, zero for a market buy by amount
+	Quantity *big.Int `json:"quantity"`
+	TradeID  string   `json:"tradeID"`
+	Status   string   `json:"status"`
+	// cumulative over all fills, the average price is the filled amount over the filled quantity
+	FilledQuantity *big.Int `json:"filledQuantity"`
+	FilledAmount   *big.Int `json:"filledAmount"`
+	AveragePrice   *big.Int `json:"averagePrice"`
+	// why the order was rejected
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt uint64 `json:"createdAt"`
+	UpdatedAt uint64 `json:"updatedAt"`
+}
+
+// IsFinal : the order can not change any more
+func (record *OrderRecord) IsFinal() bool {
+	switch record.Status {
+	case OrderStatusFilled, OrderStatusCancelled, OrderStatusExpired, OrderStatusRejected:
+		return true
+	}
+	return false
+}
+
+func (record *OrderRecord) addFill(price, quantity *big.Int) {
+	record.FilledQuantity = Add(record.FilledQuantity, quantity)
+	record.FilledAmount = Add(record.FilledAmount, Mul(price, quantity))
+	record.AveragePrice = Div(record.FilledAmount, record.FilledQuantity)
+}
+
+func (orderBook *Orderbook) getHistoryKey(orderID uint64) []byte {
+	return GetKeyFromBig(Add(orderBook.historySlot, new(big.Int).SetUint64(orderID)))
+}
+
+// GetOrderRecord : lifecycle of the order, nil when the order id is unknown
+func (orderBook *Orderbook) GetOrderRecord(orderID uint64) *OrderRecord {
+	val, err := orderBook.db.Get(orderBook.getHistoryKey(orderID), &OrderRecord{})
+	if err != nil || val == nil {
+		return nil
+	}
+	return val.(*OrderRecord)
+}
+
+func (orderBook *Orderbook) saveRecord(record *OrderRecord) error {
+	record.UpdatedAt = orderBook.Item.Timestamp
+	// what a finished order still locks goes back to its owner
+	if record.IsFinal() {
+		orderBook.releaseFunds(record.OrderID)
+	}
+	if orderBook.OnOrderUpdate != nil {
+		update := *record
+		orderBook.OnOrderUpdate(&update)
+	}
+	return orderBook.db.Put(orderBook.getHistoryKey(record.OrderID), record)
+}
+
+// openRecord : start the lifecycle of the quote that just got its order id
+func (orderBook *Orderbook) openRecord(quote *Quote) error {
+	record := &OrderRecord{
+		OrderID:        quote.OrderID,
+		PairName:       orderBook.Item.Name,
+		Type:           quote.Type,
+		Side:           quote.Side,
+		Price:          Zero(),
+		StopPrice:      Zero(),
+		Quantity:       Zero(),
+		TradeID:        quote.TradeID,
+		Status:         OrderStatusNew,
+		FilledQuantity: Zero(),
+		FilledAmount:   Zero(),
+		AveragePrice:   Zero(),
+		CreatedAt:      orderBook.Item.Timestamp,
+	}
+	if quote.Price != nil {
+		record.Price = CloneBigInt(quote.Price)
+	}
+	if quote.StopPrice != nil {
+		record.StopPrice = CloneBigInt(quote.StopPrice)
+	}
+	if quote.Quantity != nil {
+		record.Quantity = CloneBigInt(quote.Quantity)
+	}
+	return orderBook.saveRecord(record)
+}
+
+// recordTrade : add the fill to the maker and the taker
+func (orderBook *Orderbook) recordTrade(trade *Trade) {
+	orderBook.recordFill(trade.MakerOrderID, trade.Price, trade.Quantity, trade.MakerFilled)
+	orderBook.recordFill(trade.TakerOrderID, trade.Price, trade.Quantity, trade.TakerFilled)
+}
+
+func (orderBook *Orderbook) recordFill(orderID uint64, price, quantity *big.Int, filled bool) {
+	record := orderBook.GetOrderRecord(orderID)
+	if record == nil {
+		return
+	}
+	record.addFill(price, quantity)
+	record.Status = OrderStatusPartiallyFilled
+	if filled {
+		record.Status = OrderStatusFilled
+	}
+	orderBook.saveRecord(record)
+}
+
+// closeRecord : the order left the book without being filled completely
+func (orderBook *Orderbook) closeRecord(orderID uint64, status, reason string) {
+	record := orderBook.GetOrderRecord(orderID)
+	if record == nil || record.IsFinal() {
+		return
+	}
+	record.Status = status
+	record.Reason = reason
+	orderBook.saveRecord(record)
+}
+
+// finishRecord : state of the processed quote, an order that does not rest is either filled or
+// its rest is cancelled
+func (orderBook *Orderbook) finishRecord(quote *Quote, orderInBook *Quote, err error) {
+	if err != nil {
+		orderBook.closeRecord(quote.OrderID, OrderStatusRejected, err.Error())
+		return
+	}
+	record := orderBook.GetOrderRecord(quote.OrderID)
+	if record == nil || orderInBook != nil {
+		return
+	}
+
+	var filled bool
+	if record.Quantity.Sign() > 0 {
+		filled = IsEqualOrGreaterThan(record.FilledQuantity, record.Quantity)
+	} else {
+		// a market buy by amount is filled when the rest of the amount can not buy one more unit
+		filled = record.FilledQuantity.Sign() > 0 &&
+			(quote.Unspent == nil || IsStrictlySmallerThan(quote.Unspent, record.AveragePrice))
+	}
+	record.Status = OrderStatusCancelled
+	if filled {
+		record.Status = OrderStatusFilled
+	}
+	orderBook.saveRecord(record)
+}
+
+// amendRecord : the amended order keeps its fills, its quantity is what was filled plus the new remaining
+func (orderBook *Orderbook) amendRecord(orderID uint64, price, remaining *big.Int) {
+	record := orderBook.GetOrderRecord(orderID)
+	if record == nil {
+		return
+	}
+	record.Price = CloneBigInt(price)
+	record.Quantity = Add(record.FilledQuantity, remaining)
+	orderBook.saveRecord(record)
+}
+
+// GetOrderRecord : lifecycle of the order of the pair, also after it left the book
+func (engine *Engine) GetOrderRecord(pairName string, orderID uint64) (*OrderRecord, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, err
+	}
+	record := ob.GetOrderRecord(orderID)
+	if record == nil {
+		return nil, ErrOrderRecordNotFound
+	}
+	// the stored record keeps changing with the order, its fields are replaced and never updated in place
+	result := *record
+	return &result, nil
+}
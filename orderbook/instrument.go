@@ -0,0 +1,93 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	ErrInvalidInstrument = errors.New("instrument must have positive tick and lot size, and min quantity not above max quantity")
+	ErrPriceNotOnTick    = errors.New("price is not a multiple of the tick size")
+	ErrQuantityNotOnLot  = errors.New("quantity is not a multiple of the lot size")
+	ErrQuantityTooSmall  = errors.New("quantity is below the minimum order size")
+	ErrQuantityTooLarge  = errors.New("quantity is above the maximum order size")
+	ErrNotionalTooSmall  = errors.New("price * quantity is below the minimum notional")
+)
+
+// Instrument : trading rules of a pair, nil limits are not checked
+type Instrument struct {
+	BaseAsset   string   `json:"baseAsset"`
+	QuoteAsset  string   `json:"quoteAsset"`
+	TickSize    *big.Int `json:"tickSize"`
+	LotSize     *big.Int `json:"lotSize"`
+	MinQuantity *big.Int `json:"minQuantity"`
+	MaxQuantity *big.Int `json:"maxQuantity"`
+	// minimum price * quantity, in quote currency
+	MinNotional *big.Int `json:"minNotional"`
+}
+
+// RejectError : the order does not conform to the instrument of the pair, Reason is one of the
+// ErrPriceNotOnTick, ErrQuantityNotOnLot, ErrQuantityTooSmall, ErrQuantityTooLarge or ErrNotionalTooSmall
+type RejectError struct {
+	PairName string
+	Reason   error
+}
+
+func (err *RejectError) Error() string {
+	return fmt.Sprintf("Order rejected for pair %s: %v", err.PairName, err.Reason)
+}
+
+// Validate : check the instrument can be used
+func (instrument *Instrument) Validate() error {
+	if instrument.TickSize == nil || instrument.TickSize.Sign() <= 0 ||
+		instrument.LotSize == nil || instrument.LotSize.Sign() <= 0 {
+		return ErrInvalidInstrument
+	}
+	if instrument.MinQuantity != nil && instrument.MaxQuantity != nil &&
+		IsStrictlyGreaterThan(instrument.MinQuantity, instrument.MaxQuantity) {
+		return ErrInvalidInstrument
+	}
+	return nil
+}
+
+func isMultipleOf(value, step *big.Int) bool {
+	return new(big.Int).Mod(value, step).Sign() == 0
+}
+
+// Check : reason why the quote does not conform to the instrument, nil when it does
+func (instrument *Instrument) Check(quote *Quote) error {
+	for _, price := range []*big.Int{quote.Price, quote.StopPrice, quote.ProtectionPrice} {
+		if price != nil && price.Sign() > 0 && !isMultipleOf(price, instrument.TickSize) {
+			return ErrPriceNotOnTick
+		}
+	}
+
+	// market buy by amount has no base quantity, only the notional can be checked
+	if quote.QuoteQuantity != nil {
+		if instrument.MinNotional != nil && IsStrictlySmallerThan(quote.QuoteQuantity, instrument.MinNotional) {
+			return ErrNotionalTooSmall
+		}
+		return nil
+	}
+
+	if quote.Quantity == nil {
+		return nil
+	}
+	if !isMultipleOf(quote.Quantity, instrument.LotSize) ||
+		(quote.DisplayQuantity != nil && !isMultipleOf(quote.DisplayQuantity, instrument.LotSize)) {
+		return ErrQuantityNotOnLot
+	}
+	if instrument.MinQuantity != nil && IsStrictlySmallerThan(quote.Quantity, instrument.MinQuantity) {
+		return ErrQuantityTooSmall
+	}
+	if instrument.MaxQuantity != nil && IsStrictlyGreaterThan(quote.Quantity, instrument.MaxQuantity) {
+		return ErrQuantityTooLarge
+	}
+	// price of market order is not known before matching
+	if instrument.MinNotional != nil && !quote.IsMarket() && quote.Price != nil &&
+		IsStrictlySmallerThan(Mul(quote.Price, quote.Quantity), instrument.MinNotional) {
+		return ErrNotionalTooSmall
+	}
+	return nil
+}
@@ -0,0 +1,466 @@
+package orderbook
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// reservedAccountPrefix : accounts of the ledger itself start with it, a trade id can not
+	reservedAccountPrefix = "#"
+	// FeeAccount : account of the ledger that collects the fees of every pair and pays the maker
+	// rebates, a rebate is only paid when it holds enough of the quote currency
+	FeeAccount = reservedAccountPrefix + "fees"
+)
+
+var (
+	ErrInsufficientFunds  = errors.New("available balance is not enough for the order")
+	ErrInvalidAmount      = errors.New("amount must be greater than zero")
+	ErrUnboundedMarketBuy = errors.New("stop market buy needs a protection price or a quote quantity to lock funds")
+)
+
+// isReservedAccount : the account belongs to the ledger and is not the trade id of a trader
+func isReservedAccount(account string) bool {
+	return strings.HasPrefix(account, reservedAccountPrefix)
+}
+
+// Balance : funds of an account in one asset, locked funds are reserved by open orders
+type Balance struct {
+	Available *big.Int `json:"available"`
+	Locked    *big.Int `json:"locked"`
+}
+
+// OrderLockItem : funds still locked by an open order, in the asset it pays with
+type OrderLockItem struct {
+	Account string   `json:"account"`
+	Asset   string   `json:"asset"`
+	Amount  *big.Int `json:"amount"`
+}
+
+// Ledger : available and locked balances of every account per asset, the account is the trade id or
+// a reserved account of the ledger such as FeeAccount
+type Ledger struct {
+	db  *BatchDatabase
+	key []byte
+}
+
+// NewLedger : ledger stored in the database of the orderbooks
+func NewLedger(db *BatchDatabase) *Ledger {
+	return &Ledger{
+		db:  db,
+		key: crypto.Keccak256([]byte("ledger")),
+	}
+}
+
+func (ledger *Ledger) getBalanceKey(account, asset string) []byte {
+	return crypto.Keccak256(crypto.Keccak256(ledger.key, []byte(account)), []byte(strings.ToLower(asset)))
+}
+
+// GetBalance : balance of the account in the asset, zero when it never had any
+func (ledger *Ledger) GetBalance(account, asset string) *Balance {
+	val, err := ledger.db.Get(ledger.getBalanceKey(account, asset), &Balance{})
+	if err != nil || val == nil {
+		return &Balance{
+			Available: Zero(),
+			Locked:    Zero(),
+		}
+	}
+	return val.(*Balance)
+}
+
+func (ledger *Ledger) putBalance(account, asset string, balance *Balance) error {
+	return ledger.db.Put(ledger.getBalanceKey(account, asset), balance)
+}
+
+// Deposit : add the amount to the available balance
+func (ledger *Ledger) Deposit(account, asset string, amount *big.Int) error {
+	if amount == nil || amount.Sign() <= 0 {
+		return ErrInvalidAmount
+	}
+	return ledger.credit(account, asset, amount)
+}
+
+// Withdraw : take the amount from the available balance, locked funds can not be withdrawn
+func (ledger *Ledger) Withdraw(account, asset string, amount *big.Int) error {
+	if amount == nil || amount.Sign() <= 0 {
+		return ErrInvalidAmount
+	}
+	balance := ledger.GetBalance(account, asset)
+	if IsStrictlySmallerThan(balance.Available, amount) {
+		return ErrInsufficientFunds
+	}
+	balance.Available = Sub(balance.Available, amount)
+	return ledger.putBalance(account, asset, balance)
+}
+
+func (ledger *Ledger) credit(account, asset string, amount *big.Int) error {
+	balance := ledger.GetBalance(account, asset)
+	balance.Available = Add(balance.Available, amount)
+	return ledger.putBalance(account, asset, balance)
+}
+
+// lock : move the amount from the available to the locked balance
+func (ledger *Ledger) lock(account, asset string, amount *big.Int) error {
+	balance := ledger.GetBalance(account, asset)
+	if IsStrictlySmallerThan(balance.Available, amount) {
+		return ErrInsufficientFunds
+	}
+	balance.Available = Sub(balance.Available, amount)
+	balance.Locked = Add(balance.Locked, amount)
+	return ledger.putBalance(account, asset, balance)
+}
+
+// unlock : move the amount from the locked back to the available balance
+func (ledger *Ledger) unlock(account, asset string, amount *big.Int) error {
+	if amount.Sign() <= 0 {
+		return nil
+	}
+	balance := ledger.GetBalance(account, asset)
+	amount = minBigInt(amount, balance.Locked)
+	balance.Locked = Sub(balance.Locked, amount)
+	balance.Available = Add(balance.Available, amount)
+	return ledger.putBalance(account, asset, balance)
+}
+
+// spend : take the first amount from the locked and the second from the available balance, the
+// balance is left as it was when it does not have them
+func (ledger *Ledger) spend(account, asset string, fromLocked, fromAvailable *big.Int) error {
+	balance := ledger.GetBalance(account, asset)
+	if IsStrictlySmallerThan(balance.Locked, fromLocked) || IsStrictlySmallerThan(balance.Available, fromAvailable) {
+		return ErrInsufficientFunds
+	}
+	balance.Locked = Sub(balance.Locked, fromLocked)
+	balance.Available = Sub(balance.Available, fromAvailable)
+	return ledger.putBalance(account, asset, balance)
+}
+
+func (orderBook *Orderbook) getLockKey(orderID uint64) []byte {
+	return GetKeyFromBig(Add(orderBook.lockSlot, new(big.Int).SetUint64(orderID)))
+}
+
+func (orderBook *Orderbook) getOrderLock(orderID uint64) *OrderLockItem {
+	val, err := orderBook.db.Get(orderBook.getLockKey(orderID), &OrderLockItem{})
+	if err != nil || val == nil {
+		return nil
+	}
+	return val.(*OrderLockItem)
+}
+
+// feeReserve : highest fee the buyer may pay for the amount, it is locked with the amount
+func (orderBook *Orderbook) feeReserve(amount *big.Int) *big.Int {
+	if orderBook.FeeSchedule == nil {
+		return Zero()
+	}
+	return computeFee(amount, orderBook.FeeSchedule.MaxBps())
+}
+
+// buyFunds : quote currency the buy order locks for the quantity at the price
+func (orderBook *Orderbook) buyFunds(price, quantity *big.Int) *big.Int {
+	amount := Mul(price, quantity)
+	return Add(amount, orderBook.feeReserve(amount))
+}
+
+// requiredFunds : asset and amount the order locks, a sell locks the base quantity and a buy locks
+// the quote currency it can spend at most, with the fee
+func (orderBook *Orderbook) requiredFunds(quote *Quote) (string, *big.Int, error) {
+	if quote.Side == Ask {
+		return orderBook.BaseAsset, CloneBigInt(quote.Quantity), nil
+	}
+
+	var amount *big.Int
+	switch {
+	case quote.QuoteQuantity != nil:
+		amount = CloneBigInt(quote.QuoteQuantity)
+	case !quote.IsMarket():
+		return orderBook.QuoteAsset, orderBook.buyFunds(quote.Price, quote.Quantity), nil
+	case quote.Type == Market:
+		amount = orderBook.marketBuyCost(quote)
+	case quote.ProtectionPrice != nil:
+		// stop market buy does not know the book it will meet
+		amount = Mul(quote.ProtectionPrice, quote.Quantity)
+	default:
+		return "", nil, ErrUnboundedMarketBuy
+	}
+	return orderBook.QuoteAsset, Add(amount, orderBook.feeReserve(amount)), nil
+}
+
+// marketBuyCost : most the market buy can spend, walking the asks up to its protection price. Orders of
+// the same owner are skipped, so self-trade prevention can only make the order cheaper
+func (orderBook *Orderbook) marketBuyCost(quote *Quote) *big.Int {
+	protectionPrice := orderBook.protectionPrice(quote)
+	quantity := CloneBigInt(quote.Quantity)
+	cost := Zero()
+
+	iterator := orderBook.Asks.PriceTree.Iterator()
+	for found := iterator.First(); found && quantity.Sign() > 0; found = iterator.Next() {
+		orderList := orderBook.Asks.decodeOrderList(iterator.Value())
+		if protectionPrice != nil && IsStrictlyGreaterThan(orderList.Item.Price, protectionPrice) {
+			break
+		}
+		for _, order := range orderList.Orders() {
+			if quantity.Sign() <= 0 {
+				break
+			}
+			if quote.TradeID != "" && order.Item.TradeID == quote.TradeID {
+				continue
+			}
+			// the hidden reserve of an iceberg is filled at the same price
+			traded := minBigInt(order.RemainingQuantity(), quantity)
+			cost = Add(cost, Mul(orderList.Item.Price, traded))
+			quantity = Sub(quantity, traded)
+		}
+	}
+	return cost
+}
+
+// lockFunds : lock what the order can spend, the order is rejected when its owner can not pay for it
+func (orderBook *Orderbook) lockFunds(quote *Quote) error {
+	if orderBook.Ledger == nil {
+		return nil
+	}
+	asset, amount, err := orderBook.requiredFunds(quote)
+	if err != nil {
+		return err
+	}
+	if err = orderBook.Ledger.lock(quote.TradeID, asset, amount); err != nil {
+		return err
+	}
+	return orderBook.db.Put(orderBook.getLockKey(quote.OrderID), &OrderLockItem{
+		Account: quote.TradeID,
+		Asset:   asset,
+		Amount:  amount,
+	})
+}
+
+// relockAmount : lock of the amended order and the funds it locks now, nil when it locks nothing
+func (orderBook *Orderbook) relockAmount(orderID uint64, side string, price, remaining *big.Int) (*OrderLockItem, *big.Int) {
+	if orderBook.Ledger == nil {
+		return nil, nil
+	}
+	item := orderBook.getOrderLock(orderID)
+	// placed before the ledger was enabled
+	if item == nil {
+		return nil, nil
+	}
+	amount := CloneBigInt(remaining)
+	if side == Bid {
+		amount = orderBook.buyFunds(price, remaining)
+	}
+	return item, amount
+}
+
+// canRelockFunds : the owner of the amended order can pay for the remaining quantity at the price,
+// nothing is changed
+func (orderBook *Orderbook) canRelockFunds(orderID uint64, side string, price, remaining *big.Int) error {
+	item, amount := orderBook.relockAmount(orderID, side, price, remaining)
+	if item == nil || IsEqualOrSmallerThan(amount, item.Amount) {
+		return nil
+	}
+	if IsStrictlySmallerThan(orderBook.Ledger.GetBalance(item.Account, item.Asset).Available, Sub(amount, item.Amount)) {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+// relockFunds : lock more or release funds of the amended order so that it covers the remaining
+// quantity at the price, the order is left as it was when its owner can not pay for more
+func (orderBook *Orderbook) relockFunds(orderID uint64, side string, price, remaining *big.Int) error {
+	item, amount := orderBook.relockAmount(orderID, side, price, remaining)
+	if item == nil {
+		return nil
+	}
+	if IsStrictlyGreaterThan(amount, item.Amount) {
+		if err := orderBook.Ledger.lock(item.Account, item.Asset, Sub(amount, item.Amount)); err != nil {
+			return err
+		}
+	} else {
+		orderBook.Ledger.unlock(item.Account, item.Asset, Sub(item.Amount, amount))
+	}
+	item.Amount = amount
+	return orderBook.db.Put(orderBook.getLockKey(orderID), item)
+}
+
+// releaseFunds : give back what the finished order still locks
+func (orderBook *Orderbook) releaseFunds(orderID uint64) {
+	if orderBook.Ledger == nil {
+		return
+	}
+	item := orderBook.getOrderLock(orderID)
+	if item == nil {
+		return
+	}
+	orderBook.Ledger.unlock(item.Account, item.Asset, item.Amount)
+	orderBook.db.Delete(orderBook.getLockKey(orderID), true)
+}
+
+// fromLock : part of the amount taken from the funds locked by the order, the rest is taken from the
+// available balance of its owner
+func (orderBook *Orderbook) fromLock(orderID uint64, amount *big.Int) *big.Int {
+	if item := orderBook.getOrderLock(orderID); item != nil {
+		return minBigInt(item.Amount, amount)
+	}
+	return Zero()
+}
+
+// canPay : the owner of the order has the amount in its lock and available balance
+func (orderBook *Orderbook) canPay(orderID uint64, account, asset string, amount *big.Int) bool {
+	fromLocked := orderBook.fromLock(orderID, amount)
+	balance := orderBook.Ledger.GetBalance(account, asset)
+	return IsEqualOrGreaterThan(balance.Locked, fromLocked) && IsEqualOrGreaterThan(balance.Available, Sub(amount, fromLocked))
+}
+
+// spendLocked : take the amount from the funds locked by the order, and the rest from the available
+// balance of its owner
+func (orderBook *Orderbook) spendLocked(orderID uint64, account, asset string, amount *big.Int) error {
+	fromLocked := orderBook.fromLock(orderID, amount)
+	if err := orderBook.Ledger.spend(account, asset, fromLocked, Sub(amount, fromLocked)); err != nil {
+		return err
+	}
+	if item := orderBook.getOrderLock(orderID); item != nil {
+		item.Amount = Sub(item.Amount, fromLocked)
+		orderBook.db.Put(orderBook.getLockKey(orderID), item)
+	}
+	return nil
+}
+
+// settlement : what the buyer and the seller of the trade pay, and what the fee account collects
+// and pays back as rebates, in quote currency
+type settlement struct {
+	buyerOrderID, sellerOrderID uint64
+	buyer, seller               string
+	buyerIsMaker                bool
+	amount                      *big.Int
+	buyerFee, sellerFee         *big.Int
+	fees, rebates               *big.Int
+}
+
+func (orderBook *Orderbook) getSettlement(trade *Trade) *settlement {
+	result := &settlement{
+		buyerOrderID:  trade.TakerOrderID,
+		buyer:         trade.TakerTradeID,
+		buyerFee:      trade.TakerFee,
+		sellerOrderID: trade.MakerOrderID,
+		seller:        trade.MakerTradeID,
+		sellerFee:     trade.MakerFee,
+		amount:        Mul(trade.Price, trade.Quantity),
+		fees:          Zero(),
+		rebates:       Zero(),
+	}
+	if trade.AggressorSide == Ask {
+		result.buyerOrderID, result.buyer, result.buyerFee = trade.MakerOrderID, trade.MakerTradeID, trade.MakerFee
+		result.sellerOrderID, result.seller, result.sellerFee = trade.TakerOrderID, trade.TakerTradeID, trade.TakerFee
+		result.buyerIsMaker = true
+	}
+	for _, fee := range []*big.Int{result.buyerFee, result.sellerFee} {
+		if fee.Sign() > 0 {
+			result.fees = Add(result.fees, fee)
+		} else {
+			result.rebates = Sub(result.rebates, fee)
+		}
+	}
+	return result
+}
+
+// buyerCost : the traded amount and the fee the buyer pays, its rebate is paid by the fee account
+func (result *settlement) buyerCost() *big.Int {
+	if result.buyerFee.Sign() > 0 {
+		return Add(result.amount, result.buyerFee)
+	}
+	return result.amount
+}
+
+// canSettle : whether the maker and the taker can pay for the fill, a rebate the fee account can not
+// pay is the taker's, whose fill it would be
+func (orderBook *Orderbook) canSettle(trade *Trade) (makerPays, takerPays bool) {
+	if orderBook.Ledger == nil {
+		return true, true
+	}
+	result := orderBook.getSettlement(trade)
+	buyerPays := orderBook.canPay(result.buyerOrderID, result.buyer, orderBook.QuoteAsset, result.buyerCost())
+	sellerPays := orderBook.canPay(result.sellerOrderID, result.seller, orderBook.BaseAsset, trade.Quantity)
+	makerPays, takerPays = sellerPays, buyerPays
+	if result.buyerIsMaker {
+		makerPays, takerPays = buyerPays, sellerPays
+	}
+
+	feeBalance := orderBook.Ledger.GetBalance(FeeAccount, orderBook.QuoteAsset)
+	if IsStrictlySmallerThan(Add(feeBalance.Available, result.fees), result.rebates) {
+		takerPays = false
+	}
+	return makerPays, takerPays
+}
+
+// settleTrade : the buyer pays the traded amount and its fee in quote currency and receives the base
+// quantity, the seller gives the base quantity and receives the amount less its fee. The fees go to
+// the fee account, which pays the rebates, so no asset is created or lost. canSettle tells whether
+// it can be done
+func (orderBook *Orderbook) settleTrade(trade *Trade) error {
+	if orderBook.Ledger == nil {
+		return nil
+	}
+	result := orderBook.getSettlement(trade)
+
+	if err := orderBook.spendLocked(result.buyerOrderID, result.buyer, orderBook.QuoteAsset, result.buyerCost()); err != nil {
+		return err
+	}
+	if err := orderBook.spendLocked(result.sellerOrderID, result.seller, orderBook.BaseAsset, trade.Quantity); err != nil {
+		return err
+	}
+	if result.fees.Sign() > 0 {
+		orderBook.Ledger.credit(FeeAccount, orderBook.QuoteAsset, result.fees)
+	}
+	if result.rebates.Sign() > 0 {
+		if err := orderBook.Ledger.spend(FeeAccount, orderBook.QuoteAsset, Zero(), result.rebates); err != nil {
+			return err
+		}
+	}
+
+	orderBook.Ledger.credit(result.buyer, orderBook.BaseAsset, trade.Quantity)
+	if result.buyerFee.Sign() < 0 {
+		orderBook.Ledger.credit(result.buyer, orderBook.QuoteAsset, Neg(result.buyerFee))
+	}
+	if proceeds := Sub(result.amount, result.sellerFee); proceeds.Sign() > 0 {
+		orderBook.Ledger.credit(result.seller, orderBook.QuoteAsset, proceeds)
+	}
+	return nil
+}
+
+// EnableLedger : from now on orders lock the funds of their owner and fills are settled between
+// the accounts, orders already resting are settled from the available balances and cancelled when
+// their owner can not pay
+func (engine *Engine) EnableLedger() {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	engine.ledgerEnabled = true
+	for _, ob := range engine.Orderbooks {
+		ob.Ledger = engine.ledger
+	}
+}
+
+// Deposit : add the amount of the asset to the available balance of the account
+func (engine *Engine) Deposit(account, asset string, amount *big.Int) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	return engine.ledger.Deposit(account, asset, amount)
+}
+
+// Withdraw : take the amount of the asset from the available balance of the account
+func (engine *Engine) Withdraw(account, asset string, amount *big.Int) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	return engine.ledger.Withdraw(account, asset, amount)
+}
+
+// GetBalance : available and locked balance of the account in the asset
+func (engine *Engine) GetBalance(account, asset string) *Balance {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	balance := engine.ledger.GetBalance(account, asset)
+	return &Balance{
+		Available: CloneBigInt(balance.Available),
+		Locked:    CloneBigInt(balance.Locked),
+	}
+}
@@ -0,0 +1,106 @@
+package orderbook
+
+import (
+	"errors"
+	"math/big"
+)
+
+var ErrEmptyCancelFilter = errors.New("mass cancel needs a pair or a trade id")
+
+// CancelFilter : orders cancelled by CancelAll, empty fields match everything but
+// at least the pair or the trade id must be set
+type CancelFilter struct {
+	// empty means every pair
+	PairName string `json:"pairName"`
+	// owner of the orders, empty means every owner
+	TradeID string `json:"tradeID"`
+	// bid or ask, empty means both sides
+	Side string `json:"side"`
+}
+
+// Validate : check the filter does not cancel more than intended
+func (filter *CancelFilter) Validate() error {
+	if filter.PairName == "" && filter.TradeID == "" {
+		return ErrEmptyCancelFilter
+	}
+	if filter.Side != "" && filter.Side != Bid && filter.Side != Ask {
+		return ErrInvalidSide
+	}
+	return nil
+}
+
+// CancelAll : cancel the resting orders and stop orders of the side that belong to the trade id,
+// empty side or trade id match everything, and return them as quotes
+func (orderBook *Orderbook) CancelAll(side, tradeID string) []*Quote {
+	var quotes []*Quote
+	if side != Ask {
+		quotes = append(quotes, orderBook.findOrders(orderBook.Bids, Bid, tradeID)...)
+		quotes = append(quotes, orderBook.findOrders(orderBook.StopBids, Bid, tradeID)...)
+	}
+	if side != Bid {
+		quotes = append(quotes, orderBook.findOrders(orderBook.Asks, Ask, tradeID)...)
+		quotes = append(quotes, orderBook.findOrders(orderBook.StopAsks, Ask, tradeID)...)
+	}
+
+	// the trees are only changed once they have been walked
+	var cancelled []*Quote
+	for _, quote := range quotes {
+		if err := orderBook.CancelOrder(quote.OrderID); err == nil {
+			cancelled = append(cancelled, quote)
+		}
+	}
+	orderBook.Save()
+	return cancelled
+}
+
+// findOrders : orders of the tree that belong to the trade id, in price then time priority
+func (orderBook *Orderbook) findOrders(orderTree *OrderTree, side, tradeID string) []*Quote {
+	var quotes []*Quote
+	iterator := orderTree.PriceTree.Iterator()
+	for found := iterator.First(); found; found = iterator.Next() {
+		orderList := orderTree.decodeOrderList(iterator.Value())
+		for _, order := range orderList.Orders() {
+			if tradeID != "" && order.Item.TradeID != tradeID {
+				continue
+			}
+			quotes = append(quotes, &Quote{
+				PairName: orderBook.Item.Name,
+				OrderID:  new(big.Int).SetBytes(order.Key).Uint64(),
+				Side:     side,
+				Price:    CloneBigInt(order.Item.Price),
+				Quantity: order.RemainingQuantity(),
+				TradeID:  order.Item.TradeID,
+			})
+		}
+	}
+	return quotes
+}
+
+// CancelAll : cancel every order matching the filter, on one pair or on every pair
+func (engine *Engine) CancelAll(filter *CancelFilter) ([]*Quote, error) {
+	defer engine.sendEvents()
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	names := []string{filter.PairName}
+	if filter.PairName == "" {
+		names = names[:0]
+		for name := range engine.instruments {
+			names = append(names, name)
+		}
+	}
+
+	var cancelled []*Quote
+	for _, name := range names {
+		ob, err := engine.getAndCreateIfNotExisted(name)
+		if ob == nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, ob.CancelAll(filter.Side, filter.TradeID)...)
+	}
+	return cancelled, nil
+}
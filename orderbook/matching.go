@@ -0,0 +1,123 @@
+package orderbook
+
+import (
+	"fmt"
+	"math/big"
+)
+
+const (
+	// FIFOPolicy : price-time priority, the oldest order is filled first
+	FIFOPolicy = "fifo"
+	// ProRataPolicy : the quantity is shared in proportion to the displayed quantity of each order
+	ProRataPolicy = "pro_rata"
+	// ProRataTopOrderPolicy : the oldest order is filled first, the rest is shared pro-rata
+	ProRataTopOrderPolicy = "pro_rata_top_order"
+)
+
+// MatchingPolicy : decides how the quantity of an incoming order is shared among the resting orders
+// of one price level
+type MatchingPolicy interface {
+	Name() string
+	// Allocate : quantity to fill for each order, orders are given in time priority and are filled
+	// in that order, an allocation never exceeds the displayed quantity of its order and the sum
+	// never exceeds quantity
+	Allocate(orders []*Order, quantity *big.Int) []*big.Int
+}
+
+// NewMatchingPolicy : matching policy by name
+func NewMatchingPolicy(name string) (MatchingPolicy, error) {
+	switch name {
+	case FIFOPolicy:
+		return &FIFO{}, nil
+	case ProRataPolicy:
+		return &ProRata{}, nil
+	case ProRataTopOrderPolicy:
+		return &ProRataTopOrder{}, nil
+	default:
+		return nil, fmt.Errorf("Matching policy is not supported :%s", name)
+	}
+}
+
+// FIFO : price-time priority
+type FIFO struct{}
+
+func (policy *FIFO) Name() string {
+	return FIFOPolicy
+}
+
+func (policy *FIFO) Allocate(orders []*Order, quantity *big.Int) []*big.Int {
+	allocations := make([]*big.Int, len(orders))
+	remaining := CloneBigInt(quantity)
+	for i, order := range orders {
+		allocations[i] = minBigInt(order.Item.Quantity, remaining)
+		remaining = Sub(remaining, allocations[i])
+	}
+	return allocations
+}
+
+// ProRata : share the quantity in proportion to the displayed quantity, the remainder of the rounding
+// goes to the orders in time priority
+type ProRata struct{}
+
+func (policy *ProRata) Name() string {
+	return ProRataPolicy
+}
+
+func (policy *ProRata) Allocate(orders []*Order, quantity *big.Int) []*big.Int {
+	return allocateProRata(orders, quantity)
+}
+
+// ProRataTopOrder : the oldest order at the level is filled first, then the rest is shared pro-rata
+type ProRataTopOrder struct{}
+
+func (policy *ProRataTopOrder) Name() string {
+	return ProRataTopOrderPolicy
+}
+
+func (policy *ProRataTopOrder) Allocate(orders []*Order, quantity *big.Int) []*big.Int {
+	if len(orders) == 0 {
+		return nil
+	}
+	top := minBigInt(orders[0].Item.Quantity, quantity)
+	return append([]*big.Int{top}, allocateProRata(orders[1:], Sub(quantity, top))...)
+}
+
+func allocateProRata(orders []*Order, quantity *big.Int) []*big.Int {
+	allocations := make([]*big.Int, len(orders))
+	volume := Zero()
+	for _, order := range orders {
+		volume = Add(volume, order.Item.Quantity)
+	}
+
+	// enough to fill everyone
+	if IsEqualOrGreaterThan(quantity, volume) {
+		for i, order := range orders {
+			allocations[i] = CloneBigInt(order.Item.Quantity)
+		}
+		return allocations
+	}
+
+	remaining := CloneBigInt(quantity)
+	for i, order := range orders {
+		allocations[i] = Div(Mul(quantity, order.Item.Quantity), volume)
+		remaining = Sub(remaining, allocations[i])
+	}
+
+	// what is left from the rounding
+	for i, order := range orders {
+		if remaining.Sign() <= 0 {
+			break
+		}
+		extra := minBigInt(Sub(order.Item.Quantity, allocations[i]), remaining)
+		allocations[i] = Add(allocations[i], extra)
+		remaining = Sub(remaining, extra)
+	}
+	return allocations
+}
+
+func minBigInt(a, b *big.Int) *big.Int {
+	if IsStrictlySmallerThan(a, b) {
+		return CloneBigInt(a)
+	}
+	return CloneBigInt(b)
+}
@@ -0,0 +1,62 @@
+package orderbook
+
+import (
+	"testing"
+)
+
+func testLevel(quantities ...string) []*Order {
+	orders := make([]*Order, len(quantities))
+	for i, quantity := range quantities {
+		orders[i] = &Order{Item: &OrderItem{Quantity: ToBigInt(quantity)}}
+	}
+	return orders
+}
+
+func checkAllocations(t *testing.T, policy MatchingPolicy, orders []*Order, quantity string, want ...string) {
+	allocations := policy.Allocate(orders, ToBigInt(quantity))
+	if len(allocations) != len(want) {
+		t.Fatalf("%s: got %d allocations, want %d", policy.Name(), len(allocations), len(want))
+	}
+	for i, allocation := range allocations {
+		if allocation.Cmp(ToBigInt(want[i])) != 0 {
+			t.Errorf("%s: allocation %d incorrect, got: %v, want: %s", policy.Name(), i, allocation, want[i])
+		}
+	}
+}
+
+func TestMatchingPolicyAllocate(t *testing.T) {
+	level := testLevel("6", "3", "1")
+
+	checkAllocations(t, &FIFO{}, level, "8", "6", "2", "0")
+	// 5 * 6/10 = 3, 5 * 3/10 = 1, 5 * 1/10 = 0, the remaining 1 goes to the oldest order
+	checkAllocations(t, &ProRata{}, level, "5", "4", "1", "0")
+	checkAllocations(t, &ProRata{}, level, "20", "6", "3", "1")
+	// top order is filled first, then 2 is shared by 3 and 1
+	checkAllocations(t, &ProRataTopOrder{}, testLevel("6", "3", "1"), "8", "6", "2", "0")
+	checkAllocations(t, &ProRataTopOrder{}, testLevel("2", "6", "2"), "6", "2", "3", "1")
+
+	if _, err := NewMatchingPolicy("random"); err == nil {
+		t.Errorf("unknown policy should be rejected")
+	}
+}
+
+func TestProRataMatching(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("PRORATA/WETH")
+	defer cleanup()
+	orderBook.MatchingPolicy = &ProRata{}
+
+	orderBook.ProcessOrder(newTestQuote(Ask, "100", "6", "1"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "100", "3", "2"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "100", "1", "3"), false)
+
+	trades, _, _ := orderBook.ProcessOrder(newTestQuote(Bid, "100", "5", "4"), false)
+	if len(trades) != 2 || trades[0].Quantity.Cmp(ToBigInt("4")) != 0 || trades[1].Quantity.Cmp(ToBigInt("1")) != 0 {
+		t.Fatalf("pro-rata fills incorrect, got: %s", ToJSON(trades))
+	}
+	if trades[0].MakerTradeID != "1" || trades[1].MakerTradeID != "2" || trades[1].TakerRemaining.Sign() != 0 {
+		t.Errorf("pro-rata fills go to the wrong orders, got: %s", ToJSON(trades))
+	}
+	if orderBook.VolumeAtPrice(Ask, ToBigInt("100")).Cmp(ToBigInt("5")) != 0 || orderBook.Asks.Item.Volume.Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("volume after pro-rata incorrect, got: %v", orderBook.VolumeAtPrice(Ask, ToBigInt("100")))
+	}
+}
@@ -1,5 +1,12 @@
 package orderbook
 
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strconv"
+)
+
 var datadir = "../datadir/testing"
 
 // var datadir = "../../.data_30100/orderbook/"
@@ -36,3 +43,33 @@ var testQuanity3 = ToBigInt("200000")
 var testPrice3 = ToBigInt("13000")
 var testOrderID3 = 4
 var testTradeID3 = 4
+
+// newTestOrderbook : create an orderbook on its own temporary database so tests do not share state
+func newTestOrderbook(name string) (*Orderbook, func()) {
+	dir, _ := ioutil.TempDir("", "orderbook")
+	db := NewBatchDatabaseWithEncode(dir, 0, 0, EncodeBytesItem, DecodeBytesItem)
+	return NewOrderbook(name, db), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestQuote(side, price, quantity, tradeID string) *Quote {
+	return &Quote{
+		Type:     Limit,
+		Side:     side,
+		Price:    ToBigInt(price),
+		Quantity: ToBigInt(quantity),
+		TradeID:  tradeID,
+	}
+}
+
+// newTestOrderQuote : quote of an order with its id already assigned, for inserting straight into a tree
+func newTestOrderQuote(timestamp uint64, quantity, price *big.Int, orderID, tradeID int) *Quote {
+	return &Quote{
+		Timestamp: timestamp,
+		Quantity:  quantity,
+		Price:     price,
+		OrderID:   uint64(orderID),
+		TradeID:   strconv.Itoa(tradeID),
+	}
+}
@@ -0,0 +1,138 @@
+package orderbook
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// DefaultPageSize : orders per page when the page size is not given
+	DefaultPageSize = 100
+	// MaxPageSize : most orders returned in one page
+	MaxPageSize = 1000
+)
+
+// OpenOrdersPage : one page of the open orders of an account in order id order, Next is the order id
+// the next page starts from, 0 when this is the last page
+type OpenOrdersPage struct {
+	Orders []*OrderRecord `json:"orders"`
+	Next   uint64         `json:"next"`
+}
+
+// OwnerOrdersItem : ids of the open orders of an owner on the pair, in ascending order, stored at
+// the owner slot itself
+type OwnerOrdersItem struct {
+	OrderIDs []uint64 `json:"orderIDs"`
+}
+
+// OwnerOrderItem : an open order of an owner on the pair, stored under the owner slot plus the order id
+type OwnerOrderItem struct {
+	OrderID uint64 `json:"orderID"`
+}
+
+// getOwnerSlot : each owner has its own slot in the owners keyspace, order ids start at 1 so the
+// slot itself is free for the list of ids
+func (orderBook *Orderbook) getOwnerSlot(owner string) *big.Int {
+	return new(big.Int).SetBytes(crypto.Keccak256(orderBook.ownersKey, []byte(owner)))
+}
+
+func (orderBook *Orderbook) getOwnerOrderKey(owner string, orderID uint64) []byte {
+	return GetKeyFromBig(Add(orderBook.getOwnerSlot(owner), new(big.Int).SetUint64(orderID)))
+}
+
+func (orderBook *Orderbook) hasOwnerOrder(owner string, orderID uint64) bool {
+	found, _ := orderBook.db.Has(orderBook.getOwnerOrderKey(owner, orderID))
+	return found
+}
+
+func (orderBook *Orderbook) getOwnerOrders(owner string) []uint64 {
+	val, err := orderBook.db.Get(GetKeyFromBig(orderBook.getOwnerSlot(owner)), &OwnerOrdersItem{})
+	if err != nil || val == nil {
+		return nil
+	}
+	return val.(*OwnerOrdersItem).OrderIDs
+}
+
+func (orderBook *Orderbook) putOwnerOrders(owner string, orderIDs []uint64) error {
+	key := GetKeyFromBig(orderBook.getOwnerSlot(owner))
+	if len(orderIDs) == 0 {
+		return orderBook.db.Delete(key, true)
+	}
+	return orderBook.db.Put(key, &OwnerOrdersItem{OrderIDs: orderIDs})
+}
+
+// addOwnerOrder : index the open order of the owner, orders without owner are not indexed
+func (orderBook *Orderbook) addOwnerOrder(owner string, orderID uint64) error {
+	if owner == "" || orderBook.hasOwnerOrder(owner, orderID) {
+		return nil
+	}
+	if err := orderBook.db.Put(orderBook.getOwnerOrderKey(owner, orderID), &OwnerOrderItem{OrderID: orderID}); err != nil {
+		return err
+	}
+	orderIDs := orderBook.getOwnerOrders(owner)
+	i := sort.Search(len(orderIDs), func(i int) bool { return orderIDs[i] >= orderID })
+	// a new slice, the stored one may be shared with the cache
+	result := make([]uint64, 0, len(orderIDs)+1)
+	result = append(append(append(result, orderIDs[:i]...), orderID), orderIDs[i:]...)
+	return orderBook.putOwnerOrders(owner, result)
+}
+
+func (orderBook *Orderbook) removeOwnerOrder(owner string, orderID uint64) error {
+	if owner == "" || !orderBook.hasOwnerOrder(owner, orderID) {
+		return nil
+	}
+	if err := orderBook.db.Delete(orderBook.getOwnerOrderKey(owner, orderID), true); err != nil {
+		return err
+	}
+	orderIDs := orderBook.getOwnerOrders(owner)
+	i := sort.Search(len(orderIDs), func(i int) bool { return orderIDs[i] >= orderID })
+	if i == len(orderIDs) || orderIDs[i] != orderID {
+		return nil
+	}
+	result := make([]uint64, 0, len(orderIDs)-1)
+	result = append(append(result, orderIDs[:i]...), orderIDs[i+1:]...)
+	return orderBook.putOwnerOrders(owner, result)
+}
+
+// GetOpenOrders : one page of the orders of the account resting in the book or in the trigger book,
+// starting from the order id, the remaining quantity is the quantity less the filled quantity
+func (orderBook *Orderbook) GetOpenOrders(account string, fromOrderID uint64, limit int) *OpenOrdersPage {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	} else if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	page := &OpenOrdersPage{}
+	if account == "" {
+		return page
+	}
+	// only the ids of the account are walked, from the first one at or after the order id
+	orderIDs := orderBook.getOwnerOrders(account)
+	orderIDs = orderIDs[sort.Search(len(orderIDs), func(i int) bool { return orderIDs[i] >= fromOrderID }):]
+	if len(orderIDs) > limit {
+		page.Next = orderIDs[limit]
+		orderIDs = orderIDs[:limit]
+	}
+	for _, orderID := range orderIDs {
+		if record := orderBook.GetOrderRecord(orderID); record != nil {
+			result := *record
+			page.Orders = append(page.Orders, &result)
+		}
+	}
+	return page
+}
+
+// GetOpenOrders : one page of the open orders of the account on the pair
+func (engine *Engine) GetOpenOrders(pairName, account string, fromOrderID uint64, limit int) (*OpenOrdersPage, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, err
+	}
+	return ob.GetOpenOrders(account, fromOrderID, limit), nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"math/big"
-	"strconv"
 )
 
 // OrderItem : info that will be store in database
@@ -14,6 +13,11 @@ type OrderItem struct {
 	Price     *big.Int `json:"price"`
 	// OrderID   string          `json:"orderID"`
 	TradeID string `json:"tradeID"`
+	// unix time in seconds after which a good till date order is no longer valid, 0 means no expiry
+	ExpireTime uint64 `json:"expireTime"`
+	// iceberg order shows at most PeakSize, the hidden Reserve refills Quantity when it is filled
+	PeakSize *big.Int `json:"peakSize"`
+	Reserve  *big.Int `json:"reserve"`
 	// these following fields can lead to recursive problem
 	// NextOrder *Order     `json:"-"`
 	// PrevOrder *Order     `json:"-"`
@@ -43,6 +47,16 @@ func (order *Order) String() string {
 		new(big.Int).SetBytes(order.Key), order.Item.Price, order.Item.Quantity, order.Item.TradeID)
 }
 
+// Clone : copy of the order, so that it does not change with the stored one
+func (order *Order) Clone() *Order {
+	item := *order.Item
+	item.Quantity = cloneOptional(order.Item.Quantity)
+	item.Price = cloneOptional(order.Item.Price)
+	item.PeakSize = cloneOptional(order.Item.PeakSize)
+	item.Reserve = cloneOptional(order.Item.Reserve)
+	return &Order{Item: &item, Key: append([]byte{}, order.Key...)}
+}
+
 func (order *Order) GetNextOrder(orderList *OrderList) *Order {
 	nextOrder := orderList.GetOrder(order.Item.NextOrder)
 
@@ -56,22 +70,39 @@ func (order *Order) GetPrevOrder(orderList *OrderList) *Order {
 }
 
 // NewOrder : create new order with quote ( can be ethereum address )
-func NewOrder(quote map[string]string, orderList []byte) *Order {
-	timestamp, _ := strconv.ParseUint(quote["timestamp"], 10, 64)
-	quantity := ToBigInt(quote["quantity"])
-	price := ToBigInt(quote["price"])
-	orderID := ToBigInt(quote["order_id"])
-	key := GetKeyFromBig(orderID)
-	tradeID := quote["trade_id"]
+func NewOrder(quote *Quote, orderList []byte) *Order {
+	timestamp := quote.Timestamp
+	quantity := CloneBigInt(quote.Quantity)
+	price := CloneBigInt(quote.Price)
+	key := GetKeyFromUint64(quote.OrderID)
+	tradeID := quote.TradeID
+	// only good till date order carries the expiry
+	var expireTime uint64
+	if quote.TimeInForce == GTD {
+		expireTime = quote.ExpireTime
+	}
+	// iceberg order only shows its peak, the rest is kept in reserve
+	peakSize := Zero()
+	if quote.DisplayQuantity != nil {
+		peakSize = CloneBigInt(quote.DisplayQuantity)
+	}
+	reserve := Zero()
+	if peakSize.Sign() > 0 && IsStrictlyGreaterThan(quantity, peakSize) {
+		reserve = Sub(quantity, peakSize)
+		quantity = CloneBigInt(peakSize)
+	}
 	orderItem := &OrderItem{
 		Timestamp: timestamp,
 		Quantity:  quantity,
 		Price:     price,
 		// OrderID:   orderID,
-		TradeID:   tradeID,
-		NextOrder: EmptyKey(),
-		PrevOrder: EmptyKey(),
-		OrderList: orderList,
+		TradeID:    tradeID,
+		ExpireTime: expireTime,
+		PeakSize:   peakSize,
+		Reserve:    reserve,
+		NextOrder:  EmptyKey(),
+		PrevOrder:  EmptyKey(),
+		OrderList:  orderList,
 	}
 
 	// key should be Hash for compatible with smart contract
@@ -83,6 +114,55 @@ func NewOrder(quote map[string]string, orderList []byte) *Order {
 	return order
 }
 
+// IsIceberg : order still has hidden quantity
+func (order *Order) IsIceberg() bool {
+	return order.Item.Reserve != nil && order.Item.Reserve.Sign() > 0
+}
+
+// RemainingQuantity : displayed and hidden quantity still open
+func (order *Order) RemainingQuantity() *big.Int {
+	if order.Item.Reserve == nil {
+		return CloneBigInt(order.Item.Quantity)
+	}
+	return Add(order.Item.Quantity, order.Item.Reserve)
+}
+
+// Decrease : take the quantity from the hidden reserve first then from the displayed quantity,
+// the order keeps its time priority
+func (order *Order) Decrease(orderList *OrderList, quantity *big.Int) {
+	if order.IsIceberg() {
+		fromReserve := quantity
+		if IsStrictlySmallerThan(order.Item.Reserve, fromReserve) {
+			fromReserve = order.Item.Reserve
+		}
+		order.Item.Reserve = Sub(order.Item.Reserve, fromReserve)
+		quantity = Sub(quantity, fromReserve)
+	}
+	if quantity.Sign() > 0 {
+		order.UpdateQuantity(orderList, Sub(order.Item.Quantity, quantity), order.Item.Timestamp)
+	} else {
+		orderList.SaveOrder(order)
+	}
+}
+
+// Replenish : refill the displayed quantity from the reserve after the peak is filled,
+// the order moves to the tail of its price level and loses its time priority
+func (order *Order) Replenish(orderList *OrderList) {
+	newQuantity := order.Item.PeakSize
+	if IsStrictlySmallerThan(order.Item.Reserve, newQuantity) {
+		newQuantity = order.Item.Reserve
+	}
+	newQuantity = CloneBigInt(newQuantity)
+
+	orderList.MoveToTail(order)
+	orderList.Item.Volume = Add(Sub(orderList.Item.Volume, order.Item.Quantity), newQuantity)
+	order.Item.Reserve = Sub(order.Item.Reserve, newQuantity)
+	order.Item.Quantity = newQuantity
+	orderList.SaveOrder(order)
+	orderList.Save()
+	orderList.orderTree.emitDelta(DeltaUpdate, orderList.Item.Price, order)
+}
+
 // UpdateQuantity : update quantity of the order
 func (order *Order) UpdateQuantity(orderList *OrderList, newQuantity *big.Int, newTimestamp uint64) {
 	if newQuantity.Cmp(order.Item.Quantity) > 0 && !bytes.Equal(orderList.Item.TailOrder, order.Key) {
@@ -95,4 +175,5 @@ func (order *Order) UpdateQuantity(orderList *OrderList, newQuantity *big.Int, n
 	fmt.Println("QUANTITY", order.Item.Quantity.String())
 	orderList.SaveOrder(order)
 	orderList.Save()
+	orderList.orderTree.emitDelta(DeltaUpdate, orderList.Item.Price, order)
 }
@@ -9,12 +9,7 @@ import (
 
 func TestNewOrder(t *testing.T) {
 
-	dummyOrder := make(map[string]string)
-	dummyOrder["timestamp"] = strconv.FormatUint(testTimestamp, 10)
-	dummyOrder["quantity"] = testQuanity.String()
-	dummyOrder["price"] = testPrice.String()
-	dummyOrder["order_id"] = strconv.Itoa(testOrderID)
-	dummyOrder["trade_id"] = strconv.Itoa(testTradeID)
+	dummyOrder := newTestOrderQuote(testTimestamp, testQuanity, testPrice, testOrderID, testTradeID)
 	priceKey := GetKeyFromBig(testPrice)
 	order := NewOrder(dummyOrder, priceKey)
 
@@ -32,7 +27,7 @@ func TestNewOrder(t *testing.T) {
 		t.Errorf("price incorrect, got: %d, want: %d.", order.Item.Price, testPrice)
 	}
 
-	if !bytes.Equal(order.Key, []byte(dummyOrder["order_id"])) {
+	if !bytes.Equal(order.Key, GetKeyFromUint64(dummyOrder.OrderID)) {
 		t.Errorf("order id incorrect, got: %x, want: %d.", order.Key, testOrderID)
 	}
 
@@ -44,12 +39,7 @@ func TestNewOrder(t *testing.T) {
 func TestOrder(t *testing.T) {
 	orderList := NewOrderList(testPrice, testOrderTree)
 
-	dummyOrder := make(map[string]string)
-	dummyOrder["timestamp"] = strconv.FormatUint(testTimestamp, 10)
-	dummyOrder["quantity"] = testQuanity.String()
-	dummyOrder["price"] = testPrice.String()
-	dummyOrder["order_id"] = strconv.Itoa(testOrderID)
-	dummyOrder["trade_id"] = strconv.Itoa(testTradeID)
+	dummyOrder := newTestOrderQuote(testTimestamp, testQuanity, testPrice, testOrderID, testTradeID)
 
 	order := NewOrder(dummyOrder, orderList.Key)
 	orderList.AppendOrder(order)
@@ -67,12 +57,7 @@ func TestOrder(t *testing.T) {
 	var i int64 = 4
 	for ; i < 10; i++ {
 		increment := big.NewInt(i)
-		dummyOrder1 := make(map[string]string)
-		dummyOrder1["timestamp"] = strconv.FormatUint(testTimestamp1, 10)
-		dummyOrder1["quantity"] = testQuanity1.String()
-		dummyOrder1["price"] = Add(testPrice1, increment).String()
-		dummyOrder1["order_id"] = increment.String()
-		dummyOrder1["trade_id"] = strconv.Itoa(testTradeID1)
+		dummyOrder1 := newTestOrderQuote(testTimestamp1, testQuanity1, Add(testPrice1, increment), int(i), testTradeID1)
 
 		order1 := NewOrder(dummyOrder1, orderList.Key)
 		orderList.AppendOrder(order1)
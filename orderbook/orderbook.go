@@ -1,9 +1,9 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
-	"strconv"
 	"strings"
 	"time"
 
@@ -18,17 +18,71 @@ const (
 	Bid    = "bid"
 	Market = "market"
 	Limit  = "limit"
+	// StopMarket : rest in the trigger book, released as market order when a trade prints through stop_price
+	StopMarket = "stop_market"
+	// StopLimit : rest in the trigger book, released as limit order when a trade prints through stop_price
+	StopLimit = "stop_limit"
+
+	// time in force of limit order, empty value is treated as GTC
+	// GTC : good till cancel, the remaining quantity stays in the book
+	GTC = "GTC"
+	// IOC : immediate or cancel, the remaining quantity is discarded
+	IOC = "IOC"
+	// FOK : fill or kill, the order is filled completely or rejected without touching the book
+	FOK = "FOK"
+	// GTD : good till date, like GTC but only valid until expire_time
+	GTD = "GTD"
+
+	// what to do with a post-only order that would cross the spread
+	// PostOnlyReject : reject the order, this is the default
+	PostOnlyReject = "reject"
+	// PostOnlyReprice : move the price one tick away from the best opposite price
+	PostOnlyReprice = "reprice"
+
+	// self-trade prevention, applied when the incoming order meets a resting order with the same trade id
+	// STPNone : let them trade, this is the default
+	STPNone = "none"
+	// STPCancelNewest : cancel the remaining quantity of the incoming order
+	STPCancelNewest = "cancel_newest"
+	// STPCancelOldest : cancel the resting order and keep matching
+	STPCancelOldest = "cancel_oldest"
+	// STPCancelBoth : cancel both orders
+	STPCancelBoth = "cancel_both"
+	// STPDecrementAndCancel : decrease both orders by the smaller quantity without a trade
+	STPDecrementAndCancel = "decrement_and_cancel"
+
+	// BpsDenominator : 1 bps is 1 / BpsDenominator
+	BpsDenominator = 10000
 
 	// we use a big number as segment for storing order, order list from order tree slot.
 	// as sequential id
 	SlotSegment = common.AddressLength
 )
 
+var (
+	ErrInvalidTimeInForce     = errors.New("time in force is not supported")
+	ErrInvalidExpireTime      = errors.New("expire time must be in the future for GTD order")
+	ErrFillOrKillNotFilled    = errors.New("not enough liquidity to fill FOK order")
+	ErrPostOnlyWouldCross     = errors.New("post-only order would cross the spread")
+	ErrPostOnlyNotResting     = errors.New("post-only order must be able to rest in the book")
+	ErrInvalidPostOnlyMode    = errors.New("post-only mode is not supported")
+	ErrInvalidStopPrice       = errors.New("stop price must be greater than zero")
+	ErrInvalidDisplayQuantity = errors.New("display quantity of a limit order must be greater than zero and at most its quantity")
+	ErrInvalidSelfTradeMode   = errors.New("self-trade prevention mode is not supported")
+	ErrAmendStopOrder         = errors.New("stop order can not be amended, cancel it instead")
+)
+
 type OrderbookItem struct {
-	Timestamp     uint64 `json:"time"`
-	NextOrderID   uint64 `json:"nextOrderID"`
+	Timestamp   uint64 `json:"time"`
+	NextOrderID uint64 `json:"nextOrderID"`
+	// id of the last execution report, increased for every fill
+	NextExecutionID uint64 `json:"nextExecutionID"`
+	// sequence of the last book delta
+	Sequence      uint64 `json:"sequence"`
 	MaxPricePoint uint64 `json:"maxVolume"` // maximum
-	Name          string `json:"name"`
+	// continuous, auction or closed, empty means continuous
+	Phase string `json:"phase"`
+	Name  string `json:"name"`
 }
 
 // Orderbook : list of orders
@@ -36,10 +90,53 @@ type Orderbook struct {
 	db   *BatchDatabase // this is for orderBook
 	Bids *OrderTree     `json:"bids"`
 	Asks *OrderTree     `json:"asks"`
-	Item *OrderbookItem
+	// trigger book, stop orders are keyed by stop price like price of Bids and Asks
+	StopBids *OrderTree `json:"stopBids"`
+	StopAsks *OrderTree `json:"stopAsks"`
+	Item     *OrderbookItem
 
 	Key  []byte
 	slot *big.Int
+	// slot of the quote to release for each stop order
+	stopSlot *big.Int
+	// stop orders triggered by trades, waiting to be processed in order
+	triggeredOrders []*Quote
+	// good till date orders by expire time, for the expiry scheduler
+	expiries *expiryIndex
+	// slot of the location of each resting order
+	locationSlot *big.Int
+	// slot of the lifecycle of each order, kept after the order leaves the book
+	historySlot *big.Int
+	// slot of the funds locked by each open order
+	lockSlot *big.Int
+	// slot of the trade tape, every trade of the pair by its execution id
+	tapeSlot *big.Int
+	// key of the price band and halt state of the pair
+	pairStateKey []byte
+
+	// PostOnlyMode : PostOnlyReject or PostOnlyReprice, applied to crossing post-only orders
+	PostOnlyMode string
+	// TickSize : minimum price increment, used when repricing post-only orders
+	TickSize *big.Int
+	// SelfTradeMode : self-trade prevention mode for orders that do not choose one
+	SelfTradeMode string
+	// MatchingPolicy : how the orders at one price level are filled, FIFO by default
+	MatchingPolicy MatchingPolicy
+	// FeeSchedule : maker and taker fees of the pair, nil means no fee
+	FeeSchedule *FeeSchedule
+	// prefix of the fee totals of the accounts
+	feeKey []byte
+	// prefix of the open orders of the owners
+	ownersKey []byte
+	// Ledger : balances of the accounts, nil means orders are not checked for funds
+	Ledger *Ledger
+	// BaseAsset and QuoteAsset : what is traded and what it is paid with, used by the ledger
+	BaseAsset  string
+	QuoteAsset string
+	// OnDelta : called with every change of the bids and asks, nil means the changes are only counted
+	OnDelta func(*BookDelta)
+	// OnOrderUpdate : called with a copy of the record of the order every time it changes
+	OnOrderUpdate func(*OrderRecord)
 }
 
 // NewOrderbook : return new order book
@@ -53,6 +150,7 @@ func NewOrderbook(name string, db *BatchDatabase) *Orderbook {
 
 	item := &OrderbookItem{
 		NextOrderID: 0,
+		Phase:       PhaseContinuous,
 		Name:        strings.ToLower(name),
 	}
 
@@ -73,12 +171,36 @@ func NewOrderbook(name string, db *BatchDatabase) *Orderbook {
 	// the price of order tree start at order tree slot
 	bidsKey := GetSegmentHash(key, 1, SlotSegment)
 	asksKey := GetSegmentHash(key, 2, SlotSegment)
+	stopBidsKey := GetSegmentHash(key, 3, SlotSegment)
+	stopAsksKey := GetSegmentHash(key, 4, SlotSegment)
+	stopSlot := new(big.Int).SetBytes(GetSegmentHash(key, 5, SlotSegment))
+	feeKey := GetSegmentHash(key, 6, SlotSegment)
+	expiriesKey := GetSegmentHash(key, 7, SlotSegment)
+	locationSlot := new(big.Int).SetBytes(GetSegmentHash(key, 8, SlotSegment))
+	historySlot := new(big.Int).SetBytes(GetSegmentHash(key, 9, SlotSegment))
+	lockSlot := new(big.Int).SetBytes(GetSegmentHash(key, 10, SlotSegment))
+	ownersKey := GetSegmentHash(key, 11, SlotSegment)
+	tapeSlot := new(big.Int).SetBytes(GetSegmentHash(key, 12, SlotSegment))
+	pairStateKey := GetSegmentHash(key, 13, SlotSegment)
 
 	orderBook := &Orderbook{
-		db:   db,
-		Item: item,
-		slot: slot,
-		Key:  key,
+		db:             db,
+		Item:           item,
+		slot:           slot,
+		stopSlot:       stopSlot,
+		expiries:       newExpiryIndex(db, expiriesKey),
+		locationSlot:   locationSlot,
+		ownersKey:      ownersKey,
+		historySlot:    historySlot,
+		lockSlot:       lockSlot,
+		tapeSlot:       tapeSlot,
+		pairStateKey:   pairStateKey,
+		feeKey:         feeKey,
+		Key:            key,
+		PostOnlyMode:   PostOnlyReject,
+		TickSize:       big.NewInt(1),
+		SelfTradeMode:  STPNone,
+		MatchingPolicy: &FIFO{},
 	}
 
 	bids := NewOrderTree(db, bidsKey, orderBook)
@@ -87,6 +209,10 @@ func NewOrderbook(name string, db *BatchDatabase) *Orderbook {
 	// set asks and bids
 	orderBook.Bids = bids
 	orderBook.Asks = asks
+
+	// stop orders share the order slot of this orderbook, so order id is unique across all trees
+	orderBook.StopBids = NewOrderTree(db, stopBidsKey, orderBook)
+	orderBook.StopAsks = NewOrderTree(db, stopAsksKey, orderBook)
 	// orderBook.Restore()
 
 	// no need to update when there is no operation yet
@@ -103,6 +229,9 @@ func (orderBook *Orderbook) Save() error {
 
 	orderBook.Asks.Save()
 	orderBook.Bids.Save()
+	orderBook.StopAsks.Save()
+	orderBook.StopBids.Save()
+	orderBook.expiries.Save()
 
 	// orderBookBytes, _ := rlp.EncodeToBytes(orderBook.Item)
 
@@ -131,6 +260,9 @@ func (orderBook *Orderbook) Restore() error {
 
 	orderBook.Asks.Restore()
 	orderBook.Bids.Restore()
+	orderBook.StopAsks.Restore()
+	orderBook.StopBids.Restore()
+	orderBook.expiries.Restore()
 
 	val, err := orderBook.db.Get(orderBook.Key, orderBook.Item)
 	if err == nil {
@@ -213,246 +345,588 @@ func (orderBook *Orderbook) WorstAsk() (value *big.Int) {
 	return orderBook.Asks.MaxPrice()
 }
 
-// processMarketOrder : process the market order
-func (orderBook *Orderbook) processMarketOrder(quote map[string]string, verbose bool) []map[string]string {
-	var trades []map[string]string
-	quantityToTrade := ToBigInt(quote["quantity"])
-	side := quote["side"]
-	var newTrades []map[string]string
+// processMarketOrder : process the market order, it stops at the protection price and the remaining
+// quantity (or quote amount of a market buy by amount) is cancelled and reported as unspent
+func (orderBook *Orderbook) processMarketOrder(quote *Quote, verbose bool) []*Trade {
+	var trades []*Trade
+	side := quote.Side
+	var newTrades []*Trade
 	// speedup the comparison, do not assign because it is pointer
 	zero := Zero()
-	if side == Bid {
-		for quantityToTrade.Cmp(zero) > 0 && orderBook.Asks.NotEmpty() {
-			bestPriceAsks := orderBook.Asks.MinPriceList()
-			quantityToTrade, newTrades = orderBook.processOrderList(Ask, bestPriceAsks, quantityToTrade, quote, verbose)
-			trades = append(trades, newTrades...)
-		}
-		// } else if side == Ask {
+
+	protectionPrice := orderBook.protectionPrice(quote)
+	byAmount := quote.QuoteQuantity != nil
+	var quantityToTrade, amountToSpend *big.Int
+	if byAmount {
+		amountToSpend = CloneBigInt(quote.QuoteQuantity)
 	} else {
-		for quantityToTrade.Cmp(zero) > 0 && orderBook.Bids.NotEmpty() {
-			bestPriceBids := orderBook.Bids.MaxPriceList()
-			quantityToTrade, newTrades = orderBook.processOrderList(Bid, bestPriceBids, quantityToTrade, quote, verbose)
-			trades = append(trades, newTrades...)
+		quantityToTrade = CloneBigInt(quote.Quantity)
+	}
+
+	for !quote.cancelled {
+		var orderList *OrderList
+		if side == Bid {
+			if !orderBook.Asks.NotEmpty() || (protectionPrice != nil && IsStrictlyGreaterThan(orderBook.BestAsk(), protectionPrice)) {
+				break
+			}
+			orderList = orderBook.Asks.MinPriceList()
+		} else {
+			if !orderBook.Bids.NotEmpty() || (protectionPrice != nil && IsStrictlySmallerThan(orderBook.BestBid(), protectionPrice)) {
+				break
+			}
+			orderList = orderBook.Bids.MaxPriceList()
+		}
+		price := CloneBigInt(orderList.Item.Price)
+
+		// buy what the remaining amount can afford at this price level
+		if byAmount {
+			quantityToTrade = Div(amountToSpend, price)
 		}
+		if quantityToTrade.Cmp(zero) <= 0 {
+			break
+		}
+
+		var remaining *big.Int
+		if side == Bid {
+			remaining, newTrades = orderBook.processOrderList(Ask, orderList, quantityToTrade, quote, verbose)
+		} else {
+			remaining, newTrades = orderBook.processOrderList(Bid, orderList, quantityToTrade, quote, verbose)
+		}
+		trades = append(trades, newTrades...)
+
+		if byAmount {
+			// the whole level is at one price
+			amountToSpend = Sub(amountToSpend, Mul(Sub(quantityToTrade, remaining), price))
+		} else {
+			quantityToTrade = remaining
+		}
+	}
+
+	if byAmount {
+		quote.Unspent = amountToSpend
+	} else {
+		quote.Unspent = quantityToTrade
 	}
 	return trades
 }
 
+// protectionPrice : worst price a market order accepts, from the protection price or the maximum
+// slippage in bps away from the best opposite price on arrival, nil means no limit
+func (orderBook *Orderbook) protectionPrice(quote *Quote) *big.Int {
+	if quote.ProtectionPrice != nil {
+		return quote.ProtectionPrice
+	}
+	if quote.MaxSlippageBps == 0 {
+		return nil
+	}
+
+	slippage := new(big.Int).SetUint64(quote.MaxSlippageBps)
+	if quote.Side == Bid {
+		if !orderBook.Asks.NotEmpty() {
+			return nil
+		}
+		return Div(Mul(orderBook.BestAsk(), Add(big.NewInt(BpsDenominator), slippage)), big.NewInt(BpsDenominator))
+	}
+	if !orderBook.Bids.NotEmpty() {
+		return nil
+	}
+	if quote.MaxSlippageBps >= BpsDenominator {
+		return Zero()
+	}
+	return Div(Mul(orderBook.BestBid(), Sub(big.NewInt(BpsDenominator), slippage)), big.NewInt(BpsDenominator))
+}
+
 // processLimitOrder : process the limit order, can change the quote
 // If not care for performance, we should make a copy of quote to prevent further reference problem
-func (orderBook *Orderbook) processLimitOrder(quote map[string]string, verbose bool) ([]map[string]string, map[string]string) {
-	var trades []map[string]string
-	quantityToTrade := ToBigInt(quote["quantity"])
-	side := quote["side"]
-	price := ToBigInt(quote["price"])
-
-	var newTrades []map[string]string
-	var orderInBook map[string]string
+func (orderBook *Orderbook) processLimitOrder(quote *Quote, verbose bool) ([]*Trade, *Quote, error) {
+	var trades []*Trade
+	quantityToTrade := CloneBigInt(quote.Quantity)
+	side := quote.Side
+	timeInForce := quote.TimeInForce
+
+	var newTrades []*Trade
+	var orderInBook *Quote
 	// speedup the comparison, do not assign because it is pointer
 	zero := Zero()
 
+	// post-only order is repriced or rejected before matching, so it never takes liquidity
+	if quote.PostOnly {
+		if err := orderBook.applyPostOnly(quote); err != nil {
+			return nil, nil, err
+		}
+	}
+	price := quote.Price
+
+	// fill or kill must be checked before touching the book so that rejection is atomic
+	if timeInForce == FOK && !orderBook.canFill(quote, price, quantityToTrade) {
+		return nil, nil, ErrFillOrKillNotFilled
+	}
+	// only GTC and GTD orders can rest in the book
+	canRest := timeInForce != IOC && timeInForce != FOK
+
 	if side == Bid {
 		minPrice := orderBook.Asks.MinPrice()
-		for quantityToTrade.Cmp(zero) > 0 && orderBook.Asks.NotEmpty() && price.Cmp(minPrice) >= 0 {
+		for quantityToTrade.Cmp(zero) > 0 && !quote.cancelled && orderBook.Asks.NotEmpty() && price.Cmp(minPrice) >= 0 {
 			bestPriceAsks := orderBook.Asks.MinPriceList()
 			quantityToTrade, newTrades = orderBook.processOrderList(Ask, bestPriceAsks, quantityToTrade, quote, verbose)
 			trades = append(trades, newTrades...)
 			minPrice = orderBook.Asks.MinPrice()
 		}
 
-		if quantityToTrade.Cmp(zero) > 0 {
-			quote["order_id"] = strconv.FormatUint(orderBook.Item.NextOrderID, 10)
-			quote["quantity"] = quantityToTrade.String()
-			orderBook.Bids.InsertOrder(quote)
+		if quantityToTrade.Cmp(zero) > 0 && canRest && !quote.cancelled {
+			quote.Quantity = quantityToTrade
+			orderBook.insertOrder(orderBook.Bids, quote)
 			orderInBook = quote
 		}
 
 		// } else if side == Ask {
 	} else {
 		maxPrice := orderBook.Bids.MaxPrice()
-		for quantityToTrade.Cmp(zero) > 0 && orderBook.Bids.NotEmpty() && price.Cmp(maxPrice) <= 0 {
+		for quantityToTrade.Cmp(zero) > 0 && !quote.cancelled && orderBook.Bids.NotEmpty() && price.Cmp(maxPrice) <= 0 {
 			bestPriceBids := orderBook.Bids.MaxPriceList()
 			quantityToTrade, newTrades = orderBook.processOrderList(Bid, bestPriceBids, quantityToTrade, quote, verbose)
 			trades = append(trades, newTrades...)
 			maxPrice = orderBook.Bids.MaxPrice()
 		}
 
-		if quantityToTrade.Cmp(zero) > 0 {
-			quote["order_id"] = strconv.FormatUint(orderBook.Item.NextOrderID, 10)
-			quote["quantity"] = quantityToTrade.String()
-			orderBook.Asks.InsertOrder(quote)
+		if quantityToTrade.Cmp(zero) > 0 && canRest && !quote.cancelled {
+			quote.Quantity = quantityToTrade
+			orderBook.insertOrder(orderBook.Asks, quote)
 			orderInBook = quote
 		}
 	}
-	return trades, orderInBook
+	return trades, orderInBook, nil
+}
+
+// canFill : check the opposite side has enough volume at acceptable prices to fill the quantity. With
+// self-trade prevention the orders of the owner never fill it: they are skipped when they are cancelled
+// (cancel oldest), otherwise the incoming order stops at the first of them
+func (orderBook *Orderbook) canFill(quote *Quote, price, quantity *big.Int) bool {
+	orderTree, ascending := orderBook.Bids, false
+	if quote.Side == Bid {
+		orderTree, ascending = orderBook.Asks, true
+	}
+	mode := orderBook.selfTradeMode(quote)
+	if quote.TradeID == "" || mode == "" || mode == STPNone {
+		return IsEqualOrGreaterThan(orderTree.VolumeToPrice(price, ascending), quantity)
+	}
+
+	volume := Zero()
+	iterator := orderTree.PriceTree.Iterator()
+	next, found := iterator.Prev, iterator.Last()
+	if ascending {
+		next, found = iterator.Next, iterator.First()
+	}
+	for ; found && IsStrictlySmallerThan(volume, quantity); found = next() {
+		orderList := orderTree.decodeOrderList(iterator.Value())
+		if (ascending && orderList.Item.Price.Cmp(price) > 0) || (!ascending && orderList.Item.Price.Cmp(price) < 0) {
+			break
+		}
+		levelVolume := Zero()
+		for _, order := range orderList.Orders() {
+			if order.Item.TradeID != quote.TradeID {
+				levelVolume = Add(levelVolume, order.Item.Quantity)
+				continue
+			}
+			if mode == STPCancelOldest {
+				continue
+			}
+			// only price-time priority fills the orders ahead of it before meeting it
+			if orderBook.MatchingPolicy.Name() == FIFOPolicy {
+				volume = Add(volume, levelVolume)
+			}
+			return IsEqualOrGreaterThan(volume, quantity)
+		}
+		volume = Add(volume, levelVolume)
+	}
+	return IsEqualOrGreaterThan(volume, quantity)
+}
+
+// applyPostOnly : reject or reprice the post-only order if it would cross the spread
+func (orderBook *Orderbook) applyPostOnly(quote *Quote) error {
+	if quote.TimeInForce == IOC || quote.TimeInForce == FOK {
+		return ErrPostOnlyNotResting
+	}
+
+	price := quote.Price
+	var newPrice *big.Int
+	if quote.Side == Bid {
+		if orderBook.Asks.NotEmpty() && IsEqualOrGreaterThan(price, orderBook.BestAsk()) {
+			newPrice = Sub(orderBook.BestAsk(), orderBook.TickSize)
+		}
+	} else {
+		if orderBook.Bids.NotEmpty() && IsEqualOrSmallerThan(price, orderBook.BestBid()) {
+			newPrice = Add(orderBook.BestBid(), orderBook.TickSize)
+		}
+	}
+
+	// not crossing, nothing to do
+	if newPrice == nil {
+		return nil
+	}
+
+	if orderBook.PostOnlyMode != PostOnlyReprice || newPrice.Sign() <= 0 {
+		return ErrPostOnlyWouldCross
+	}
+
+	quote.Price = newPrice
+	return nil
+}
+
+// validateExpireTime : good till date order must expire after the current time of the orderbook
+func (orderBook *Orderbook) validateExpireTime(quote *Quote) error {
+	if quote.TimeInForce == GTD && quote.ExpireTime <= orderBook.Item.Timestamp {
+		return ErrInvalidExpireTime
+	}
+	return nil
 }
 
-// ProcessOrder : process the order
-func (orderBook *Orderbook) ProcessOrder(quote map[string]string, verbose bool) ([]map[string]string, map[string]string) {
-	orderType := quote["type"]
-	var orderInBook map[string]string
-	var trades []map[string]string
+// ProcessOrder : process the order, the quote gets its order id and the remaining quantity
+// and is returned as order in book when it rests in the book
+func (orderBook *Orderbook) ProcessOrder(quote *Quote, verbose bool) ([]*Trade, *Quote, error) {
+	var orderInBook *Quote
+	var trades []*Trade
+	var err error
+
+	if err = quote.Validate(); err != nil {
+		return nil, nil, err
+	}
 
 	orderBook.UpdateTime()
+
+	// expiry only makes sense for limit order, market order never rests in the book
+	if !quote.IsMarket() {
+		if err = orderBook.validateExpireTime(quote); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = orderBook.checkPhase(quote); err != nil {
+		return nil, nil, err
+	}
+
 	// quote["timestamp"] = strconv.Itoa(orderBook.Time)
 	// if we do not use auto-increment orderid, we must set price slot to avoid conflict
 	orderBook.Item.NextOrderID++
+	quote.OrderID = orderBook.Item.NextOrderID
+	orderBook.openRecord(quote)
+
+	// the order is rejected when its owner can not pay for it
+	err = orderBook.lockFunds(quote)
+	switch {
+	case err != nil:
+	case quote.Type == StopMarket || quote.Type == StopLimit:
+		orderInBook, err = orderBook.processStopOrder(quote)
+	case orderBook.Phase() == PhaseAuction:
+		orderInBook, err = orderBook.collectAuctionOrder(quote)
+	default:
+		trades, orderInBook, err = orderBook.processOrder(quote, verbose)
+	}
 
-	if orderType == Market {
-		trades = orderBook.processMarketOrder(quote, verbose)
-	} else {
-		trades, orderInBook = orderBook.processLimitOrder(quote, verbose)
+	// resting good till date order is cancelled by the expiry scheduler
+	if err == nil && orderInBook != nil {
+		err = orderBook.addExpiry(orderInBook)
+	}
+	orderBook.finishRecord(quote, orderInBook, err)
+
+	// then release stop orders triggered by the trades above, including the cascade
+	if err == nil {
+		trades = append(trades, orderBook.processTriggeredOrders(verbose)...)
 	}
 
 	// update orderBook
 	orderBook.Save()
 
-	return trades, orderInBook
+	return trades, orderInBook, err
+}
+
+// processOrder : match market or limit order that already has its order id
+func (orderBook *Orderbook) processOrder(quote *Quote, verbose bool) ([]*Trade, *Quote, error) {
+	var trades []*Trade
+	var orderInBook *Quote
+	var err error
+	if quote.Type == Market {
+		trades = orderBook.processMarketOrder(quote, verbose)
+	} else {
+		trades, orderInBook, err = orderBook.processLimitOrder(quote, verbose)
+	}
+	quote.addFills(trades)
+	return trades, orderInBook, err
 }
 
-// processOrderList : process the order list
-func (orderBook *Orderbook) processOrderList(side string, orderList *OrderList, quantityStillToTrade *big.Int, quote map[string]string, verbose bool) (*big.Int, []map[string]string) {
+// processOrderList : process the order list, the matching policy of the pair decides which orders
+// of the level are filled and by how much
+func (orderBook *Orderbook) processOrderList(side string, orderList *OrderList, quantityStillToTrade *big.Int, quote *Quote, verbose bool) (*big.Int, []*Trade) {
 	quantityToTrade := CloneBigInt(quantityStillToTrade)
 	// quantityToTrade := quantityStillToTrade
-	var trades []map[string]string
+	var trades []*Trade
 	// speedup the comparison, do not assign because it is pointer
 	zero := Zero()
-	// var watchDog = 0
+	orderTree := orderBook.Asks
+	if side == Bid {
+		orderTree = orderBook.Bids
+	}
 	// fmt.Printf("CMP problem :%t - %t\n", quantityToTrade.Cmp(Zero()) > 0, IsGreaterThan(quantityToTrade, Zero()))
-	for orderList.Item.Length > 0 && quantityToTrade.Cmp(zero) > 0 {
+	for orderList.Item.Length > 0 && quantityToTrade.Cmp(zero) > 0 && !quote.cancelled {
 
-		headOrder := orderList.GetOrder(orderList.Item.HeadOrder)
-		// fmt.Printf("Head :%s ,%s\n", new(big.Int).SetBytes(orderList.Item.HeadOrder), orderBook.Asks.MinPriceList().String(0))
-		if headOrder == nil {
-			panic("headOrder is null")
-			// return Zero(), trades
-		}
+		// allocate again after each round, iceberg orders are replenished and self-trade prevention
+		// can change the level
+		orders := orderList.Orders()
+		allocations := orderBook.MatchingPolicy.Allocate(orders, quantityToTrade)
+		matched := false
 
-		tradedPrice := CloneBigInt(headOrder.Item.Price)
-
-		var newBookQuantity *big.Int
-		var tradedQuantity *big.Int
-
-		if IsStrictlySmallerThan(quantityToTrade, headOrder.Item.Quantity) {
-			tradedQuantity = CloneBigInt(quantityToTrade)
-			// Do the transaction
-			newBookQuantity = Sub(headOrder.Item.Quantity, quantityToTrade)
-			headOrder.UpdateQuantity(orderList, newBookQuantity, headOrder.Item.Timestamp)
-			quantityToTrade = Zero()
-
-		} else if IsEqual(quantityToTrade, headOrder.Item.Quantity) {
-			tradedQuantity = CloneBigInt(quantityToTrade)
-			if side == Bid {
-				// orderBook.Bids.RemoveOrderByID(headOrder.Key)
-				orderBook.Bids.RemoveOrder(headOrder)
-			} else {
-				// orderBook.Asks.RemoveOrderByID(headOrder.Key)
-				orderBook.Asks.RemoveOrder(headOrder)
+		for i, allocated := range allocations {
+			if allocated.Sign() <= 0 {
+				continue
+			}
+			// the order may have been changed by the previous fills of this round
+			order := orderList.GetOrder(orders[i].Key)
+			if order == nil {
+				panic("order is null")
 			}
-			quantityToTrade = Zero()
 
-		} else {
-			tradedQuantity = CloneBigInt(headOrder.Item.Quantity)
-			if side == Bid {
-				// orderBook.Bids.RemoveOrderByID(headOrder.Key)
-				orderBook.Bids.RemoveOrder(headOrder)
-			} else {
-				// orderBook.Asks.RemoveOrderByID(headOrder.Key)
-				// fmt.Printf("\nBEFORE : %s\n\n", orderList.String(0))
-				// orderList, _ = orderBook.Asks.RemoveOrder(headOrder)
-				orderBook.Asks.RemoveOrderFromOrderList(headOrder, orderList)
-				// fmt.Println("AFTER DELETE", orderList.String(0))
-				// fmt.Printf("\nAFTER : %x, %s\n\n", orderList.Item.HeadOrder, orderList.String(0))
+			matched = true
+			// orders of the same owner never trade with each other unless allowed
+			if orderBook.isSelfTrade(quote, order) {
+				quantityToTrade = orderBook.preventSelfTrade(quote, orderTree, orderList, order, quantityToTrade)
+				break
+			}
+
+			trade := &Trade{
+				PairName:      orderBook.Item.Name,
+				Timestamp:     orderBook.Item.Timestamp,
+				Price:         CloneBigInt(order.Item.Price),
+				Quantity:      minBigInt(allocated, quantityToTrade),
+				AggressorSide: quote.Side,
+				MakerOrderID:  new(big.Int).SetBytes(order.Key).Uint64(),
+				TakerOrderID:  quote.OrderID,
+				MakerTradeID:  order.Item.TradeID,
+				TakerTradeID:  quote.TradeID,
+			}
+			orderBook.computeFees(trade)
+			// a fill that can not be paid for does not happen, the order of the party that can not pay
+			// is cancelled
+			if makerPays, takerPays := orderBook.canSettle(trade); !makerPays || !takerPays {
+				if !makerPays {
+					orderBook.cancelResting(orderTree, orderList, order, ErrInsufficientFunds.Error())
+				}
+				if !takerPays {
+					quote.cancelled = true
+				}
+				break
+			}
+			// funds move before the orders do, a settlement that fails leaves both orders as they
+			// were and the incoming order stops matching
+			if err := orderBook.settleTrade(trade); err != nil {
+				quote.cancelled = true
+				break
 			}
-		}
 
-		if verbose {
-			fmt.Printf("TRADE: Timestamp - %d, Price - %s, Quantity - %s, TradeID - %s, Matching TradeID - %s\n",
-				orderBook.Item.Timestamp, tradedPrice, tradedQuantity, headOrder.Item.TradeID, quote["trade_id"])
-			// fmt.Println(headOrder)
-			// watchDog++
-			// if watchDog > 10 {
-			// panic("stop")
-			// }
+			tradedQuantity := trade.Quantity
+			makerRemaining := orderBook.fillOrder(orderTree, orderList, order, tradedQuantity)
+			quantityToTrade = Sub(quantityToTrade, tradedQuantity)
 
+			if verbose {
+				fmt.Printf("TRADE: Timestamp - %d, Price - %s, Quantity - %s, TradeID - %s, Matching TradeID - %s\n",
+					orderBook.Item.Timestamp, trade.Price, tradedQuantity, order.Item.TradeID, quote.TradeID)
+			}
+
+			orderBook.Item.NextExecutionID++
+			trade.ExecutionID = orderBook.Item.NextExecutionID
+			trade.MakerRemaining = makerRemaining
+			trade.TakerRemaining = CloneBigInt(quantityToTrade)
+			trade.MakerFilled = makerRemaining.Sign() == 0
+			trade.TakerFilled = quantityToTrade.Sign() == 0
+			trades = append(trades, trade)
+			orderBook.chargeFees(trade)
+			orderBook.recordTrade(trade)
+			orderBook.appendTrade(trade)
 		}
 
-		transactionRecord := make(map[string]string)
-		transactionRecord["timestamp"] = strconv.FormatUint(orderBook.Item.Timestamp, 10)
-		transactionRecord["price"] = tradedPrice.String()
-		transactionRecord["quantity"] = tradedQuantity.String()
+		if !matched {
+			break
+		}
+	}
 
-		trades = append(trades, transactionRecord)
+	// evaluate the trigger book right after this batch, so the cascade order is deterministic
+	if len(trades) > 0 {
+		orderBook.triggerStopOrders(trades[len(trades)-1].Price)
 	}
 	return quantityToTrade, trades
 }
 
-// CancelOrder : cancel the order, just need ID, side and price, of course order must belong
-// to a price point as well
-func (orderBook *Orderbook) CancelOrder(side string, orderID uint64, price *big.Int) error {
-	orderBook.UpdateTime()
-	key := GetKeyFromBig(big.NewInt(int64(orderID)))
-	var err error
-	if side == Bid {
-		order := orderBook.Bids.GetOrder(key, price)
-		if order != nil {
-			_, err = orderBook.Bids.RemoveOrder(order)
-		}
-		// if orderBook.Bids.OrderExist(key, price) {
-		// 	orderBook.Bids.RemoveOrder(order)
-		// }
-	} else {
-
-		order := orderBook.Asks.GetOrder(key, price)
-		if order != nil {
-			_, err = orderBook.Asks.RemoveOrder(order)
-		}
+// fillOrder : take the traded quantity from the displayed quantity of the resting order, which is
+// removed when it is filled or replenished when it is an iceberg, and return what is still open
+func (orderBook *Orderbook) fillOrder(orderTree *OrderTree, orderList *OrderList, order *Order, tradedQuantity *big.Int) *big.Int {
+	if IsStrictlySmallerThan(tradedQuantity, order.Item.Quantity) {
+		newBookQuantity := Sub(order.Item.Quantity, tradedQuantity)
+		order.UpdateQuantity(orderList, newBookQuantity, order.Item.Timestamp)
+		orderTree.Item.Volume = Sub(orderTree.Item.Volume, tradedQuantity)
+		return order.RemainingQuantity()
+	}
 
-		// if orderBook.Asks.OrderExist(key) {
-		// 	orderBook.Asks.RemoveOrder(order)
-		// }
+	if order.IsIceberg() {
+		// the peak is filled, show the next one from the reserve
+		order.Replenish(orderList)
+		orderTree.Item.Volume = Add(Sub(orderTree.Item.Volume, tradedQuantity), order.Item.Quantity)
+		return order.RemainingQuantity()
 	}
 
-	return err
+	// remove from this orderList so that its length stays in sync with the loop
+	orderBook.removeOrder(orderTree, orderList, order)
+	return Zero()
 }
 
-func (orderBook *Orderbook) UpdateOrder(quoteUpdate map[string]string) error {
-	orderID, err := strconv.ParseUint(quoteUpdate["order_id"], 10, 64)
-	if err == nil {
-		price, ok := new(big.Int).SetString(quoteUpdate["price"], 10)
-		if !ok {
-			return fmt.Errorf("Price is not correct :%s", quoteUpdate["price"])
-		}
+// CancelOrder : cancel the resting order or stop order, found by its id alone
+func (orderBook *Orderbook) CancelOrder(orderID uint64) error {
+	return orderBook.closeOrder(orderID, OrderStatusCancelled)
+}
+
+// ExpireOrder : cancel the good till date order that reached its expire time
+func (orderBook *Orderbook) ExpireOrder(orderID uint64) error {
+	return orderBook.closeOrder(orderID, OrderStatusExpired)
+}
 
-		return orderBook.ModifyOrder(quoteUpdate, orderID, price)
+// closeOrder : remove the resting order or stop order and close its lifecycle with the status
+func (orderBook *Orderbook) closeOrder(orderID uint64, status string) error {
+	orderBook.UpdateTime()
+	order, location := orderBook.GetOrderByID(orderID)
+	if order == nil {
+		return ErrOrderNotFound
 	}
-	return err
+
+	orderTree := orderBook.getLocationTree(location)
+	if err := orderBook.removeOrder(orderTree, orderTree.PriceList(location.Price), order); err != nil {
+		return err
+	}
+	if location.Stop {
+		orderBook.removeStopQuote(order.Key)
+	}
+	orderBook.closeRecord(orderID, status, "")
+	// the sequence of the deltas sent for the removal must survive a restart
+	return orderBook.Save()
 }
 
-// ModifyOrder : modify the order
-func (orderBook *Orderbook) ModifyOrder(quoteUpdate map[string]string, orderID uint64, price *big.Int) error {
+// UpdateOrder : amend the resting order of the quote, see ModifyOrder
+func (orderBook *Orderbook) UpdateOrder(quoteUpdate *Quote) ([]*Trade, *Quote, error) {
+	return orderBook.ModifyOrder(quoteUpdate, quoteUpdate.OrderID)
+}
+
+// ModifyOrder : amend the resting order to the price and quantity (remaining, including the hidden
+// reserve) of the quote, nil keeps the current value. A quantity decrease keeps the time priority,
+// a quantity increase or a price change replaces the order at the tail of its level and the new
+// price can match like a new limit order. The amended order is returned when it still rests
+func (orderBook *Orderbook) ModifyOrder(quoteUpdate *Quote, orderID uint64) ([]*Trade, *Quote, error) {
+	if quoteUpdate.Price != nil && quoteUpdate.Price.Sign() <= 0 {
+		return nil, nil, ErrInvalidPrice
+	}
+	if quoteUpdate.Quantity != nil && quoteUpdate.Quantity.Sign() <= 0 {
+		return nil, nil, ErrInvalidQuantity
+	}
+	if orderBook.Phase() == PhaseClosed {
+		return nil, nil, ErrMarketClosed
+	}
+
+	order, location := orderBook.GetOrderByID(orderID)
+	if order == nil {
+		return nil, nil, ErrOrderNotFound
+	}
+	if location.Stop {
+		return nil, nil, ErrAmendStopOrder
+	}
 	orderBook.UpdateTime()
 
-	side := quoteUpdate["side"]
-	quoteUpdate["order_id"] = strconv.FormatUint(orderID, 10)
-	quoteUpdate["timestamp"] = strconv.FormatUint(orderBook.Item.Timestamp, 10)
-	key := GetKeyFromBig(ToBigInt(quoteUpdate["order_id"]))
-	if side == Bid {
+	price := location.Price
+	if quoteUpdate.Price != nil {
+		price = quoteUpdate.Price
+	}
+	remaining := order.RemainingQuantity()
+	quantity := remaining
+	if quoteUpdate.Quantity != nil {
+		quantity = quoteUpdate.Quantity
+	}
+
+	quoteUpdate.OrderID = orderID
+	quoteUpdate.Side = location.Side
+	quoteUpdate.Price = CloneBigInt(price)
+	quoteUpdate.Quantity = CloneBigInt(quantity)
+	quoteUpdate.TradeID = order.Item.TradeID
+
+	// the owner must be able to pay for the amended order before it is touched, the funds are only
+	// locked once the amend can no longer be rejected
+	if err := orderBook.canRelockFunds(orderID, location.Side, price, quantity); err != nil {
+		return nil, nil, err
+	}
+
+	orderTree := orderBook.getLocationTree(location)
+	orderList := orderTree.PriceList(location.Price)
 
-		if orderBook.Bids.OrderExist(key, price) {
-			return orderBook.Bids.UpdateOrder(quoteUpdate)
+	// same price and not more quantity, the order keeps its place in the queue
+	if IsEqual(price, location.Price) && IsEqualOrSmallerThan(quantity, remaining) {
+		if err := orderBook.relockFunds(orderID, location.Side, price, quantity); err != nil {
+			return nil, nil, err
 		}
-		// if orderBook.Bids.OrderExist(key) {
-		// 	orderBook.Bids.UpdateOrder(quoteUpdate)
-		// }
-	} else {
+		displayed := CloneBigInt(order.Item.Quantity)
+		order.Decrease(orderList, Sub(remaining, quantity))
+		orderTree.Item.Volume = Sub(orderTree.Item.Volume, Sub(displayed, order.Item.Quantity))
+		quoteUpdate.Timestamp = order.Item.Timestamp
+		orderBook.amendRecord(orderID, price, quantity)
+		return nil, quoteUpdate, orderBook.Save()
+	}
 
-		if orderBook.Asks.OrderExist(key, price) {
-			return orderBook.Asks.UpdateOrder(quoteUpdate)
+	// otherwise cancel and replace, keeping the id, the owner, the expiry and the peak of an iceberg
+	replace := &Quote{
+		PairName:      orderBook.Item.Name,
+		OrderID:       orderID,
+		Type:          Limit,
+		Side:          location.Side,
+		Price:         CloneBigInt(price),
+		Quantity:      CloneBigInt(quantity),
+		TradeID:       order.Item.TradeID,
+		Timestamp:     orderBook.Item.Timestamp,
+		PostOnly:      quoteUpdate.PostOnly,
+		SelfTradeMode: quoteUpdate.SelfTradeMode,
+	}
+	if order.Item.ExpireTime > 0 {
+		replace.TimeInForce = GTD
+		replace.ExpireTime = order.Item.ExpireTime
+	}
+	if order.Item.PeakSize != nil && order.Item.PeakSize.Sign() > 0 {
+		replace.DisplayQuantity = CloneBigInt(order.Item.PeakSize)
+	}
+	// rejected post-only amend leaves the order as it was
+	if replace.PostOnly && orderBook.Phase() == PhaseContinuous {
+		if err := orderBook.applyPostOnly(replace); err != nil {
+			return nil, nil, err
 		}
 	}
+	// a post-only price can only have moved away from the book, it needs no more funds than checked
+	if err := orderBook.relockFunds(orderID, location.Side, replace.Price, quantity); err != nil {
+		return nil, nil, err
+	}
+	if err := orderBook.removeOrder(orderTree, orderList, order); err != nil {
+		orderBook.relockFunds(orderID, location.Side, location.Price, remaining)
+		return nil, nil, err
+	}
+	orderBook.amendRecord(orderID, price, quantity)
 
-	return nil
+	var trades []*Trade
+	var orderInBook *Quote
+	var err error
+	if orderBook.Phase() == PhaseAuction {
+		orderInBook, err = orderBook.collectAuctionOrder(replace)
+	} else {
+		trades, orderInBook, err = orderBook.processOrder(replace, false)
+	}
+	orderBook.finishRecord(replace, orderInBook, err)
+	if err == nil {
+		trades = append(trades, orderBook.processTriggeredOrders(false)...)
+	}
+	orderBook.Save()
+
+	quoteUpdate.Timestamp = replace.Timestamp
+	quoteUpdate.FilledQuantity = replace.FilledQuantity
+	quoteUpdate.AveragePrice = replace.AveragePrice
+	return trades, orderInBook, err
 }
 
 // VolumeAtPrice : get volume at the current price
@@ -1,6 +1,11 @@
 package orderbook
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strconv"
 	"testing"
 )
 
@@ -34,84 +39,22 @@ func TestOrderbook(t *testing.T) {
 	orderBook := testOrderbook
 	orderBook.Restore()
 
-	limitOrders := make([]map[string]string, 0)
-
-	dummyOrder := make(map[string]string)
-	dummyOrder["type"] = "limit"
-	dummyOrder["side"] = Ask
-	dummyOrder["quantity"] = "5"
-	dummyOrder["price"] = "101"
-	dummyOrder["trade_id"] = "100"
-
-	limitOrders = append(limitOrders, dummyOrder)
-
-	dummyOrder1 := make(map[string]string)
-	dummyOrder1["type"] = "limit"
-	dummyOrder1["side"] = Ask
-	dummyOrder1["quantity"] = "5"
-	dummyOrder1["price"] = "103"
-	dummyOrder1["trade_id"] = "101"
-
-	limitOrders = append(limitOrders, dummyOrder1)
-
-	dummyOrder2 := make(map[string]string)
-	dummyOrder2["type"] = "limit"
-	dummyOrder2["side"] = Ask
-	dummyOrder2["quantity"] = "5"
-	dummyOrder2["price"] = "101"
-	dummyOrder2["trade_id"] = "102"
-
-	limitOrders = append(limitOrders, dummyOrder2)
-
-	dummyOrder7 := make(map[string]string)
-	dummyOrder7["type"] = "limit"
-	dummyOrder7["side"] = Ask
-	dummyOrder7["quantity"] = "5"
-	dummyOrder7["price"] = "101"
-	dummyOrder7["trade_id"] = "103"
-
-	limitOrders = append(limitOrders, dummyOrder7)
-
-	dummyOrder3 := make(map[string]string)
-	dummyOrder3["type"] = "limit"
-	dummyOrder3["side"] = Bid
-	dummyOrder3["quantity"] = "5"
-	dummyOrder3["price"] = "99"
-	dummyOrder3["trade_id"] = "100"
-
-	limitOrders = append(limitOrders, dummyOrder3)
-
-	dummyOrder4 := make(map[string]string)
-	dummyOrder4["type"] = "limit"
-	dummyOrder4["side"] = Bid
-	dummyOrder4["quantity"] = "5"
-	dummyOrder4["price"] = "98"
-	dummyOrder4["trade_id"] = "101"
-	limitOrders = append(limitOrders, dummyOrder4)
-
-	dummyOrder5 := make(map[string]string)
-	dummyOrder5["type"] = "limit"
-	dummyOrder5["side"] = Bid
-	dummyOrder5["quantity"] = "5"
-	dummyOrder5["price"] = "99"
-	dummyOrder5["trade_id"] = "102"
-
-	limitOrders = append(limitOrders, dummyOrder5)
-
-	dummyOrder6 := make(map[string]string)
-	dummyOrder6["type"] = "limit"
-	dummyOrder6["side"] = Bid
-	dummyOrder6["quantity"] = "5"
-	dummyOrder6["price"] = "97"
-	dummyOrder6["trade_id"] = "103"
-
-	limitOrders = append(limitOrders, dummyOrder6)
+	limitOrders := []*Quote{
+		newTestQuote(Ask, "101", "5", "100"),
+		newTestQuote(Ask, "103", "5", "101"),
+		newTestQuote(Ask, "101", "5", "102"),
+		newTestQuote(Ask, "101", "5", "103"),
+		newTestQuote(Bid, "99", "5", "100"),
+		newTestQuote(Bid, "98", "5", "101"),
+		newTestQuote(Bid, "99", "5", "102"),
+		newTestQuote(Bid, "97", "5", "103"),
+	}
 
 	// t.Logf("Limit Orders :%s", ToJSON(limitOrders))
-	var trades []map[string]string
-	var orderInBook map[string]string
+	var trades []*Trade
+	var orderInBook *Quote
 	for _, order := range limitOrders {
-		trades, orderInBook = orderBook.ProcessOrder(order, true)
+		trades, orderInBook, _ = orderBook.ProcessOrder(order, true)
 	}
 	// t.Logf("\nOrderbook :%s", orderBook.String(0))
 	// return
@@ -143,20 +86,15 @@ func TestOrderbook(t *testing.T) {
 	}
 
 	//Submitting a limit order that crosses the opposing best price will result in a trade
-	marketOrder := make(map[string]string)
-	marketOrder["type"] = "limit"
-	marketOrder["side"] = Bid
-	marketOrder["quantity"] = "2"
-	marketOrder["price"] = "102"
-	marketOrder["trade_id"] = "109"
+	marketOrder := newTestQuote(Bid, "102", "2", "109")
 
-	trades, orderInBook = orderBook.ProcessOrder(marketOrder, true)
+	trades, orderInBook, _ = orderBook.ProcessOrder(marketOrder, true)
 
 	if len(trades) > 0 {
-		tradedPrice := trades[0]["price"]
-		tradedQuantity := trades[0]["quantity"]
+		tradedPrice := trades[0].Price.String()
+		tradedQuantity := trades[0].Quantity.String()
 
-		if !(tradedPrice == "101" && tradedQuantity == "2" && len(orderInBook) == 0) {
+		if !(tradedPrice == "101" && tradedQuantity == "2" && orderInBook == nil) {
 			t.Errorf("orderBook.ProcessOrder incorrect")
 		}
 	}
@@ -167,16 +105,11 @@ func TestOrderbook(t *testing.T) {
 
 	// If a limit crosses but is only partially matched, the remaning volume will
 	// be placed in the book as an outstanding order
-	bigOrder := make(map[string]string)
-	bigOrder["type"] = "limit"
-	bigOrder["side"] = Bid
-	bigOrder["quantity"] = "50"
-	bigOrder["price"] = "102"
-	bigOrder["trade_id"] = "110"
+	bigOrder := newTestQuote(Bid, "102", "50", "110")
 
-	trades, orderInBook = orderBook.ProcessOrder(bigOrder, true)
+	trades, orderInBook, _ = orderBook.ProcessOrder(bigOrder, true)
 
-	if len(orderInBook) == 0 {
+	if orderInBook == nil {
 		t.Errorf("orderBook.ProcessOrder incorrect")
 	}
 
@@ -220,3 +153,1252 @@ func TestOrderbookRestore(t *testing.T) {
 
 	t.Logf("\nOrder : %s", order)
 }
+
+func TestTimeInForce(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("TIF/WETH")
+	defer cleanup()
+
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "5", "1"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "102", "5", "2"), false)
+
+	// fill or kill can not be filled, book must stay untouched
+	fok := newTestQuote(Bid, "101", "6", "3")
+	fok.TimeInForce = FOK
+	trades, orderInBook, err := orderBook.ProcessOrder(fok, false)
+	if err != ErrFillOrKillNotFilled || len(trades) != 0 || orderInBook != nil {
+		t.Errorf("FOK should be rejected, got err: %v, trades: %v, orderInBook: %v", err, trades, orderInBook)
+	}
+	if orderBook.VolumeAtPrice(Ask, ToBigInt("101")).Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("FOK rejection must not touch the book, got volume: %v", orderBook.VolumeAtPrice(Ask, ToBigInt("101")))
+	}
+
+	// fill or kill sweeping two levels
+	fok = newTestQuote(Bid, "102", "6", "3")
+	fok.TimeInForce = FOK
+	trades, orderInBook, err = orderBook.ProcessOrder(fok, false)
+	if err != nil || len(trades) != 2 || orderInBook != nil {
+		t.Errorf("FOK should be filled, got err: %v, trades: %v, orderInBook: %v", err, trades, orderInBook)
+	}
+
+	// immediate or cancel discards the remaining quantity
+	ioc := newTestQuote(Bid, "102", "10", "4")
+	ioc.TimeInForce = IOC
+	trades, orderInBook, err = orderBook.ProcessOrder(ioc, false)
+	if err != nil || len(trades) != 1 || orderInBook != nil {
+		t.Errorf("IOC remaining should be discarded, got err: %v, trades: %v, orderInBook: %v", err, trades, orderInBook)
+	}
+	if orderBook.Bids.NotEmpty() {
+		t.Errorf("IOC order must not rest in the book")
+	}
+
+	// good till date needs an expiry in the future
+	gtd := newTestQuote(Bid, "100", "1", "5")
+	gtd.TimeInForce = GTD
+	if _, _, err = orderBook.ProcessOrder(gtd, false); err != ErrInvalidExpireTime {
+		t.Errorf("GTD without expiry should be rejected, got: %v", err)
+	}
+	expireTime := orderBook.Item.Timestamp + 3600
+	gtd.ExpireTime = expireTime
+	_, orderInBook, err = orderBook.ProcessOrder(gtd, false)
+	if err != nil || orderInBook == nil {
+		t.Fatalf("GTD should rest in the book, got err: %v", err)
+	}
+	order := orderBook.GetOrder(GetKeyFromUint64(orderInBook.OrderID))
+	if order == nil || order.Item.ExpireTime != expireTime {
+		t.Errorf("GTD order should carry the expiry, got: %v", order)
+	}
+}
+
+func TestPostOnly(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("POST/WETH")
+	defer cleanup()
+
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "5", "1"), false)
+	orderBook.ProcessOrder(newTestQuote(Bid, "99", "5", "2"), false)
+
+	// crossing post-only order is rejected by default
+	postOnly := newTestQuote(Bid, "101", "1", "3")
+	postOnly.PostOnly = true
+	trades, _, err := orderBook.ProcessOrder(postOnly, false)
+	if err != ErrPostOnlyWouldCross || len(trades) != 0 {
+		t.Errorf("post-only order should be rejected, got err: %v, trades: %v", err, trades)
+	}
+
+	// with reprice mode it rests one tick behind the best ask
+	orderBook.PostOnlyMode = PostOnlyReprice
+	orderBook.TickSize = ToBigInt("2")
+	postOnly = newTestQuote(Bid, "101", "1", "3")
+	postOnly.PostOnly = true
+	trades, orderInBook, err := orderBook.ProcessOrder(postOnly, false)
+	if err != nil || len(trades) != 0 || orderInBook == nil || orderInBook.Price.String() != "99" {
+		t.Errorf("post-only order should be repriced, got err: %v, trades: %v, orderInBook: %v", err, trades, orderInBook)
+	}
+
+	postOnly = newTestQuote(Ask, "98", "1", "4")
+	postOnly.PostOnly = true
+	_, orderInBook, err = orderBook.ProcessOrder(postOnly, false)
+	if err != nil || orderInBook == nil || orderInBook.Price.String() != "101" {
+		t.Errorf("post-only ask should be repriced, got err: %v, orderInBook: %v", err, orderInBook)
+	}
+
+	// non crossing post-only order keeps its price
+	postOnly = newTestQuote(Ask, "105", "1", "5")
+	postOnly.PostOnly = true
+	_, orderInBook, err = orderBook.ProcessOrder(postOnly, false)
+	if err != nil || orderInBook == nil || orderInBook.Price.String() != "105" {
+		t.Errorf("post-only ask should rest at its price, got err: %v, orderInBook: %v", err, orderInBook)
+	}
+}
+
+func TestStopOrder(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("STOP/WETH")
+	defer cleanup()
+
+	orderBook.ProcessOrder(newTestQuote(Bid, "96", "1", "1"), false)
+	orderBook.ProcessOrder(newTestQuote(Bid, "94", "5", "2"), false)
+
+	stop := newTestQuote(Ask, "0", "2", "3")
+	stop.Type = StopMarket
+	if _, _, err := orderBook.ProcessOrder(stop, false); err != ErrInvalidStopPrice {
+		t.Errorf("stop order without stop price should be rejected, got: %v", err)
+	}
+	stop.StopPrice = ToBigInt("95")
+	_, orderInBook, err := orderBook.ProcessOrder(stop, false)
+	if err != nil || orderInBook == nil || !orderBook.StopAsks.NotEmpty() {
+		t.Fatalf("stop order should rest in the trigger book, got err: %v", err)
+	}
+
+	// trade at 96 does not go through the stop price
+	sell := newTestQuote(Ask, "0", "1", "4")
+	sell.Type = Market
+	trades, _, _ := orderBook.ProcessOrder(sell, false)
+	if len(trades) != 1 || !orderBook.StopAsks.NotEmpty() {
+		t.Errorf("stop order should not be triggered, got trades: %v", trades)
+	}
+
+	// trade at 94 releases the stop order as market order
+	sell = newTestQuote(Ask, "0", "1", "5")
+	sell.Type = Market
+	trades, _, _ = orderBook.ProcessOrder(sell, false)
+	if len(trades) != 2 || trades[1].Quantity.String() != "2" || orderBook.StopAsks.NotEmpty() {
+		t.Errorf("stop order should be triggered, got trades: %v", trades)
+	}
+	if orderBook.VolumeAtPrice(Bid, ToBigInt("94")).Cmp(ToBigInt("2")) != 0 {
+		t.Errorf("volume after stop incorrect, got: %v", orderBook.VolumeAtPrice(Bid, ToBigInt("94")))
+	}
+
+	// stop limit order can be cancelled with its stop price
+	stopLimit := newTestQuote(Bid, "120", "1", "6")
+	stopLimit.Type = StopLimit
+	stopLimit.StopPrice = ToBigInt("110")
+	_, orderInBook, _ = orderBook.ProcessOrder(stopLimit, false)
+	orderID := orderInBook.OrderID
+	if err := orderBook.CancelOrder(orderID); err != nil || orderBook.StopBids.NotEmpty() {
+		t.Errorf("stop order should be cancelled, got err: %v", err)
+	}
+}
+
+func TestIcebergOrder(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("ICE/WETH")
+	defer cleanup()
+
+	iceberg := newTestQuote(Ask, "101", "10", "1")
+	iceberg.DisplayQuantity = ToBigInt("0")
+	if _, _, err := orderBook.ProcessOrder(iceberg, false); err != ErrInvalidDisplayQuantity {
+		t.Errorf("iceberg order without display quantity should be rejected, got: %v", err)
+	}
+	iceberg.DisplayQuantity = ToBigInt("3")
+	_, orderInBook, _ := orderBook.ProcessOrder(iceberg, false)
+	icebergID := orderInBook.OrderID
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "2", "2"), false)
+
+	// only the peak is shown
+	if orderBook.VolumeAtPrice(Ask, ToBigInt("101")).Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("volume should only count displayed quantity, got: %v", orderBook.VolumeAtPrice(Ask, ToBigInt("101")))
+	}
+
+	// the peak is filled, replenished order goes behind the second one
+	trades, _, _ := orderBook.ProcessOrder(newTestQuote(Bid, "101", "4", "3"), false)
+	if len(trades) != 2 || trades[0].Quantity.String() != "3" || trades[1].Quantity.String() != "1" {
+		t.Errorf("iceberg should lose priority after replenish, got trades: %v", trades)
+	}
+	if orderBook.VolumeAtPrice(Ask, ToBigInt("101")).Cmp(ToBigInt("4")) != 0 || orderBook.Asks.Item.Volume.Cmp(ToBigInt("4")) != 0 {
+		t.Errorf("volume after replenish incorrect, got: %v", orderBook.VolumeAtPrice(Ask, ToBigInt("101")))
+	}
+	if orderList := orderBook.Asks.PriceList(ToBigInt("101")); !bytes.Equal(orderList.Item.TailOrder, GetKeyFromUint64(icebergID)) {
+		t.Errorf("replenished iceberg should be at the tail of the price level")
+	}
+
+	orderBook.ProcessOrder(newTestQuote(Bid, "101", "5", "4"), false)
+	order := orderBook.Asks.GetOrder(GetKeyFromUint64(icebergID), ToBigInt("101"))
+	if order == nil || order.Item.Quantity.Cmp(ToBigInt("2")) != 0 || order.Item.Reserve.Cmp(ToBigInt("1")) != 0 {
+		t.Fatalf("iceberg remaining quantity incorrect, got: %v", order)
+	}
+
+	// reserve survives the encoding
+	encoded, _ := EncodeBytesItem(order.Item)
+	decoded := &OrderItem{}
+	DecodeBytesItem(encoded, decoded)
+	if decoded.Reserve.Cmp(order.Item.Reserve) != 0 || decoded.PeakSize.Cmp(ToBigInt("3")) != 0 {
+		t.Errorf("iceberg fields not encoded, got: %v", decoded)
+	}
+}
+
+func TestExecutionReport(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("EXEC/WETH")
+	defer cleanup()
+
+	_, maker1, _ := orderBook.ProcessOrder(newTestQuote(Ask, "101", "2", "maker1"), false)
+	_, maker2, _ := orderBook.ProcessOrder(newTestQuote(Ask, "102", "5", "maker2"), false)
+
+	taker := newTestQuote(Bid, "102", "4", "taker")
+	trades, orderInBook, _ := orderBook.ProcessOrder(taker, false)
+	if len(trades) != 2 || orderInBook != nil {
+		t.Fatalf("taker should be filled by two makers, got trades: %s", ToJSON(trades))
+	}
+
+	first, second := trades[0], trades[1]
+	if first.ExecutionID != 1 || second.ExecutionID != 2 || first.PairName != "exec/weth" || first.AggressorSide != Bid {
+		t.Errorf("execution report header incorrect, got: %s", ToJSON(first))
+	}
+	if first.MakerOrderID != maker1.OrderID || first.TakerOrderID != taker.OrderID ||
+		first.MakerTradeID != "maker1" || first.TakerTradeID != "taker" {
+		t.Errorf("execution report parties incorrect, got: %s", ToJSON(first))
+	}
+	if !first.MakerFilled || first.TakerFilled || first.TakerRemaining.Cmp(ToBigInt("2")) != 0 {
+		t.Errorf("first fill remaining incorrect, got: %s", ToJSON(first))
+	}
+	if second.MakerOrderID != maker2.OrderID || second.MakerFilled || !second.TakerFilled ||
+		second.MakerRemaining.Cmp(ToBigInt("3")) != 0 || second.TakerRemaining.Sign() != 0 {
+		t.Errorf("second fill remaining incorrect, got: %s", ToJSON(second))
+	}
+
+	// execution id keeps increasing after a restart
+	orderBook.Commit()
+	restored := NewOrderbook("EXEC/WETH", orderBook.db)
+	restored.Restore()
+	if restored.Item.NextExecutionID != 2 {
+		t.Errorf("execution id should be persisted, got: %d", restored.Item.NextExecutionID)
+	}
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("STP/WETH")
+	defer cleanup()
+
+	// default of the pair lets the owner trade with itself
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "1", "bot"), false)
+	trades, _, _ := orderBook.ProcessOrder(newTestQuote(Bid, "101", "1", "bot"), false)
+	if len(trades) != 1 {
+		t.Errorf("self trade should be allowed by default, got trades: %v", trades)
+	}
+
+	invalid := newTestQuote(Bid, "101", "1", "bot")
+	invalid.SelfTradeMode = "cancel_all"
+	if _, _, err := orderBook.ProcessOrder(invalid, false); err != ErrInvalidSelfTradeMode {
+		t.Errorf("unknown mode should be rejected, got: %v", err)
+	}
+
+	// cancel newest: the incoming order is cancelled, the resting one stays
+	orderBook.SelfTradeMode = STPCancelNewest
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "2", "bot"), false)
+	trades, orderInBook, _ := orderBook.ProcessOrder(newTestQuote(Bid, "101", "1", "bot"), false)
+	if len(trades) != 0 || orderInBook != nil || orderBook.VolumeAtPrice(Ask, ToBigInt("101")).Cmp(ToBigInt("2")) != 0 {
+		t.Errorf("incoming order should be cancelled, got trades: %v, orderInBook: %v", trades, orderInBook)
+	}
+
+	// cancel oldest: the resting order is cancelled and matching goes on with the next one
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "3", "other"), false)
+	cancelOldest := newTestQuote(Bid, "101", "1", "bot")
+	cancelOldest.SelfTradeMode = STPCancelOldest
+	trades, _, _ = orderBook.ProcessOrder(cancelOldest, false)
+	if len(trades) != 1 || trades[0].MakerTradeID != "other" || orderBook.VolumeAtPrice(Ask, ToBigInt("101")).Cmp(ToBigInt("2")) != 0 {
+		t.Errorf("resting order should be cancelled, got trades: %v", trades)
+	}
+
+	// decrement and cancel: the larger resting order is decreased, the smaller incoming one is cancelled
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "5", "bot"), false)
+	decrement := newTestQuote(Bid, "101", "1", "other")
+	decrement.SelfTradeMode = STPDecrementAndCancel
+	trades, orderInBook, _ = orderBook.ProcessOrder(decrement, false)
+	if len(trades) != 0 || orderInBook != nil || orderBook.VolumeAtPrice(Ask, ToBigInt("101")).Cmp(ToBigInt("6")) != 0 {
+		t.Errorf("orders should be decremented, got trades: %v, volume: %v", trades, orderBook.VolumeAtPrice(Ask, ToBigInt("101")))
+	}
+	if orderBook.Asks.Item.Volume.Cmp(ToBigInt("6")) != 0 {
+		t.Errorf("tree volume after decrement incorrect, got: %v", orderBook.Asks.Item.Volume)
+	}
+
+	// cancel both
+	cancelBoth := newTestQuote(Bid, "101", "3", "other")
+	cancelBoth.SelfTradeMode = STPCancelBoth
+	trades, orderInBook, _ = orderBook.ProcessOrder(cancelBoth, false)
+	if len(trades) != 0 || orderInBook != nil || orderBook.VolumeAtPrice(Ask, ToBigInt("101")).Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("both orders should be cancelled, got trades: %v, volume: %v", trades, orderBook.Asks.Item.Volume)
+	}
+}
+
+func TestMarketOrderProtection(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("MKT/WETH")
+	defer cleanup()
+
+	orderBook.ProcessOrder(newTestQuote(Ask, "100", "2", "1"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "110", "2", "2"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "130", "2", "3"), false)
+
+	// quote quantity is only for market buy
+	invalid := newTestQuote(Ask, "0", "0", "4")
+	invalid.Type = Market
+	invalid.Quantity = nil
+	invalid.QuoteQuantity = ToBigInt("100")
+	if _, _, err := orderBook.ProcessOrder(invalid, false); err != ErrInvalidQuoteQuantity {
+		t.Errorf("market sell by amount should be rejected, got: %v", err)
+	}
+
+	// spend 330: 2 at 100, 1 at 110, the rest can not buy another unit
+	byAmount := &Quote{Type: Market, Side: Bid, QuoteQuantity: ToBigInt("330"), TradeID: "5"}
+	trades, _, err := orderBook.ProcessOrder(byAmount, false)
+	if err != nil || len(trades) != 2 || trades[1].Quantity.Cmp(ToBigInt("1")) != 0 {
+		t.Fatalf("market buy by amount incorrect, got err: %v, trades: %s", err, ToJSON(trades))
+	}
+	if byAmount.FilledQuantity.Cmp(ToBigInt("3")) != 0 || byAmount.AveragePrice.Cmp(ToBigInt("103")) != 0 || byAmount.Unspent.Cmp(ToBigInt("20")) != 0 {
+		t.Errorf("market buy by amount report incorrect, got: %s", ToJSON(byAmount))
+	}
+
+	// 10% slippage from 110 stops before 130
+	slippage := &Quote{Type: Market, Side: Bid, Quantity: ToBigInt("3"), MaxSlippageBps: 1000, TradeID: "6"}
+	trades, _, _ = orderBook.ProcessOrder(slippage, false)
+	if len(trades) != 1 || slippage.Unspent.Cmp(ToBigInt("2")) != 0 || orderBook.BestAsk().Cmp(ToBigInt("130")) != 0 {
+		t.Errorf("slippage protection incorrect, got trades: %s, quote: %s", ToJSON(trades), ToJSON(slippage))
+	}
+
+	// protection price below the best ask does not trade at all
+	protection := &Quote{Type: Market, Side: Bid, Quantity: ToBigInt("1"), ProtectionPrice: ToBigInt("120"), TradeID: "7"}
+	trades, _, _ = orderBook.ProcessOrder(protection, false)
+	if len(trades) != 0 || protection.Unspent.Cmp(ToBigInt("1")) != 0 || protection.AveragePrice != nil {
+		t.Errorf("protection price incorrect, got trades: %s", ToJSON(trades))
+	}
+}
+
+func TestFeeSchedule(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("FEE/WETH")
+	defer cleanup()
+
+	invalid := &FeeSchedule{Tiers: []FeeTier{{MinVolume: ToBigInt("100"), MakerBps: 1, TakerBps: 2}}}
+	if invalid.Validate() != ErrInvalidFeeSchedule {
+		t.Errorf("fee schedule without base tier should be rejected")
+	}
+
+	// 0.1% maker, 0.2% taker, maker gets a 0.05% rebate from 10000 traded
+	orderBook.FeeSchedule = &FeeSchedule{Tiers: []FeeTier{
+		{MinVolume: Zero(), MakerBps: 10, TakerBps: 20},
+		{MinVolume: ToBigInt("10000"), MakerBps: -5, TakerBps: 15},
+	}}
+
+	orderBook.ProcessOrder(newTestQuote(Ask, "1000", "20", "maker"), false)
+	trades, _, _ := orderBook.ProcessOrder(newTestQuote(Bid, "1000", "10", "taker"), false)
+	if len(trades) != 1 || trades[0].MakerFee.Cmp(ToBigInt("10")) != 0 || trades[0].TakerFee.Cmp(ToBigInt("20")) != 0 {
+		t.Fatalf("fees of the first fill incorrect, got: %s", ToJSON(trades))
+	}
+
+	// both accounts reached the second tier
+	trades, _, _ = orderBook.ProcessOrder(newTestQuote(Bid, "1000", "10", "taker"), false)
+	if len(trades) != 1 || trades[0].MakerFee.Cmp(ToBigInt("-5")) != 0 || trades[0].TakerFee.Cmp(ToBigInt("15")) != 0 {
+		t.Fatalf("fees of the second fill incorrect, got: %s", ToJSON(trades))
+	}
+
+	maker := orderBook.GetAccountFees("maker")
+	taker := orderBook.GetAccountFees("taker")
+	if maker.Volume.Cmp(ToBigInt("20000")) != 0 || maker.FeesPaid.Cmp(ToBigInt("10")) != 0 || maker.RebatesReceived.Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("maker fee totals incorrect, got: %s", ToJSON(maker))
+	}
+	if taker.FeesPaid.Cmp(ToBigInt("35")) != 0 || taker.RebatesReceived.Sign() != 0 {
+		t.Errorf("taker fee totals incorrect, got: %s", ToJSON(taker))
+	}
+
+	// totals are persisted
+	orderBook.Commit()
+	restored := NewOrderbook("FEE/WETH", orderBook.db)
+	if restored.GetAccountFees("taker").FeesPaid.Cmp(ToBigInt("35")) != 0 {
+		t.Errorf("fee totals should be persisted, got: %s", ToJSON(restored.GetAccountFees("taker")))
+	}
+}
+
+func TestAuction(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("auction")
+	defer cleanup()
+
+	if err := orderBook.SetPhase(PhaseAuction); err != nil {
+		t.Fatalf("auction should start, got: %v", err)
+	}
+	market := &Quote{Type: Market, Side: Bid, Quantity: ToBigInt("1"), TradeID: "1"}
+	if _, _, err := orderBook.ProcessOrder(market, false); err != ErrNotAllowedInAuction {
+		t.Errorf("market order should be rejected during the auction, got: %v", err)
+	}
+
+	// crossed orders collect without matching
+	for _, quote := range []*Quote{
+		newTestQuote(Bid, "100", "10", "1"),
+		newTestQuote(Bid, "99", "20", "2"),
+		newTestQuote(Ask, "98", "15", "3"),
+		newTestQuote(Ask, "101", "10", "4"),
+	} {
+		trades, _, err := orderBook.ProcessOrder(quote, false)
+		if err != nil || len(trades) != 0 {
+			t.Fatalf("order should rest without matching, got: %d trades, %v", len(trades), err)
+		}
+	}
+
+	// 98 and 99 both execute 15 with the same imbalance, the reference price breaks the tie
+	if price, volume := orderBook.EquilibriumPrice(ToBigInt("100")); price.Cmp(ToBigInt("99")) != 0 || volume.Cmp(ToBigInt("15")) != 0 {
+		t.Errorf("equilibrium should be 15 at 99, got: %v at %v", volume, price)
+	}
+	for _, phase := range []string{PhaseContinuous, PhaseClosed} {
+		if err := orderBook.SetPhase(phase); err != ErrAuctionInProgress {
+			t.Errorf("auction should only end by uncrossing, got: %v", err)
+		}
+	}
+
+	trades, err := orderBook.EndAuction(nil, false)
+	if err != nil {
+		t.Fatalf("auction should end, got: %v", err)
+	}
+	if len(trades) != 2 || trades[0].Quantity.Cmp(ToBigInt("10")) != 0 || trades[1].Quantity.Cmp(ToBigInt("5")) != 0 {
+		t.Fatalf("book should be uncrossed in price then time priority, got: %s", ToJSON(trades))
+	}
+	for _, trade := range trades {
+		if trade.Price.Cmp(ToBigInt("98")) != 0 {
+			t.Errorf("every fill should be at the equilibrium price, got: %v", trade.Price)
+		}
+	}
+	if orderBook.Phase() != PhaseContinuous || orderBook.BestBid().Cmp(ToBigInt("99")) != 0 || orderBook.BestAsk().Cmp(ToBigInt("101")) != 0 {
+		t.Errorf("book should be uncrossed and continuous, got: %s %v/%v", orderBook.Phase(), orderBook.BestBid(), orderBook.BestAsk())
+	}
+
+	orderBook.SetPhase(PhaseClosed)
+	if _, _, err = orderBook.ProcessOrder(newTestQuote(Bid, "99", "1", "1"), false); err != ErrMarketClosed {
+		t.Errorf("closed pair should reject orders, got: %v", err)
+	}
+	encoded, _ := EncodeBytesOrderbookItem(orderBook.Item)
+	item := &OrderbookItem{}
+	DecodeBytesOrderbookItem(encoded, item)
+	if item.Phase != PhaseClosed || item.Name != orderBook.Item.Name {
+		t.Errorf("phase should be stored, got: %s %s", item.Phase, item.Name)
+	}
+}
+
+func TestAuctionSelfTrade(t *testing.T) {
+	tests := []struct {
+		mode   string
+		trades int
+		bid    string // remaining quantity of the bid of the owner, empty when it left the book
+	}{
+		{STPNone, 2, "1"},
+		{STPCancelNewest, 1, "5"},
+		{STPCancelOldest, 2, ""},
+		{STPCancelBoth, 1, ""},
+		{STPDecrementAndCancel, 1, "1"},
+	}
+	for _, test := range tests {
+		orderBook, cleanup := newTestOrderbook("auction-stp")
+		orderBook.SelfTradeMode = test.mode
+		orderBook.SetPhase(PhaseAuction)
+		own := newTestQuote(Bid, "100", "10", "1")
+		orderBook.ProcessOrder(own, false)
+		orderBook.ProcessOrder(newTestQuote(Ask, "99", "4", "1"), false)
+		orderBook.ProcessOrder(newTestQuote(Ask, "99", "5", "2"), false)
+		if test.mode == STPCancelOldest || test.mode == STPCancelBoth {
+			// the asks are met by a bid of another owner instead
+			orderBook.ProcessOrder(newTestQuote(Bid, "99", "5", "3"), false)
+		}
+
+		trades, err := orderBook.EndAuction(nil, false)
+		if err != nil || len(trades) != test.trades {
+			t.Errorf("%s: auction should end with %d trades, got: %s, %v", test.mode, test.trades, ToJSON(trades), err)
+		}
+		for _, trade := range trades {
+			if test.mode != STPNone && trade.MakerTradeID == trade.TakerTradeID {
+				t.Errorf("%s: orders of the same owner should not trade, got: %s", test.mode, ToJSON(trade))
+			}
+		}
+		order, _ := orderBook.GetOrderByID(own.OrderID)
+		if order != nil {
+			if remaining := order.RemainingQuantity().String(); remaining != test.bid {
+				t.Errorf("%s: bid of the owner should have %q left, got: %s", test.mode, test.bid, remaining)
+			}
+		} else if test.bid != "" {
+			t.Errorf("%s: bid of the owner should rest with %s, got none", test.mode, test.bid)
+		}
+		cleanup()
+	}
+}
+
+func TestClosedCrossedBook(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("closed")
+	defer cleanup()
+
+	orderBook.SetPhase(PhaseAuction)
+	orderBook.ProcessOrder(newTestQuote(Bid, "100", "10", "1"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "99", "10", "2"), false)
+	// a book stored closed while crossed
+	orderBook.Item.Phase = PhaseClosed
+
+	if err := orderBook.SetPhase(PhaseContinuous); err != ErrBookCrossed {
+		t.Fatalf("crossed book should not reopen without an auction, got: %v", err)
+	}
+	if err := orderBook.SetPhase(PhaseAuction); err != nil {
+		t.Fatalf("crossed book should reopen through an auction, got: %v", err)
+	}
+	if trades, err := orderBook.EndAuction(nil, false); err != nil || len(trades) != 1 || orderBook.isCrossed() {
+		t.Fatalf("auction should uncross the book, got: %s, %v", ToJSON(trades), err)
+	}
+
+	// a book that is not crossed reopens from closed
+	orderBook.SetPhase(PhaseClosed)
+	if err := orderBook.SetPhase(PhaseContinuous); err != nil {
+		t.Errorf("uncrossed book should reopen, got: %v", err)
+	}
+}
+
+func TestExpiryIndexRestore(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("expiry")
+	defer cleanup()
+
+	quote := newTestQuote(Ask, "100", "5", "1")
+	quote.TimeInForce = GTD
+	quote.ExpireTime = orderBook.Item.Timestamp + 60
+	if _, _, err := orderBook.ProcessOrder(quote, false); err != nil {
+		t.Fatalf("GTD should rest in the book, got: %v", err)
+	}
+
+	// the index is found again by an orderbook restored from the same database
+	restored := NewOrderbook("expiry", orderBook.db)
+	restored.Restore()
+	expired := restored.popExpiredOrders(quote.ExpireTime)
+	if len(expired) != 1 || expired[0].OrderID != quote.OrderID || expired[0].Price.Cmp(quote.Price) != 0 {
+		t.Fatalf("restored index should return the expired order, got: %s", ToJSON(expired))
+	}
+	expired0 := expired[0]
+	if expired = restored.popExpiredOrders(quote.ExpireTime); len(expired) != 0 {
+		t.Errorf("order should only expire once, got: %s", ToJSON(expired))
+	}
+
+	// an order that could not be cancelled is indexed again with its expire time
+	restored.addExpiry(expired0)
+	if expired = restored.popExpiredOrders(quote.ExpireTime); len(expired) != 1 || expired[0].OrderID != quote.OrderID {
+		t.Errorf("order indexed again should expire again, got: %s", ToJSON(expired))
+	}
+}
+
+func TestOrderIndex(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("index")
+	defer cleanup()
+
+	_, resting, _ := orderBook.ProcessOrder(newTestQuote(Bid, "100", "5", "1"), false)
+	stop := &Quote{Type: StopMarket, Side: Bid, StopPrice: ToBigInt("120"), Quantity: ToBigInt("5"), TradeID: "2"}
+	orderBook.ProcessOrder(stop, false)
+
+	order, location := orderBook.GetOrderByID(resting.OrderID)
+	if order == nil || location.Side != Bid || location.Price.Cmp(ToBigInt("100")) != 0 || location.Stop {
+		t.Fatalf("resting order should be found by id, got: %s", ToJSON(location))
+	}
+	if _, location = orderBook.GetOrderByID(stop.OrderID); location == nil || !location.Stop || location.Price.Cmp(ToBigInt("120")) != 0 {
+		t.Fatalf("stop order should be found by id at its stop price, got: %s", ToJSON(location))
+	}
+
+	// amend keeps the side and price that are not sent
+	amend := &Quote{OrderID: resting.OrderID, Quantity: ToBigInt("3")}
+	if _, _, err := orderBook.UpdateOrder(amend); err != nil {
+		t.Fatalf("amend by id should succeed, got: %v", err)
+	}
+	if order, _ = orderBook.GetOrderByID(resting.OrderID); order.Item.Quantity.Cmp(ToBigInt("3")) != 0 || orderBook.BestBid().Cmp(ToBigInt("100")) != 0 {
+		t.Errorf("amend should only change the quantity, got: %s", order)
+	}
+
+	for _, orderID := range []uint64{resting.OrderID, stop.OrderID} {
+		if err := orderBook.CancelOrder(orderID); err != nil {
+			t.Errorf("cancel by id should succeed, got: %v", err)
+		}
+		if err := orderBook.CancelOrder(orderID); err != ErrOrderNotFound {
+			t.Errorf("order should only be cancelled once, got: %v", err)
+		}
+	}
+	if orderBook.Bids.NotEmpty() || orderBook.StopBids.NotEmpty() {
+		t.Errorf("cancelled orders should leave the book")
+	}
+
+	// filled order leaves the index
+	_, maker, _ := orderBook.ProcessOrder(newTestQuote(Ask, "100", "5", "3"), false)
+	orderBook.ProcessOrder(newTestQuote(Bid, "100", "5", "4"), false)
+	if order, _ = orderBook.GetOrderByID(maker.OrderID); order != nil {
+		t.Errorf("filled order should not be found, got: %s", order)
+	}
+}
+
+func TestAmendOrder(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("amend")
+	defer cleanup()
+
+	var ids []uint64
+	for _, tradeID := range []string{"1", "2", "3"} {
+		_, orderInBook, _ := orderBook.ProcessOrder(newTestQuote(Bid, "100", "5", tradeID), false)
+		ids = append(ids, orderInBook.OrderID)
+	}
+	stop := &Quote{Type: StopMarket, Side: Bid, StopPrice: ToBigInt("120"), Quantity: ToBigInt("5"), TradeID: "4"}
+	orderBook.ProcessOrder(stop, false)
+
+	tests := []struct {
+		quote *Quote
+		err   error
+	}{
+		{&Quote{OrderID: 1000, Quantity: ToBigInt("1")}, ErrOrderNotFound},
+		{&Quote{OrderID: ids[0], Quantity: ToBigInt("0")}, ErrInvalidQuantity},
+		{&Quote{OrderID: ids[0], Price: ToBigInt("-1")}, ErrInvalidPrice},
+		{&Quote{OrderID: stop.OrderID, Quantity: ToBigInt("1")}, ErrAmendStopOrder},
+	}
+	for i, test := range tests {
+		if _, _, err := orderBook.UpdateOrder(test.quote); err != test.err {
+			t.Errorf("case %d: got error %v, want %v", i, err, test.err)
+		}
+	}
+	if err := orderBook.Bids.UpdateOrder(&Quote{OrderID: 1000, Price: ToBigInt("100"), Quantity: ToBigInt("1")}); err != ErrOrderNotFound {
+		t.Errorf("tree update of a missing order should fail, got: %v", err)
+	}
+
+	// decrease keeps the priority, increase goes to the tail
+	orderBook.UpdateOrder(&Quote{OrderID: ids[0], Quantity: ToBigInt("3")})
+	orderBook.UpdateOrder(&Quote{OrderID: ids[1], Quantity: ToBigInt("8")})
+	orderList := orderBook.Bids.PriceList(ToBigInt("100"))
+	queue := orderList.Orders()
+	for i, id := range []uint64{ids[0], ids[2], ids[1]} {
+		if len(queue) != 3 || !bytes.Equal(queue[i].Key, GetKeyFromUint64(id)) {
+			t.Fatalf("order %d should be at position %d of the queue", id, i)
+		}
+	}
+	if orderList.Item.Volume.Cmp(ToBigInt("16")) != 0 || orderBook.Bids.Item.Volume.Cmp(ToBigInt("16")) != 0 {
+		t.Errorf("volume should follow the amends, got: %v / %v", orderList.Item.Volume, orderBook.Bids.Item.Volume)
+	}
+
+	// price change moves the order out of its old level
+	orderBook.UpdateOrder(&Quote{OrderID: ids[2], Price: ToBigInt("105")})
+	if orderBook.BestBid().Cmp(ToBigInt("105")) != 0 || orderBook.Bids.PriceList(ToBigInt("100")).Item.Length != 2 {
+		t.Errorf("order should move to the new price level")
+	}
+
+	// and can match like a new limit order
+	_, ask, _ := orderBook.ProcessOrder(newTestQuote(Ask, "110", "4", "5"), false)
+	trades, orderInBook, err := orderBook.UpdateOrder(&Quote{OrderID: ids[0], Price: ToBigInt("110")})
+	if err != nil || len(trades) != 1 || trades[0].Quantity.Cmp(ToBigInt("3")) != 0 || trades[0].MakerOrderID != ask.OrderID {
+		t.Fatalf("amended order should match, got: %s, %v", ToJSON(trades), err)
+	}
+	if orderInBook != nil {
+		t.Errorf("filled amended order should not rest, got: %s", ToJSON(orderInBook))
+	}
+	if order, _ := orderBook.GetOrderByID(ids[0]); order != nil {
+		t.Errorf("filled amended order should leave the book")
+	}
+}
+
+func TestOrderHistory(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("history")
+	defer cleanup()
+
+	checkRecord := func(orderID uint64, status, filled, averagePrice string) {
+		t.Helper()
+		record := orderBook.GetOrderRecord(orderID)
+		if record == nil {
+			t.Fatalf("order %d should have a record", orderID)
+		}
+		if record.Status != status || record.FilledQuantity.Cmp(ToBigInt(filled)) != 0 || record.AveragePrice.Cmp(ToBigInt(averagePrice)) != 0 {
+			t.Errorf("order %d should be %s with %s filled at %s, got: %s", orderID, status, filled, averagePrice, ToJSON(record))
+		}
+	}
+
+	resting := newTestQuote(Bid, "100", "5", "1")
+	orderBook.ProcessOrder(resting, false)
+	checkRecord(resting.OrderID, OrderStatusNew, "0", "0")
+
+	taker := newTestQuote(Ask, "100", "2", "2")
+	orderBook.ProcessOrder(taker, false)
+	checkRecord(taker.OrderID, OrderStatusFilled, "2", "100")
+	checkRecord(resting.OrderID, OrderStatusPartiallyFilled, "2", "100")
+
+	orderBook.ProcessOrder(newTestQuote(Ask, "99", "3", "3"), false)
+	checkRecord(resting.OrderID, OrderStatusFilled, "5", "100")
+	if order, _ := orderBook.GetOrderByID(resting.OrderID); order != nil {
+		t.Errorf("filled order should leave the book")
+	}
+
+	// cancelled and expired orders keep what they filled
+	cancelled := newTestQuote(Bid, "90", "5", "1")
+	orderBook.ProcessOrder(cancelled, false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "90", "1", "2"), false)
+	orderBook.CancelOrder(cancelled.OrderID)
+	checkRecord(cancelled.OrderID, OrderStatusCancelled, "1", "90")
+
+	expired := newTestQuote(Bid, "80", "5", "1")
+	expired.TimeInForce = GTD
+	expired.ExpireTime = orderBook.Item.Timestamp + 100
+	orderBook.ProcessOrder(expired, false)
+	orderBook.ExpireOrder(expired.OrderID)
+	checkRecord(expired.OrderID, OrderStatusExpired, "0", "0")
+
+	// the rest of an order that can not rest is cancelled
+	orderBook.ProcessOrder(newTestQuote(Ask, "120", "1", "2"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "130", "1", "2"), false)
+	market := &Quote{Type: Market, Side: Bid, Quantity: ToBigInt("3"), TradeID: "1"}
+	orderBook.ProcessOrder(market, false)
+	checkRecord(market.OrderID, OrderStatusCancelled, "2", "125")
+
+	rejected := newTestQuote(Ask, "50", "100", "2")
+	rejected.TimeInForce = FOK
+	if _, _, err := orderBook.ProcessOrder(rejected, false); err != ErrFillOrKillNotFilled {
+		t.Fatalf("FOK order should be rejected, got: %v", err)
+	}
+	checkRecord(rejected.OrderID, OrderStatusRejected, "0", "0")
+	if record := orderBook.GetOrderRecord(rejected.OrderID); record.Reason != ErrFillOrKillNotFilled.Error() {
+		t.Errorf("rejected order should keep the reason, got: %s", record.Reason)
+	}
+
+	// amended quantity counts what was already filled
+	amended := newTestQuote(Ask, "150", "5", "2")
+	orderBook.ProcessOrder(amended, false)
+	orderBook.ProcessOrder(newTestQuote(Bid, "150", "2", "1"), false)
+	orderBook.UpdateOrder(&Quote{OrderID: amended.OrderID, Quantity: ToBigInt("1")})
+	if record := orderBook.GetOrderRecord(amended.OrderID); record.Quantity.Cmp(ToBigInt("3")) != 0 {
+		t.Errorf("amended quantity should be 3, got: %v", record.Quantity)
+	}
+	orderBook.ProcessOrder(newTestQuote(Bid, "150", "1", "1"), false)
+	checkRecord(amended.OrderID, OrderStatusFilled, "3", "150")
+
+	if orderBook.GetOrderRecord(1000) != nil {
+		t.Errorf("unknown order should not have a record")
+	}
+}
+
+func TestOpenOrders(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("open")
+	defer cleanup()
+
+	var ids []uint64
+	for _, price := range []string{"90", "91", "92"} {
+		quote := newTestQuote(Bid, price, "5", "1")
+		orderBook.ProcessOrder(quote, false)
+		ids = append(ids, quote.OrderID)
+	}
+	stop := &Quote{Type: StopMarket, Side: Bid, StopPrice: ToBigInt("95"), Quantity: ToBigInt("1"), TradeID: "1"}
+	orderBook.ProcessOrder(stop, false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "100", "5", "2"), false)
+
+	openOrders := func(fromOrderID uint64, limit int) ([]uint64, uint64) {
+		page := orderBook.GetOpenOrders("1", fromOrderID, limit)
+		var orderIDs []uint64
+		for _, record := range page.Orders {
+			orderIDs = append(orderIDs, record.OrderID)
+		}
+		return orderIDs, page.Next
+	}
+	check := func(got []uint64, want ...uint64) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("open orders should be %v, got: %v", want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("open orders should be %v, got: %v", want, got)
+			}
+		}
+	}
+
+	orderIDs, next := openOrders(0, 2)
+	check(orderIDs, ids[0], ids[1])
+	if next != ids[2] {
+		t.Errorf("next page should start at %d, got: %d", ids[2], next)
+	}
+	orderIDs, next = openOrders(next, 2)
+	check(orderIDs, ids[2], stop.OrderID)
+	if next != 0 {
+		t.Errorf("last page should have no next, got: %d", next)
+	}
+
+	// filled, cancelled and triggered orders are no longer open, amended orders still are
+	orderBook.ProcessOrder(newTestQuote(Ask, "92", "5", "2"), false)
+	orderBook.CancelOrder(ids[0])
+	orderBook.UpdateOrder(&Quote{OrderID: ids[1], Price: ToBigInt("89")})
+	orderIDs, _ = openOrders(0, 0)
+	check(orderIDs, ids[1], stop.OrderID)
+
+	orderBook.ProcessOrder(newTestQuote(Bid, "100", "1", "3"), false)
+	orderIDs, _ = openOrders(0, 0)
+	check(orderIDs, ids[1])
+
+	if page := orderBook.GetOpenOrders("4", 0, 0); len(page.Orders) != 0 {
+		t.Errorf("account without orders should have no open orders")
+	}
+	// every owner has its own keyspace
+	if page := orderBook.GetOpenOrders("2", 0, 0); len(page.Orders) != 1 || page.Orders[0].Price.String() != "100" {
+		t.Errorf("other account should only see its own open order, got: %s", ToJSON(page.Orders))
+	}
+}
+
+func TestOpenOrdersPaging(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("paging")
+	defer cleanup()
+
+	// the owner has a few orders among many more orders of other accounts
+	var ids []uint64
+	for i := 0; i < 300; i++ {
+		orderBook.ProcessOrder(newTestQuote(Bid, strconv.Itoa(100+i%50), "1", strconv.Itoa(2+i%3)), false)
+		if i%60 == 0 {
+			quote := newTestQuote(Ask, strconv.Itoa(1000+i), "1", "1")
+			orderBook.ProcessOrder(quote, false)
+			ids = append(ids, quote.OrderID)
+		}
+	}
+
+	var got []uint64
+	pages := 0
+	for next := uint64(0); ; pages++ {
+		page := orderBook.GetOpenOrders("1", next, 2)
+		for _, record := range page.Orders {
+			got = append(got, record.OrderID)
+		}
+		if next = page.Next; next == 0 {
+			break
+		}
+	}
+	if pages != 2 || ToJSON(got) != ToJSON(ids) {
+		t.Errorf("owner orders should be %v in 3 pages, got: %v in %d", ids, got, pages+1)
+	}
+	if page := orderBook.GetOpenOrders("1", ids[len(ids)-1]+1, 2); len(page.Orders) != 0 || page.Next != 0 {
+		t.Errorf("no owner orders should follow the last one, got: %s", ToJSON(page))
+	}
+	if page := orderBook.GetOpenOrders("5", 0, 0); len(page.Orders) != 0 {
+		t.Errorf("account without orders should have no open orders, got: %s", ToJSON(page))
+	}
+}
+
+func TestDepth(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("depth")
+	defer cleanup()
+
+	for _, quote := range []*Quote{
+		newTestQuote(Bid, "100", "5", "1"),
+		newTestQuote(Bid, "100", "3", "2"),
+		newTestQuote(Bid, "99", "2", "1"),
+		newTestQuote(Bid, "95", "1", "1"),
+		newTestQuote(Ask, "101", "4", "3"),
+		newTestQuote(Ask, "102", "1", "3"),
+		newTestQuote(Ask, "103", "2", "3"),
+		newTestQuote(Ask, "110", "1", "3"),
+	} {
+		orderBook.ProcessOrder(quote, false)
+	}
+	// stop orders are not part of the depth
+	orderBook.ProcessOrder(&Quote{Type: StopLimit, Side: Bid, StopPrice: ToBigInt("105"), Price: ToBigInt("106"), Quantity: ToBigInt("1")}, false)
+
+	check := func(side string, got []*DepthLevel, want ...string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s depth should have %d levels, got: %s", side, len(want), ToJSON(got))
+		}
+		for i, level := range got {
+			if value := level.Price.String() + ":" + level.Volume.String() + ":" + strconv.FormatUint(level.Count, 10); value != want[i] {
+				t.Errorf("%s level %d should be %s, got: %s", side, i, want[i], value)
+			}
+		}
+	}
+
+	depth := orderBook.Depth(0, nil)
+	if depth.Sequence == 0 || depth.Sequence != orderBook.Item.Sequence {
+		t.Errorf("depth should carry the sequence of the last delta %d, got: %d", orderBook.Item.Sequence, depth.Sequence)
+	}
+	check(Bid, depth.Bids, "100:8:2", "99:2:1", "95:1:1")
+	check(Ask, depth.Asks, "101:4:1", "102:1:1", "103:2:1", "110:1:1")
+
+	depth = orderBook.Depth(2, ToBigInt("5"))
+	check(Bid, depth.Bids, "100:8:2", "95:3:2")
+	check(Ask, depth.Asks, "105:7:3", "110:1:1")
+
+	depth = orderBook.Depth(1, nil)
+	check(Bid, depth.Bids, "100:8:2")
+	check(Ask, depth.Asks, "101:4:1")
+}
+
+func TestSnapshot(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("SNAP/WETH")
+	defer cleanup()
+
+	iceberg := newTestQuote(Ask, "101", "10", "4")
+	iceberg.DisplayQuantity = ToBigInt("3")
+	gtd := newTestQuote(Ask, "105", "2", "1")
+	gtd.TimeInForce = GTD
+	gtd.ExpireTime = orderBook.Item.Timestamp + 60
+	for _, quote := range []*Quote{
+		newTestQuote(Bid, "100", "5", "1"),
+		newTestQuote(Bid, "100", "3", "2"),
+		newTestQuote(Bid, "99", "2", "3"),
+		iceberg,
+		newTestQuote(Ask, "101", "2", "5"),
+		gtd,
+		{Type: StopLimit, Side: Bid, StopPrice: ToBigInt("110"), Price: ToBigInt("111"), Quantity: ToBigInt("1"), TradeID: "6"},
+		{Type: StopMarket, Side: Ask, StopPrice: ToBigInt("90"), Quantity: ToBigInt("1"), TradeID: "7"},
+		// the iceberg is replenished behind the second order of its level
+		newTestQuote(Bid, "101", "4", "9"),
+	} {
+		if _, _, err := orderBook.ProcessOrder(quote, false); err != nil {
+			t.Fatalf("order should be accepted, got: %v", err)
+		}
+	}
+
+	file, _ := ioutil.TempFile("", "snapshot")
+	file.Close()
+	defer os.Remove(file.Name())
+	if err := orderBook.ExportSnapshot(file.Name()); err != nil {
+		t.Fatalf("snapshot should be exported, got: %v", err)
+	}
+	snapshot, err := ReadSnapshot(file.Name())
+	if err != nil {
+		t.Fatalf("snapshot should be read, got: %v", err)
+	}
+	if len(snapshot.Asks) != 3 || snapshot.Asks[0].TradeID != "5" || snapshot.Asks[1].Reserve.String() != "4" {
+		t.Errorf("asks should be in queue order with the reserve of the iceberg, got: %s", ToJSON(snapshot.Asks))
+	}
+
+	restored, cleanupRestored := newTestOrderbook("SNAP/WETH")
+	defer cleanupRestored()
+	if err = restored.LoadSnapshot(snapshot); err != nil {
+		t.Fatalf("snapshot should be loaded, got: %v", err)
+	}
+	if got, want := ToJSON(restored.Snapshot()), ToJSON(orderBook.Snapshot()); got != want {
+		t.Errorf("restored book should be the same, want: %s, got: %s", want, got)
+	}
+	if page := restored.GetOpenOrders("4", 0, 0); len(page.Orders) != 1 || page.Orders[0].Quantity.String() != "7" {
+		t.Errorf("iceberg should be open with its reserve, got: %s", ToJSON(page))
+	}
+	if expired := restored.popExpiredOrders(gtd.ExpireTime); len(expired) != 1 || expired[0].OrderID != gtd.OrderID {
+		t.Errorf("good till date order should be indexed for expiry, got: %s", ToJSON(expired))
+	}
+
+	// both books fill the same orders
+	want, _, _ := orderBook.ProcessOrder(newTestQuote(Bid, "101", "6", "8"), false)
+	got, _, _ := restored.ProcessOrder(newTestQuote(Bid, "101", "6", "8"), false)
+	if len(got) != 3 || len(want) != 3 {
+		t.Fatalf("taker should fill three orders, want: %s, got: %s", ToJSON(want), ToJSON(got))
+	}
+	for i := range got {
+		// the trades are printed at the time of each book
+		got[i].Timestamp, want[i].Timestamp = 0, 0
+		if ToJSON(got[i]) != ToJSON(want[i]) {
+			t.Errorf("restored book should fill like the original, want: %s, got: %s", ToJSON(want[i]), ToJSON(got[i]))
+		}
+	}
+
+	if err = restored.LoadSnapshot(snapshot); err != ErrBookNotEmpty {
+		t.Errorf("snapshot should only be loaded into a fresh book, got: %v", err)
+	}
+	other, cleanupOther := newTestOrderbook("OTHER/WETH")
+	defer cleanupOther()
+	if err = other.LoadSnapshot(snapshot); err != ErrSnapshotPairName {
+		t.Errorf("snapshot of another pair should be refused, got: %v", err)
+	}
+	snapshot.Version = SnapshotVersion + 1
+	if err = other.LoadSnapshot(snapshot); err != ErrSnapshotVersion {
+		t.Errorf("unknown snapshot version should be refused, got: %v", err)
+	}
+	snapshot.Version = SnapshotVersion
+
+	// an invalid snapshot is refused before the book is changed, a valid one can be loaded afterwards
+	fresh, cleanupFresh := newTestOrderbook("SNAP/WETH")
+	defer cleanupFresh()
+	snapshot.Phase = "halted"
+	if err = fresh.LoadSnapshot(snapshot); err != ErrSnapshotInvalid {
+		t.Errorf("unknown phase should be refused, got: %v", err)
+	}
+	snapshot.Phase = PhaseContinuous
+	peakSize := snapshot.Asks[1].PeakSize
+	snapshot.Asks[1].PeakSize = ToBigInt("100")
+	if err = fresh.LoadSnapshot(snapshot); err != ErrSnapshotInvalid {
+		t.Errorf("peak above the rest of the iceberg should be refused, got: %v", err)
+	}
+	snapshot.Asks[1].PeakSize = ToBigInt("2")
+	if err = fresh.LoadSnapshot(snapshot); err != ErrSnapshotInvalid {
+		t.Errorf("iceberg showing more than its peak should be refused, got: %v", err)
+	}
+	snapshot.Asks[1].PeakSize = peakSize
+	askPrice := snapshot.Asks[0].Price
+	snapshot.Asks[0].Price = ToBigInt("100")
+	if err = fresh.LoadSnapshot(snapshot); err != ErrSnapshotInvalid {
+		t.Errorf("crossed continuous book should be refused, got: %v", err)
+	}
+	snapshot.Asks[0].Price = askPrice
+	if fresh.Item.NextOrderID != 0 || fresh.Bids.NotEmpty() || fresh.Asks.NotEmpty() {
+		t.Fatalf("refused snapshot should leave the book untouched")
+	}
+	if err = fresh.LoadSnapshot(snapshot); err != nil {
+		t.Errorf("snapshot should be loaded after a refused one, got: %v", err)
+	}
+}
+
+func TestBookDelta(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("delta")
+	defer cleanup()
+
+	iceberg := newTestQuote(Ask, "101", "6", "3")
+	iceberg.DisplayQuantity = ToBigInt("2")
+	for _, quote := range []*Quote{
+		newTestQuote(Bid, "100", "5", "1"),
+		newTestQuote(Bid, "100", "3", "2"),
+		iceberg,
+		newTestQuote(Ask, "101", "2", "4"),
+		newTestQuote(Ask, "102", "1", "4"),
+	} {
+		orderBook.ProcessOrder(quote, false)
+	}
+
+	// the book of a consumer, price levels by side with their queue of order id and displayed quantity
+	book := map[string]map[string][][2]uint64{Bid: {}, Ask: {}}
+	snapshot := orderBook.Snapshot()
+	for side, orders := range map[string][]*SnapshotOrder{Bid: snapshot.Bids, Ask: snapshot.Asks} {
+		for _, order := range orders {
+			book[side][order.Price.String()] = append(book[side][order.Price.String()], [2]uint64{order.OrderID, order.Quantity.Uint64()})
+		}
+	}
+
+	sequence := snapshot.Sequence
+	orderBook.OnDelta = func(delta *BookDelta) {
+		if delta.Sequence != sequence+1 {
+			t.Errorf("delta sequence should be %d, got: %d", sequence+1, delta.Sequence)
+		}
+		sequence = delta.Sequence
+		levels, price := book[delta.Side], delta.Price.String()
+		queue, found := levels[price]
+		position := -1
+		for i, entry := range queue {
+			if entry[0] == delta.OrderID {
+				position = i
+			}
+		}
+		switch {
+		case delta.Kind == DeltaLevelCreate && !found:
+			levels[price] = [][2]uint64{}
+		case delta.Kind == DeltaLevelDelete && found && len(queue) == 0:
+			delete(levels, price)
+		case delta.Kind == DeltaAdd && found && position < 0:
+			levels[price] = append(queue, [2]uint64{delta.OrderID, delta.Quantity.Uint64()})
+		case delta.Kind == DeltaUpdate && position >= 0:
+			queue[position][1] = delta.Quantity.Uint64()
+		case delta.Kind == DeltaMove && position >= 0:
+			levels[price] = append(append(queue[:position:position], queue[position+1:]...), queue[position])
+		case delta.Kind == DeltaRemove && position >= 0:
+			levels[price] = append(queue[:position:position], queue[position+1:]...)
+		default:
+			t.Errorf("delta can not be applied: %s", ToJSON(delta))
+		}
+	}
+
+	stop := &Quote{Type: StopLimit, Side: Bid, StopPrice: ToBigInt("101"), Price: ToBigInt("99"), Quantity: ToBigInt("2"), TradeID: "5"}
+	orderBook.ProcessOrder(stop, false)
+	if sequence != snapshot.Sequence {
+		t.Errorf("stop order should not be published before it is triggered")
+	}
+	// fills the peak of the iceberg, which goes to the tail, then part of the second order
+	orderBook.ProcessOrder(newTestQuote(Bid, "101", "3", "6"), false)
+	orderBook.UpdateOrder(&Quote{OrderID: 1, Quantity: ToBigInt("7")})
+	orderBook.UpdateOrder(&Quote{OrderID: 2, Price: ToBigInt("98")})
+	orderBook.CancelOrder(5)
+	orderBook.ProcessOrder(newTestQuote(Ask, "100", "8", "7"), false)
+	if sequence == snapshot.Sequence {
+		t.Fatalf("changes of the book should be published")
+	}
+
+	want := map[string]map[string][][2]uint64{Bid: {}, Ask: {}}
+	snapshot = orderBook.Snapshot()
+	for side, orders := range map[string][]*SnapshotOrder{Bid: snapshot.Bids, Ask: snapshot.Asks} {
+		for _, order := range orders {
+			want[side][order.Price.String()] = append(want[side][order.Price.String()], [2]uint64{order.OrderID, order.Quantity.Uint64()})
+		}
+	}
+	if ToJSON(book) != ToJSON(want) || snapshot.Sequence != sequence {
+		t.Errorf("snapshot and deltas should rebuild the book, want: %s at %d, got: %s at %d", ToJSON(want), snapshot.Sequence, ToJSON(book), sequence)
+	}
+
+	encoded, _ := EncodeBytesOrderbookItem(orderBook.Item)
+	item := &OrderbookItem{}
+	DecodeBytesOrderbookItem(encoded, item)
+	if item.Sequence != sequence || item.Name != orderBook.Item.Name {
+		t.Errorf("sequence should be stored, got: %d", item.Sequence)
+	}
+
+	// the deltas of a cancel are not sent again with the same sequence after a restart
+	quote := newTestQuote(Bid, "90", "1", "8")
+	orderBook.ProcessOrder(quote, false)
+	orderBook.Commit()
+	orderBook.CancelOrder(quote.OrderID)
+	orderBook.Commit()
+	stored := &OrderbookItem{}
+	if encoded, err := orderBook.db.db.Get(orderBook.Key); err != nil || orderBook.db.DecodeBytes(encoded, stored) != nil {
+		t.Fatalf("orderbook item should be stored, got: %v", err)
+	}
+	if stored.Sequence != sequence {
+		t.Errorf("sequence stored after a cancel should be %d, got: %d", sequence, stored.Sequence)
+	}
+}
+
+func TestTradeTape(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("TAPE/WETH")
+	defer cleanup()
+
+	// the maker gets a rebate, which is a negative fee
+	orderBook.FeeSchedule = &FeeSchedule{Tiers: []FeeTier{{MinVolume: Zero(), MakerBps: -5, TakerBps: 10}}}
+	orderBook.ProcessOrder(newTestQuote(Ask, "1000", "30", "1"), false)
+	for i := 0; i < 3; i++ {
+		orderBook.ProcessOrder(newTestQuote(Bid, "1000", "5", "2"), false)
+	}
+
+	page := orderBook.GetTrades(0, 2)
+	if len(page.Trades) != 2 || page.Trades[0].ExecutionID != 1 || page.Trades[1].ExecutionID != 2 || page.Next != 3 {
+		t.Fatalf("first page should have the first two trades, got: %s", ToJSON(page))
+	}
+	if page.Trades[0].MakerFee.Cmp(ToBigInt("-3")) != 0 || page.Trades[0].Quantity.Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("stored trade should keep its fields, got: %s", ToJSON(page.Trades[0]))
+	}
+	if page = orderBook.GetTrades(page.Next, 2); len(page.Trades) != 1 || page.Trades[0].ExecutionID != 3 || page.Next != 0 {
+		t.Errorf("last page should have the last trade, got: %s", ToJSON(page))
+	}
+
+	// trades printed later
+	now := orderBook.Item.Timestamp
+	for i := uint64(1); i <= 3; i++ {
+		orderBook.Item.NextExecutionID++
+		orderBook.appendTrade(&Trade{ExecutionID: orderBook.Item.NextExecutionID, Timestamp: now + 100*i, Price: ToBigInt("1000"), Quantity: ToBigInt("1")})
+	}
+	if page = orderBook.GetTradesByTime(now+150, now+250, 0, 0); len(page.Trades) != 1 || page.Trades[0].ExecutionID != 5 {
+		t.Errorf("only the trade printed in the range should be found, got: %s", ToJSON(page))
+	}
+	page = orderBook.GetTradesByTime(now+100, 0, 0, 1)
+	if len(page.Trades) != 1 || page.Trades[0].ExecutionID != 4 || page.Next != 5 {
+		t.Fatalf("first trade from the start time should be found, got: %s", ToJSON(page))
+	}
+	if page = orderBook.GetTradesByTime(now+100, 0, page.Next, 0); len(page.Trades) != 2 || page.Next != 0 {
+		t.Errorf("next page should go on from the sequence, got: %s", ToJSON(page))
+	}
+	if page = orderBook.GetTradesByTime(now+1000, 0, 0, 0); len(page.Trades) != 0 {
+		t.Errorf("no trade should be found after the last one, got: %s", ToJSON(page))
+	}
+
+	// a book loaded from a snapshot only has the trades printed after it
+	loaded, cleanupLoaded := newTestOrderbook("LOADED/WETH")
+	defer cleanupLoaded()
+	loaded.Item.NextExecutionID = 1000
+	for i := 0; i < 2; i++ {
+		loaded.Item.NextExecutionID++
+		loaded.appendTrade(&Trade{ExecutionID: loaded.Item.NextExecutionID, Timestamp: now})
+	}
+	if page = loaded.GetTrades(0, 0); len(page.Trades) != 2 || page.Trades[0].ExecutionID != 1001 {
+		t.Errorf("tape should start at the first stored trade, got: %s", ToJSON(page))
+	}
+}
+
+func TestDecodeBaselineOrderbookItem(t *testing.T) {
+	// the first layout is the timestamp, the next order id and the name
+	encoded := make([]byte, 16, 25)
+	binary.BigEndian.PutUint64(encoded[0:8], 1000)
+	binary.BigEndian.PutUint64(encoded[8:16], 42)
+	encoded = append(encoded, "tomo/weth"...)
+
+	item := &OrderbookItem{}
+	if err := DecodeBytesOrderbookItem(encoded, item); err != nil {
+		t.Fatalf("baseline item should be decoded, got: %v", err)
+	}
+	if item.Timestamp != 1000 || item.NextOrderID != 42 || item.Name != "tomo/weth" ||
+		item.NextExecutionID != 0 || item.Sequence != 0 || item.Phase != PhaseContinuous {
+		t.Errorf("baseline item decoded wrong, got: %s", ToJSON(item))
+	}
+
+	// the item is stored again with the new fields
+	item.NextExecutionID, item.Sequence, item.Phase = 7, 9, PhaseAuction
+	encoded, _ = EncodeBytesOrderbookItem(item)
+	decoded := &OrderbookItem{}
+	DecodeBytesOrderbookItem(encoded, decoded)
+	if ToJSON(decoded) != ToJSON(item) {
+		t.Errorf("item should survive the encoding, want: %s, got: %s", ToJSON(item), ToJSON(decoded))
+	}
+}
+
+func TestDecodeBaselineOrderItem(t *testing.T) {
+	// the first layout is quantity, price, next, prev, order list, timestamp and the trade id
+	encoded := make([]byte, 5*32+8)
+	copy(encoded[0:32], GetKeyFromBig(ToBigInt("15")))
+	copy(encoded[32:64], GetKeyFromBig(ToBigInt("100")))
+	copy(encoded[64:96], GetKeyFromUint64(2))
+	copy(encoded[96:128], GetKeyFromUint64(1))
+	copy(encoded[128:160], GetKeyFromUint64(3))
+	binary.BigEndian.PutUint64(encoded[160:168], 1000)
+	encoded = append(encoded, "trader"...)
+
+	item := &OrderItem{}
+	if err := DecodeBytesOrderItem(encoded, item); err != nil {
+		t.Fatalf("baseline order should be decoded, got: %v", err)
+	}
+	if item.Quantity.Cmp(ToBigInt("15")) != 0 || item.Price.Cmp(ToBigInt("100")) != 0 || item.Timestamp != 1000 ||
+		item.TradeID != "trader" || item.ExpireTime != 0 || item.PeakSize.Sign() != 0 || item.Reserve.Sign() != 0 {
+		t.Errorf("baseline order decoded wrong, got: %s", ToJSON(item))
+	}
+	if !bytes.Equal(item.NextOrder, GetKeyFromUint64(2)) || !bytes.Equal(item.PrevOrder, GetKeyFromUint64(1)) ||
+		!bytes.Equal(item.OrderList, GetKeyFromUint64(3)) {
+		t.Errorf("baseline order pointers decoded wrong, got: %x %x %x", item.NextOrder, item.PrevOrder, item.OrderList)
+	}
+
+	// the order is stored again with the new fields
+	item.ExpireTime, item.PeakSize, item.Reserve = 2000, ToBigInt("5"), ToBigInt("10")
+	encoded, _ = EncodeBytesOrderItem(item)
+	decoded := &OrderItem{}
+	DecodeBytesOrderItem(encoded, decoded)
+	if ToJSON(decoded) != ToJSON(item) || !bytes.Equal(decoded.OrderList, item.OrderList) {
+		t.Errorf("order should survive the encoding, want: %s, got: %s", ToJSON(item), ToJSON(decoded))
+	}
+}
+
+func TestFillOrKillSelfTrade(t *testing.T) {
+	orderBook, cleanup := newTestOrderbook("FOKSTP/WETH")
+	defer cleanup()
+
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "5", "maker"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "5", "taker"), false)
+	orderBook.ProcessOrder(newTestQuote(Ask, "102", "5", "maker"), false)
+
+	// the own order stops the incoming order, the volume behind it can not fill it
+	fok := newTestQuote(Bid, "102", "10", "taker")
+	fok.TimeInForce = FOK
+	fok.SelfTradeMode = STPCancelNewest
+	trades, _, err := orderBook.ProcessOrder(fok, false)
+	if err != ErrFillOrKillNotFilled || len(trades) != 0 {
+		t.Fatalf("FOK meeting its own order should be rejected, got err: %v, trades: %v", err, trades)
+	}
+	if orderBook.VolumeAtPrice(Ask, ToBigInt("101")).Cmp(ToBigInt("10")) != 0 {
+		t.Errorf("FOK rejection must not touch the book, got volume: %v", orderBook.VolumeAtPrice(Ask, ToBigInt("101")))
+	}
+
+	// the orders ahead of the own order can fill it
+	fok = newTestQuote(Bid, "102", "5", "taker")
+	fok.TimeInForce = FOK
+	fok.SelfTradeMode = STPCancelNewest
+	if trades, _, err = orderBook.ProcessOrder(fok, false); err != nil || len(trades) != 1 {
+		t.Fatalf("FOK filled before its own order should be accepted, got err: %v, trades: %v", err, trades)
+	}
+
+	// the own order is cancelled and its volume does not count
+	orderBook.ProcessOrder(newTestQuote(Ask, "101", "5", "maker"), false)
+	fok = newTestQuote(Bid, "102", "15", "taker")
+	fok.TimeInForce = FOK
+	fok.SelfTradeMode = STPCancelOldest
+	if trades, _, err = orderBook.ProcessOrder(fok, false); err != ErrFillOrKillNotFilled {
+		t.Fatalf("FOK should not count its own volume, got err: %v, trades: %v", err, trades)
+	}
+	fok = newTestQuote(Bid, "102", "10", "taker")
+	fok.TimeInForce = FOK
+	fok.SelfTradeMode = STPCancelOldest
+	if trades, _, err = orderBook.ProcessOrder(fok, false); err != nil || len(trades) != 2 {
+		t.Fatalf("FOK should be filled by the other orders, got err: %v, trades: %v", err, trades)
+	}
+}
@@ -0,0 +1,100 @@
+package orderbook
+
+import (
+	"errors"
+	"math/big"
+)
+
+var ErrOrderNotFound = errors.New("order is not resting in the book")
+
+// OrderLocation : where the resting order is, so that it can be found by its id alone
+type OrderLocation struct {
+	Side string `json:"side"`
+	// price level of the order, the stop price for an order in the trigger book
+	Price *big.Int `json:"price"`
+	Stop  bool     `json:"stop"`
+}
+
+func (orderBook *Orderbook) getLocationKey(key []byte) []byte {
+	return GetKeyFromBig(Add(orderBook.locationSlot, new(big.Int).SetBytes(key)))
+}
+
+// getLocation : location of the resting order, nil when it is filled, cancelled or unknown
+func (orderBook *Orderbook) getLocation(key []byte) *OrderLocation {
+	val, err := orderBook.db.Get(orderBook.getLocationKey(key), &OrderLocation{})
+	if err != nil || val == nil {
+		return nil
+	}
+	return val.(*OrderLocation)
+}
+
+func (orderBook *Orderbook) getLocationTree(location *OrderLocation) *OrderTree {
+	if location.Side == Bid {
+		if location.Stop {
+			return orderBook.StopBids
+		}
+		return orderBook.Bids
+	}
+	if location.Stop {
+		return orderBook.StopAsks
+	}
+	return orderBook.Asks
+}
+
+// insertOrder : rest the quote in the order tree and remember where it is and whose it is
+func (orderBook *Orderbook) insertOrder(orderTree *OrderTree, quote *Quote) error {
+	if err := orderTree.InsertOrder(quote); err != nil {
+		return err
+	}
+	if err := orderBook.addOwnerOrder(quote.TradeID, quote.OrderID); err != nil {
+		return err
+	}
+	location := &OrderLocation{
+		Side:  quote.Side,
+		Price: CloneBigInt(quote.Price),
+		Stop:  orderTree == orderBook.StopBids || orderTree == orderBook.StopAsks,
+	}
+	return orderBook.db.Put(orderBook.getLocationKey(GetKeyFromUint64(quote.OrderID)), location)
+}
+
+// removeOrder : remove the order from its order list and forget where it was and whose it was
+func (orderBook *Orderbook) removeOrder(orderTree *OrderTree, orderList *OrderList, order *Order) error {
+	orderBook.db.Delete(orderBook.getLocationKey(order.Key), true)
+	orderBook.removeOwnerOrder(order.Item.TradeID, new(big.Int).SetBytes(order.Key).Uint64())
+	return orderTree.RemoveOrderFromOrderList(order, orderList)
+}
+
+// GetOrderByID : the resting order and where it is, nil when it is not resting
+func (orderBook *Orderbook) GetOrderByID(orderID uint64) (*Order, *OrderLocation) {
+	key := GetKeyFromUint64(orderID)
+	location := orderBook.getLocation(key)
+	if location == nil {
+		return nil, nil
+	}
+	order := orderBook.getLocationTree(location).GetOrder(key, location.Price)
+	if order == nil {
+		return nil, nil
+	}
+	return order, location
+}
+
+// completeAmend : take what the amend quote does not change (side, price and quantity) from the
+// resting order, so that an amend only needs the order id
+func (orderBook *Orderbook) completeAmend(quote *Quote) error {
+	order, location := orderBook.GetOrderByID(quote.OrderID)
+	if order == nil {
+		return ErrOrderNotFound
+	}
+	if location.Stop {
+		return ErrAmendStopOrder
+	}
+	quote.Side = location.Side
+	if quote.Price == nil {
+		quote.Price = CloneBigInt(location.Price)
+	}
+	// the quantity of an amend is what remains, including the hidden reserve of an iceberg
+	if quote.Quantity == nil {
+		quote.Quantity = order.RemainingQuantity()
+	}
+	return nil
+}
@@ -133,6 +133,15 @@ func (orderList *OrderList) Tail() *Order {
 	return orderList.GetOrder(orderList.Item.TailOrder)
 }
 
+// Orders : all orders of the list in time priority
+func (orderList *OrderList) Orders() []*Order {
+	var orders []*Order
+	for order := orderList.Head(); order != nil; order = order.GetNextOrder(orderList) {
+		orders = append(orders, order)
+	}
+	return orders
+}
+
 // String : travel the list to print it in nice format
 func (orderList *OrderList) String(startDepth int) string {
 
@@ -305,6 +314,7 @@ func (orderList *OrderList) AppendOrder(order *Order) error {
 	orderList.Item.Length++
 	orderList.Item.Volume = Add(orderList.Item.Volume, order.Item.Quantity)
 	// fmt.Println("orderlist", orderList.String(0))
+	orderList.orderTree.emitDelta(DeltaAdd, orderList.Item.Price, order)
 	return orderList.Save()
 }
 
@@ -366,12 +376,18 @@ func (orderList *OrderList) RemoveOrder(order *Order) error {
 	}
 
 	// fmt.Println("AFTER DELETE", orderList.String(0))
+	orderList.orderTree.emitDelta(DeltaRemove, orderList.Item.Price, order)
 
 	return orderList.Save()
 }
 
 // MoveToTail : move order to the end of the order list
 func (orderList *OrderList) MoveToTail(order *Order) {
+	// already the last one
+	if bytes.Equal(orderList.Item.TailOrder, order.Key) {
+		return
+	}
+
 	if !orderList.isEmptyKey(order.Item.PrevOrder) { // This Order is not the first Order in the OrderList
 		prevOrder := orderList.GetOrder(order.Item.PrevOrder)
 		if prevOrder != nil {
@@ -394,8 +410,12 @@ func (orderList *OrderList) MoveToTail(order *Order) {
 	if tailOrder != nil {
 		tailOrder.Item.NextOrder = order.Key
 		orderList.SaveOrder(tailOrder)
+		order.Item.PrevOrder = tailOrder.Key
 	}
+	order.Item.NextOrder = EmptyKey()
+	orderList.SaveOrder(order)
 
 	orderList.Item.TailOrder = order.Key
 	orderList.Save()
+	orderList.orderTree.emitDelta(DeltaMove, orderList.Item.Price, order)
 }
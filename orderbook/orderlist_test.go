@@ -2,7 +2,6 @@ package orderbook
 
 import (
 	"math/big"
-	"strconv"
 	"testing"
 )
 
@@ -26,12 +25,7 @@ func TestOrderList(t *testing.T) {
 	orderList := NewOrderList(testPrice, testOrderTree)
 	testOrderTree.orderDB.Debug = true
 
-	dummyOrder := make(map[string]string)
-	dummyOrder["timestamp"] = strconv.FormatUint(testTimestamp, 10)
-	dummyOrder["quantity"] = testQuanity.String()
-	dummyOrder["price"] = testPrice.String()
-	dummyOrder["order_id"] = strconv.Itoa(testOrderID)
-	dummyOrder["trade_id"] = strconv.Itoa(testTradeID)
+	dummyOrder := newTestOrderQuote(testTimestamp, testQuanity, testPrice, testOrderID, testTradeID)
 
 	order := NewOrder(dummyOrder, orderList.Key)
 	orderList.AppendOrder(order)
@@ -48,12 +42,7 @@ func TestOrderList(t *testing.T) {
 		t.Errorf("Orderlist volume incorrect, got: %d, want: %d.", orderList.Item.Volume, order.Item.Quantity)
 	}
 
-	dummyOrder1 := make(map[string]string)
-	dummyOrder1["timestamp"] = strconv.FormatUint(testTimestamp1, 10)
-	dummyOrder1["quantity"] = testQuanity1.String()
-	dummyOrder1["price"] = testPrice1.String()
-	dummyOrder1["order_id"] = strconv.Itoa(testOrderID1)
-	dummyOrder1["trade_id"] = strconv.Itoa(testTradeID1)
+	dummyOrder1 := newTestOrderQuote(testTimestamp1, testQuanity1, testPrice1, testOrderID1, testTradeID1)
 
 	order1 := NewOrder(dummyOrder1, orderList.Key)
 	orderList.AppendOrder(order1)
@@ -3,7 +3,6 @@ package orderbook
 import (
 	"fmt"
 	"math/big"
-	"strconv"
 	"strings"
 	// rbt "github.com/emirpasic/gods/trees/redblacktree"
 )
@@ -236,6 +235,7 @@ func (orderTree *OrderTree) CreatePrice(price *big.Int) *OrderList {
 
 	// should use batch to optimize the performance
 	orderTree.Save()
+	orderTree.emitDelta(DeltaLevelCreate, price, nil)
 
 	// // update cache
 	// orderTree.orderListCache.Add(price.String(), newList)
@@ -276,6 +276,7 @@ func (orderTree *OrderTree) RemovePrice(price *big.Int) {
 
 		// should use batch to optimize the performance
 		orderTree.Save()
+		orderTree.emitDelta(DeltaLevelDelete, price, nil)
 	}
 }
 
@@ -307,8 +308,8 @@ func (orderTree *OrderTree) OrderExist(key []byte, price *big.Int) bool {
 	return orderList.OrderExist(key)
 }
 
-// InsertOrder : insert new order using quote data as map
-func (orderTree *OrderTree) InsertOrder(quote map[string]string) error {
+// InsertOrder : insert new order using quote data
+func (orderTree *OrderTree) InsertOrder(quote *Quote) error {
 
 	// orderID := ToBigInt(quote["order_id"])
 	// key := GetKeyFromBig(orderID)
@@ -319,7 +320,7 @@ func (orderTree *OrderTree) InsertOrder(quote map[string]string) error {
 	// 	return
 	// }
 
-	price := ToBigInt(quote["price"])
+	price := quote.Price
 
 	var orderList *OrderList
 
@@ -360,43 +361,30 @@ func (orderTree *OrderTree) InsertOrder(quote map[string]string) error {
 	return nil
 }
 
-// UpdateOrder : update an order
-func (orderTree *OrderTree) UpdateOrder(quote map[string]string) error {
-	// order := orderTree.OrderMap[quote["order_id"]]
-
-	price := ToBigInt(quote["price"])
-	orderList := orderTree.PriceList(price)
-
-	if orderList == nil {
-		// create a price list for this price
-		orderList = orderTree.CreatePrice(price)
+// UpdateOrder : move the order to the price of the quote or update its displayed quantity,
+// a quantity increase loses the time priority
+func (orderTree *OrderTree) UpdateOrder(quote *Quote) error {
+	key := GetKeyFromUint64(quote.OrderID)
+	order := orderTree.orderBook.GetOrder(key)
+	if order == nil {
+		return ErrOrderNotFound
+	}
+	// the order must be in this tree, at its current price
+	orderList := orderTree.PriceList(order.Item.Price)
+	if orderList == nil || !orderList.OrderExist(key) {
+		return ErrOrderNotFound
 	}
 
-	orderID := ToBigInt(quote["order_id"])
-	key := GetKeyFromBig(orderID)
-	// order := orderTree.GetOrder(key)
-
-	order := orderList.GetOrder(key)
-
-	originalQuantity := CloneBigInt(order.Item.Quantity)
-
-	if !IsEqual(price, order.Item.Price) {
-		// Price changed. Remove order and update tree.
-		// orderList := orderTree.PriceMap[order.Price.String()]
-		orderList.RemoveOrder(order)
-		if orderList.Item.Length == 0 {
-			orderTree.RemovePrice(price)
+	if !IsEqual(quote.Price, order.Item.Price) {
+		// price changed, remove the order from its current price list and insert it at the new price
+		if err := orderTree.RemoveOrderFromOrderList(order, orderList); err != nil {
+			return err
 		}
-		orderTree.InsertOrder(quote)
-		// orderList.Save()
-	} else {
-		quantity := ToBigInt(quote["quantity"])
-		timestamp, _ := strconv.ParseUint(quote["timestamp"], 10, 64)
-		order.UpdateQuantity(orderList, quantity, timestamp)
+		return orderTree.InsertOrder(quote)
 	}
 
-	// fmt.Println("QUANTITY", order.Item.Quantity.String())
-
+	originalQuantity := CloneBigInt(order.Item.Quantity)
+	order.UpdateQuantity(orderList, quote.Quantity, quote.Timestamp)
 	orderTree.Item.Volume = Add(orderTree.Item.Volume, Sub(order.Item.Quantity, originalQuantity))
 
 	// should use batch to optimize the performance
@@ -561,3 +549,35 @@ func (orderTree *OrderTree) MinPriceList() *OrderList {
 	}
 	return nil
 }
+
+// VolumeToPrice : total volume of the price levels from the best price up to limitPrice
+// ascending walks from the min price (asks), otherwise from the max price (bids)
+func (orderTree *OrderTree) VolumeToPrice(limitPrice *big.Int, ascending bool) *big.Int {
+	volume := Zero()
+	iterator := orderTree.PriceTree.Iterator()
+	var found bool
+	if ascending {
+		found = iterator.First()
+	} else {
+		found = iterator.Last()
+	}
+
+	for found {
+		item := orderTree.getOrderListItem(iterator.Value())
+		if ascending && item.Price.Cmp(limitPrice) > 0 {
+			break
+		}
+		if !ascending && item.Price.Cmp(limitPrice) < 0 {
+			break
+		}
+		volume = Add(volume, item.Volume)
+
+		if ascending {
+			found = iterator.Next()
+		} else {
+			found = iterator.Prev()
+		}
+	}
+
+	return volume
+}
@@ -1,7 +1,6 @@
 package orderbook
 
 import (
-	"strconv"
 	"testing"
 )
 
@@ -11,33 +10,13 @@ func TestNewOrderTree(t *testing.T) {
 
 	// fmt.Println(ToJSON(orderTree.Item))
 
-	dummyOrder := make(map[string]string)
-	dummyOrder["timestamp"] = strconv.FormatUint(testTimestamp, 10)
-	dummyOrder["quantity"] = testQuanity.String()
-	dummyOrder["price"] = testPrice.String()
-	dummyOrder["order_id"] = strconv.Itoa(testOrderID)
-	dummyOrder["trade_id"] = strconv.Itoa(testTradeID)
-
-	dummyOrder1 := make(map[string]string)
-	dummyOrder1["timestamp"] = strconv.FormatUint(testTimestamp1, 10)
-	dummyOrder1["quantity"] = testQuanity1.String()
-	dummyOrder1["price"] = testPrice1.String()
-	dummyOrder1["order_id"] = strconv.Itoa(testOrderID1)
-	dummyOrder1["trade_id"] = strconv.Itoa(testTradeID1)
-
-	dummyOrder2 := make(map[string]string)
-	dummyOrder2["timestamp"] = strconv.FormatUint(testTimestamp2, 10)
-	dummyOrder2["quantity"] = testQuanity2.String()
-	dummyOrder2["price"] = testPrice2.String()
-	dummyOrder2["order_id"] = strconv.Itoa(testOrderID2)
-	dummyOrder2["trade_id"] = strconv.Itoa(testTradeID2)
-
-	dummyOrder3 := make(map[string]string)
-	dummyOrder3["timestamp"] = strconv.FormatUint(testTimestamp3, 10)
-	dummyOrder3["quantity"] = testQuanity3.String()
-	dummyOrder3["price"] = testPrice3.String()
-	dummyOrder3["order_id"] = strconv.Itoa(testOrderID3)
-	dummyOrder3["trade_id"] = strconv.Itoa(testTradeID3)
+	dummyOrder := newTestOrderQuote(testTimestamp, testQuanity, testPrice, testOrderID, testTradeID)
+
+	dummyOrder1 := newTestOrderQuote(testTimestamp1, testQuanity1, testPrice1, testOrderID1, testTradeID1)
+
+	dummyOrder2 := newTestOrderQuote(testTimestamp2, testQuanity2, testPrice2, testOrderID2, testTradeID2)
+
+	dummyOrder3 := newTestOrderQuote(testTimestamp3, testQuanity3, testPrice3, testOrderID3, testTradeID3)
 
 	// if orderTree.Item.Volume.Cmp(Zero()) != 0 {
 	// 	t.Errorf("orderTree.Volume incorrect, got: %d, want: %s.", orderTree.Item.Volume, Zero())
@@ -0,0 +1,285 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+var (
+	ErrInvalidSide            = errors.New("side must be bid or ask")
+	ErrInvalidOrderType       = errors.New("order type is not supported")
+	ErrInvalidQuantity        = errors.New("quantity must be greater than zero")
+	ErrInvalidPrice           = errors.New("price must be greater than zero")
+	ErrInvalidQuoteQuantity   = errors.New("quote quantity is only supported by market buy order")
+	ErrInvalidProtectionPrice = errors.New("protection price must be greater than zero")
+	ErrProtectionNotMarket    = errors.New("protection price and maximum slippage only apply to market orders")
+	ErrReservedTradeID        = errors.New("trade id is reserved for the accounts of the ledger")
+)
+
+// FieldError : a quote field is present but can not be parsed
+type FieldError struct {
+	Field string
+	Value string
+}
+
+func (err *FieldError) Error() string {
+	return fmt.Sprintf("invalid %s: %q", err.Field, err.Value)
+}
+
+// Quote : order request, also used as the order in book returned by ProcessOrder
+type Quote struct {
+	PairName  string   `json:"pairName"`
+	OrderID   uint64   `json:"orderID"`
+	Type      string   `json:"type"`
+	Side      string   `json:"side"`
+	Price     *big.Int `json:"price"`
+	Quantity  *big.Int `json:"quantity"`
+	TradeID   string   `json:"tradeID"`
+	Timestamp uint64   `json:"timestamp"`
+	// GTC, IOC, FOK or GTD, empty means GTC
+	TimeInForce string `json:"timeInForce,omitempty"`
+	// unix time in seconds, only used by GTD order
+	ExpireTime uint64 `json:"expireTime,omitempty"`
+	// maker only, the order never takes liquidity
+	PostOnly bool `json:"postOnly,omitempty"`
+	// trigger price of stop_market and stop_limit order
+	StopPrice *big.Int `json:"stopPrice,omitempty"`
+	// iceberg order only shows this quantity in the book, nil means all of it
+	DisplayQuantity *big.Int `json:"displayQuantity,omitempty"`
+	// self-trade prevention mode, empty means the default of the pair
+	SelfTradeMode string `json:"selfTradeMode,omitempty"`
+	// market buy by amount of quote currency to spend instead of base quantity
+	QuoteQuantity *big.Int `json:"quoteQuantity,omitempty"`
+	// market order stops matching at this price, the remaining quantity is cancelled
+	ProtectionPrice *big.Int `json:"protectionPrice,omitempty"`
+	// market order stops matching this far away from the best opposite price on arrival
+	MaxSlippageBps uint64 `json:"maxSlippageBps,omitempty"`
+
+	// filled by ProcessOrder
+	FilledQuantity *big.Int `json:"filledQuantity,omitempty"`
+	AveragePrice   *big.Int `json:"averagePrice,omitempty"`
+	// what a market order did not use, in quote currency when it is by amount, otherwise in base quantity
+	Unspent *big.Int `json:"unspent,omitempty"`
+
+	// remaining quantity was cancelled by self-trade prevention
+	cancelled bool
+	// sum of price * quantity of the fills, for the average price
+	filledAmount *big.Int
+}
+
+// Trade : execution report of one fill between the incoming quote (taker) and a resting order (maker)
+type Trade struct {
+	// sequential per pair, unique across restarts
+	ExecutionID uint64   `json:"executionID"`
+	PairName    string   `json:"pairName"`
+	Timestamp   uint64   `json:"timestamp"`
+	Price       *big.Int `json:"price"`
+	Quantity    *big.Int `json:"quantity"`
+	// side of the taker
+	AggressorSide string `json:"aggressorSide"`
+	MakerOrderID  uint64 `json:"makerOrderID"`
+	TakerOrderID  uint64 `json:"takerOrderID"`
+	MakerTradeID  string `json:"makerTradeID"`
+	TakerTradeID  string `json:"takerTradeID"`
+	// quantity still open after this fill, including the hidden reserve of an iceberg maker
+	MakerRemaining *big.Int `json:"makerRemaining"`
+	TakerRemaining *big.Int `json:"takerRemaining"`
+	MakerFilled    bool     `json:"makerFilled"`
+	TakerFilled    bool     `json:"takerFilled"`
+	// in quote currency, negative is a rebate
+	MakerFee *big.Int `json:"makerFee"`
+	TakerFee *big.Int `json:"takerFee"`
+}
+
+// NewQuote : parse the quote from its map form used by the p2p messages and the RPC payload,
+// empty values are treated as absent and malformed values are rejected with a FieldError
+func NewQuote(quote map[string]string) (*Quote, error) {
+	var err error
+	result := &Quote{
+		PairName:      quote["pair_name"],
+		Type:          quote["type"],
+		Side:          quote["side"],
+		TradeID:       quote["trade_id"],
+		TimeInForce:   quote["time_in_force"],
+		SelfTradeMode: quote["self_trade_mode"],
+	}
+	// limit is the default order type
+	if result.Type == "" {
+		result.Type = Limit
+	}
+
+	if result.OrderID, err = parseUint(quote, "order_id"); err != nil {
+		return nil, err
+	}
+	if result.Timestamp, err = parseUint(quote, "timestamp"); err != nil {
+		return nil, err
+	}
+	if result.ExpireTime, err = parseUint(quote, "expire_time"); err != nil {
+		return nil, err
+	}
+	if result.Price, err = parseBigInt(quote, "price"); err != nil {
+		return nil, err
+	}
+	if result.Quantity, err = parseBigInt(quote, "quantity"); err != nil {
+		return nil, err
+	}
+	if result.StopPrice, err = parseBigInt(quote, "stop_price"); err != nil {
+		return nil, err
+	}
+	if result.DisplayQuantity, err = parseBigInt(quote, "display_quantity"); err != nil {
+		return nil, err
+	}
+	if result.QuoteQuantity, err = parseBigInt(quote, "quote_quantity"); err != nil {
+		return nil, err
+	}
+	if result.ProtectionPrice, err = parseBigInt(quote, "protection_price"); err != nil {
+		return nil, err
+	}
+	if result.MaxSlippageBps, err = parseUint(quote, "max_slippage_bps"); err != nil {
+		return nil, err
+	}
+	if value := quote["post_only"]; value != "" {
+		if result.PostOnly, err = strconv.ParseBool(value); err != nil {
+			return nil, &FieldError{Field: "post_only", Value: value}
+		}
+	}
+
+	return result, nil
+}
+
+func parseUint(quote map[string]string, field string) (uint64, error) {
+	value := quote[field]
+	if value == "" {
+		return 0, nil
+	}
+	result, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, &FieldError{Field: field, Value: value}
+	}
+	return result, nil
+}
+
+func parseBigInt(quote map[string]string, field string) (*big.Int, error) {
+	value := quote[field]
+	if value == "" {
+		return nil, nil
+	}
+	result, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return nil, &FieldError{Field: field, Value: value}
+	}
+	return result, nil
+}
+
+// Validate : check the fields that do not depend on the state of the orderbook
+func (quote *Quote) Validate() error {
+	if quote.Side != Bid && quote.Side != Ask {
+		return ErrInvalidSide
+	}
+	if isReservedAccount(quote.TradeID) {
+		return ErrReservedTradeID
+	}
+	if quote.QuoteQuantity != nil {
+		// spending an amount only makes sense for a market buy
+		if quote.Type != Market || quote.Side != Bid || quote.Quantity != nil {
+			return ErrInvalidQuoteQuantity
+		}
+		if quote.QuoteQuantity.Sign() <= 0 {
+			return ErrInvalidQuantity
+		}
+	} else if quote.Quantity == nil || quote.Quantity.Sign() <= 0 {
+		return ErrInvalidQuantity
+	}
+	if quote.ProtectionPrice != nil && quote.ProtectionPrice.Sign() <= 0 {
+		return ErrInvalidProtectionPrice
+	}
+
+	switch quote.Type {
+	case Market:
+	case Limit:
+		if quote.Price == nil || quote.Price.Sign() <= 0 {
+			return ErrInvalidPrice
+		}
+	case StopMarket, StopLimit:
+		if quote.StopPrice == nil || quote.StopPrice.Sign() <= 0 {
+			return ErrInvalidStopPrice
+		}
+		if quote.Type == StopLimit && (quote.Price == nil || quote.Price.Sign() <= 0) {
+			return ErrInvalidPrice
+		}
+	default:
+		return ErrInvalidOrderType
+	}
+
+	// a market order never rests, time in force only applies to limit orders
+	if quote.TimeInForce != "" && quote.IsMarket() {
+		return ErrInvalidTimeInForce
+	}
+	// a limit order is already protected by its price
+	if (quote.ProtectionPrice != nil || quote.MaxSlippageBps > 0) && !quote.IsMarket() {
+		return ErrProtectionNotMarket
+	}
+	switch quote.TimeInForce {
+	case "", GTC, IOC, FOK:
+	case GTD:
+		if quote.ExpireTime == 0 {
+			return ErrInvalidExpireTime
+		}
+	default:
+		return ErrInvalidTimeInForce
+	}
+
+	// only an order that rests can hide part of its quantity
+	if quote.DisplayQuantity != nil && (quote.IsMarket() || quote.DisplayQuantity.Sign() <= 0 ||
+		IsStrictlyGreaterThan(quote.DisplayQuantity, quote.Quantity)) {
+		return ErrInvalidDisplayQuantity
+	}
+	if quote.SelfTradeMode != "" && !isSelfTradeMode(quote.SelfTradeMode) {
+		return ErrInvalidSelfTradeMode
+	}
+	return nil
+}
+
+// addFills : update filled quantity and average price with the fills of this quote
+func (quote *Quote) addFills(trades []*Trade) {
+	for _, trade := range trades {
+		if trade.TakerOrderID != quote.OrderID {
+			continue
+		}
+		if quote.FilledQuantity == nil {
+			quote.FilledQuantity = Zero()
+			quote.filledAmount = Zero()
+		}
+		quote.FilledQuantity = Add(quote.FilledQuantity, trade.Quantity)
+		quote.filledAmount = Add(quote.filledAmount, Mul(trade.Price, trade.Quantity))
+	}
+	if quote.FilledQuantity != nil && quote.FilledQuantity.Sign() > 0 {
+		quote.AveragePrice = Div(quote.filledAmount, quote.FilledQuantity)
+	}
+}
+
+// IsMarket : market order, including the one released from a stop market order, never rests in the book
+func (quote *Quote) IsMarket() bool {
+	return quote.Type == Market || quote.Type == StopMarket
+}
+
+// Clone : copy of the quote, so that big.Int fields are not shared
+func (quote *Quote) Clone() *Quote {
+	result := *quote
+	result.Price = cloneOptional(quote.Price)
+	result.Quantity = cloneOptional(quote.Quantity)
+	result.StopPrice = cloneOptional(quote.StopPrice)
+	result.DisplayQuantity = cloneOptional(quote.DisplayQuantity)
+	result.QuoteQuantity = cloneOptional(quote.QuoteQuantity)
+	result.ProtectionPrice = cloneOptional(quote.ProtectionPrice)
+	return &result
+}
+
+func cloneOptional(value *big.Int) *big.Int {
+	if value == nil {
+		return nil
+	}
+	return CloneBigInt(value)
+}
@@ -0,0 +1,68 @@
+package orderbook
+
+import (
+	"testing"
+)
+
+func TestNewQuote(t *testing.T) {
+	payload := map[string]string{
+		"pair_name":        "TOMO/WETH",
+		"side":             Bid,
+		"price":            "100",
+		"quantity":         "5",
+		"trade_id":         "1",
+		"timestamp":        "123452342343",
+		"time_in_force":    GTD,
+		"expire_time":      "123452342999",
+		"post_only":        "true",
+		"display_quantity": "2",
+	}
+	quote, err := NewQuote(payload)
+	if err != nil {
+		t.Fatalf("quote should be parsed, got: %v", err)
+	}
+	if quote.Type != Limit || quote.Price.Cmp(ToBigInt("100")) != 0 || quote.ExpireTime != 123452342999 || !quote.PostOnly {
+		t.Errorf("quote parsed incorrectly, got: %s", ToJSON(quote))
+	}
+	if err = quote.Validate(); err != nil {
+		t.Errorf("quote should be valid, got: %v", err)
+	}
+
+	// malformed number must not silently become zero
+	payload["quantity"] = "5x"
+	if _, err = NewQuote(payload); err == nil {
+		t.Errorf("malformed quantity should be rejected")
+	} else if fieldErr, ok := err.(*FieldError); !ok || fieldErr.Field != "quantity" {
+		t.Errorf("error should point at the quantity field, got: %v", err)
+	}
+}
+
+func TestQuoteValidate(t *testing.T) {
+	tests := []struct {
+		quote *Quote
+		err   error
+	}{
+		{&Quote{Type: Limit, Side: "buy", Price: ToBigInt("1"), Quantity: ToBigInt("1")}, ErrInvalidSide},
+		{&Quote{Type: "stop", Side: Bid, Price: ToBigInt("1"), Quantity: ToBigInt("1")}, ErrInvalidOrderType},
+		{&Quote{Type: Limit, Side: Bid, Price: ToBigInt("1")}, ErrInvalidQuantity},
+		{&Quote{Type: Limit, Side: Ask, Quantity: ToBigInt("1")}, ErrInvalidPrice},
+		{&Quote{Type: Market, Side: Ask, Quantity: ToBigInt("1")}, nil},
+		{&Quote{Type: StopLimit, Side: Ask, StopPrice: ToBigInt("1"), Quantity: ToBigInt("1")}, ErrInvalidPrice},
+		{&Quote{Type: Limit, Side: Bid, Price: ToBigInt("1"), Quantity: ToBigInt("1"), TimeInForce: "DAY"}, ErrInvalidTimeInForce},
+		{&Quote{Type: Market, Side: Bid, Quantity: ToBigInt("1"), TimeInForce: FOK}, ErrInvalidTimeInForce},
+		{&Quote{Type: StopMarket, Side: Ask, StopPrice: ToBigInt("1"), Quantity: ToBigInt("1"), TimeInForce: GTD, ExpireTime: 1}, ErrInvalidTimeInForce},
+		{&Quote{Type: Limit, Side: Bid, Price: ToBigInt("1"), Quantity: ToBigInt("1"), TradeID: FeeAccount}, ErrReservedTradeID},
+		{&Quote{Type: Limit, Side: Bid, Price: ToBigInt("1"), Quantity: ToBigInt("5"), DisplayQuantity: ToBigInt("6")}, ErrInvalidDisplayQuantity},
+		{&Quote{Type: Market, Side: Bid, Quantity: ToBigInt("5"), DisplayQuantity: ToBigInt("1")}, ErrInvalidDisplayQuantity},
+		{&Quote{Type: StopMarket, Side: Ask, StopPrice: ToBigInt("1"), Quantity: ToBigInt("5"), DisplayQuantity: ToBigInt("1")}, ErrInvalidDisplayQuantity},
+		{&Quote{Type: StopLimit, Side: Ask, StopPrice: ToBigInt("1"), Price: ToBigInt("1"), Quantity: ToBigInt("5"), DisplayQuantity: ToBigInt("5")}, nil},
+		{&Quote{Type: Limit, Side: Bid, Price: ToBigInt("1"), Quantity: ToBigInt("1"), ProtectionPrice: ToBigInt("2")}, ErrProtectionNotMarket},
+		{&Quote{Type: StopLimit, Side: Bid, StopPrice: ToBigInt("1"), Price: ToBigInt("1"), Quantity: ToBigInt("1"), MaxSlippageBps: 100}, ErrProtectionNotMarket},
+		{&Quote{Type: StopMarket, Side: Bid, StopPrice: ToBigInt("1"), Quantity: ToBigInt("1"), ProtectionPrice: ToBigInt("2")}, nil},
+	}
+	for i, test := range tests {
+		if err := test.quote.Validate(); err != test.err {
+			t.Errorf("case %d: got error %v, want %v", i, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package orderbook
+
+import (
+	"math/big"
+)
+
+func isSelfTradeMode(mode string) bool {
+	switch mode {
+	case STPNone, STPCancelNewest, STPCancelOldest, STPCancelBoth, STPDecrementAndCancel:
+		return true
+	}
+	return false
+}
+
+// selfTradeMode : mode of the order, or the default of the pair
+func (orderBook *Orderbook) selfTradeMode(quote *Quote) string {
+	if quote.SelfTradeMode != "" {
+		return quote.SelfTradeMode
+	}
+	return orderBook.SelfTradeMode
+}
+
+// isSelfTrade : the resting order belongs to the owner of the incoming order, empty trade id has no owner
+func (orderBook *Orderbook) isSelfTrade(quote *Quote, order *Order) bool {
+	if quote.TradeID == "" || quote.TradeID != order.Item.TradeID {
+		return false
+	}
+	mode := orderBook.selfTradeMode(quote)
+	return mode != "" && mode != STPNone
+}
+
+// preventSelfTrade : apply the self-trade prevention mode without trading, and return the quantity of
+// the incoming order still to trade, the quote is marked as cancelled when its remaining quantity is cancelled
+func (orderBook *Orderbook) preventSelfTrade(quote *Quote, orderTree *OrderTree, orderList *OrderList, order *Order, quantityToTrade *big.Int) *big.Int {
+	switch orderBook.selfTradeMode(quote) {
+	case STPCancelOldest:
+		orderBook.cancelResting(orderTree, orderList, order, "")
+		return quantityToTrade
+
+	case STPCancelBoth:
+		orderBook.cancelResting(orderTree, orderList, order, "")
+		quote.cancelled = true
+		return Zero()
+
+	case STPDecrementAndCancel:
+		remaining := order.RemainingQuantity()
+		if IsEqualOrSmallerThan(remaining, quantityToTrade) {
+			orderBook.cancelResting(orderTree, orderList, order, "")
+			return Sub(quantityToTrade, remaining)
+		}
+		orderBook.decrementResting(orderTree, orderList, order, quantityToTrade)
+		quote.cancelled = true
+		return Zero()
+
+	default:
+		// cancel newest
+		quote.cancelled = true
+		return Zero()
+	}
+}
+
+// cancelResting : remove the resting order met by the incoming order, when it belongs to the same owner
+// or its owner can not pay for the fill
+func (orderBook *Orderbook) cancelResting(orderTree *OrderTree, orderList *OrderList, order *Order, reason string) {
+	orderBook.removeOrder(orderTree, orderList, order)
+	orderBook.closeRecord(new(big.Int).SetBytes(order.Key).Uint64(), OrderStatusCancelled, reason)
+}
+
+// decrementResting : take the quantity off the resting order without trading it, the order keeps
+// its place in the queue
+func (orderBook *Orderbook) decrementResting(orderTree *OrderTree, orderList *OrderList, order *Order, quantity *big.Int) {
+	displayed := CloneBigInt(order.Item.Quantity)
+	order.Decrease(orderList, quantity)
+	orderTree.Item.Volume = Sub(orderTree.Item.Volume, Sub(displayed, order.Item.Quantity))
+	// the decremented quantity is neither filled nor open any more
+	orderID := new(big.Int).SetBytes(order.Key).Uint64()
+	orderBook.amendRecord(orderID, order.Item.Price, order.RemainingQuantity())
+	side := Ask
+	if orderTree == orderBook.Bids {
+		side = Bid
+	}
+	orderBook.relockFunds(orderID, side, order.Item.Price, order.RemainingQuantity())
+	orderTree.Save()
+}
+
+// preventAuctionSelfTrade : apply the self-trade prevention mode of the pair to the bid and ask of the
+// same owner met while uncrossing, the newer of the two is the taker. It returns false when the
+// orders may trade, otherwise at least one of them leaves the book
+func (orderBook *Orderbook) preventAuctionSelfTrade(bidList *OrderList, bid *Order, askList *OrderList, ask *Order, bidIsTaker bool) bool {
+	mode := orderBook.SelfTradeMode
+	if bid.Item.TradeID == "" || bid.Item.TradeID != ask.Item.TradeID || mode == "" || mode == STPNone {
+		return false
+	}
+	makerTree, makerList, maker := orderBook.Asks, askList, ask
+	takerTree, takerList, taker := orderBook.Bids, bidList, bid
+	if !bidIsTaker {
+		makerTree, makerList, maker, takerTree, takerList, taker = takerTree, takerList, taker, makerTree, makerList, maker
+	}
+
+	switch mode {
+	case STPCancelOldest:
+		orderBook.cancelResting(makerTree, makerList, maker, "")
+	case STPCancelBoth:
+		orderBook.cancelResting(makerTree, makerList, maker, "")
+		orderBook.cancelResting(takerTree, takerList, taker, "")
+	case STPDecrementAndCancel:
+		// both orders lose the smaller remaining quantity, the one left with nothing is cancelled
+		quantity := minBigInt(maker.RemainingQuantity(), taker.RemainingQuantity())
+		for _, resting := range []struct {
+			orderTree *OrderTree
+			orderList *OrderList
+			order     *Order
+		}{{makerTree, makerList, maker}, {takerTree, takerList, taker}} {
+			if IsEqualOrSmallerThan(resting.order.RemainingQuantity(), quantity) {
+				orderBook.cancelResting(resting.orderTree, resting.orderList, resting.order, "")
+			} else {
+				orderBook.decrementResting(resting.orderTree, resting.orderList, resting.order, quantity)
+			}
+		}
+	default:
+		// cancel newest
+		orderBook.cancelResting(takerTree, takerList, taker, "")
+	}
+	return true
+}
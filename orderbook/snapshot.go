@@ -0,0 +1,346 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// SnapshotVersion : version of the snapshot format written by ExportSnapshot
+const SnapshotVersion = 1
+
+var (
+	ErrSnapshotVersion  = errors.New("snapshot version is not supported")
+	ErrSnapshotPairName = errors.New("snapshot is for another pair")
+	ErrSnapshotInvalid  = errors.New("snapshot order is invalid")
+	ErrBookNotEmpty     = errors.New("snapshot can only be loaded into a fresh orderbook")
+)
+
+// SnapshotOrder : one resting order, Quantity is the displayed quantity and Reserve the hidden rest
+// of an iceberg order. StopQuote is the quote released when a stop order is triggered
+type SnapshotOrder struct {
+	OrderID    uint64   `json:"orderID"`
+	TradeID    string   `json:"tradeID"`
+	Timestamp  uint64   `json:"timestamp"`
+	Price      *big.Int `json:"price"`
+	Quantity   *big.Int `json:"quantity"`
+	PeakSize   *big.Int `json:"peakSize,omitempty"`
+	Reserve    *big.Int `json:"reserve,omitempty"`
+	ExpireTime uint64   `json:"expireTime,omitempty"`
+	StopQuote  *Quote   `json:"stopQuote,omitempty"`
+}
+
+// Snapshot : every resting order of the book (L3), the price levels are in matching order, best price
+// first, and the orders of a level in queue order. For the trigger book the first level is the one
+// triggered first
+type Snapshot struct {
+	Version         uint64 `json:"version"`
+	PairName        string `json:"pairName"`
+	Timestamp       uint64 `json:"timestamp"`
+	NextOrderID     uint64 `json:"nextOrderID"`
+	NextExecutionID uint64 `json:"nextExecutionID"`
+	// sequence of the last book delta in the snapshot
+	Sequence uint64           `json:"sequence"`
+	Phase    string           `json:"phase"`
+	Bids     []*SnapshotOrder `json:"bids"`
+	Asks     []*SnapshotOrder `json:"asks"`
+	StopBids []*SnapshotOrder `json:"stopBids"`
+	StopAsks []*SnapshotOrder `json:"stopAsks"`
+}
+
+// snapshotOrders : the orders of the tree level by level, head of the queue first
+func (orderBook *Orderbook) snapshotOrders(orderTree *OrderTree, descending, stop bool) []*SnapshotOrder {
+	var result []*SnapshotOrder
+	iterator := orderTree.PriceTree.Iterator()
+	next, found := iterator.Next, iterator.First()
+	if descending {
+		next, found = iterator.Prev, iterator.Last()
+	}
+
+	for ; found; found = next() {
+		orderList := orderTree.decodeOrderList(iterator.Value())
+		for _, order := range orderList.Orders() {
+			item := &SnapshotOrder{
+				OrderID:    new(big.Int).SetBytes(order.Key).Uint64(),
+				TradeID:    order.Item.TradeID,
+				Timestamp:  order.Item.Timestamp,
+				Price:      CloneBigInt(order.Item.Price),
+				Quantity:   CloneBigInt(order.Item.Quantity),
+				ExpireTime: order.Item.ExpireTime,
+			}
+			// an iceberg keeps its peak even when its reserve is used up
+			if order.Item.PeakSize != nil && order.Item.PeakSize.Sign() > 0 {
+				item.PeakSize = CloneBigInt(order.Item.PeakSize)
+				item.Reserve = Zero()
+				if order.Item.Reserve != nil {
+					item.Reserve = CloneBigInt(order.Item.Reserve)
+				}
+			}
+			if stop {
+				item.StopQuote = orderBook.getStopQuote(order.Key)
+			}
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Snapshot : every resting order of the book and of the trigger book in exact queue order
+func (orderBook *Orderbook) Snapshot() *Snapshot {
+	return &Snapshot{
+		Version:         SnapshotVersion,
+		PairName:        orderBook.Item.Name,
+		Timestamp:       orderBook.Item.Timestamp,
+		NextOrderID:     orderBook.Item.NextOrderID,
+		NextExecutionID: orderBook.Item.NextExecutionID,
+		Sequence:        orderBook.Item.Sequence,
+		Phase:           orderBook.Phase(),
+		Bids:            orderBook.snapshotOrders(orderBook.Bids, true, false),
+		Asks:            orderBook.snapshotOrders(orderBook.Asks, false, false),
+		StopBids:        orderBook.snapshotOrders(orderBook.StopBids, false, true),
+		StopAsks:        orderBook.snapshotOrders(orderBook.StopAsks, true, true),
+	}
+}
+
+// ExportSnapshot : write the snapshot of the book to the file as json
+func (orderBook *Orderbook) ExportSnapshot(path string) error {
+	data, err := json.MarshalIndent(orderBook.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// ReadSnapshot : read the snapshot written by ExportSnapshot
+func ReadSnapshot(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != SnapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	return snapshot, nil
+}
+
+// validate : check every order of the snapshot before any is loaded, so that a snapshot that can not
+// be loaded leaves the book untouched
+func (snapshot *Snapshot) validate() error {
+	if snapshot.Phase != "" && !isPhase(snapshot.Phase) {
+		return ErrSnapshotInvalid
+	}
+	ids := make(map[uint64]bool)
+	checkID := func(item *SnapshotOrder) bool {
+		if item == nil || item.OrderID == 0 || item.OrderID > snapshot.NextOrderID || ids[item.OrderID] ||
+			isReservedAccount(item.TradeID) {
+			return false
+		}
+		ids[item.OrderID] = true
+		return true
+	}
+
+	var bestBid, bestAsk *big.Int
+	for _, items := range [][]*SnapshotOrder{snapshot.Bids, snapshot.Asks} {
+		for _, item := range items {
+			if !checkID(item) {
+				return ErrSnapshotInvalid
+			}
+			if item.Price == nil || item.Price.Sign() <= 0 || item.Quantity == nil || item.Quantity.Sign() <= 0 {
+				return ErrSnapshotInvalid
+			}
+			// an iceberg shows at most its peak, and its peak is never more than what is left of it
+			if item.PeakSize != nil && (item.PeakSize.Sign() <= 0 || item.Reserve == nil || item.Reserve.Sign() < 0 ||
+				IsStrictlyGreaterThan(item.Quantity, item.PeakSize) ||
+				IsStrictlyGreaterThan(item.PeakSize, Add(item.Quantity, item.Reserve))) {
+				return ErrSnapshotInvalid
+			}
+		}
+	}
+	for _, item := range snapshot.Bids {
+		if bestBid == nil || IsStrictlyGreaterThan(item.Price, bestBid) {
+			bestBid = item.Price
+		}
+	}
+	for _, item := range snapshot.Asks {
+		if bestAsk == nil || IsStrictlyGreaterThan(bestAsk, item.Price) {
+			bestAsk = item.Price
+		}
+	}
+	// only an auction or a closed book rests crossing orders, a continuous book would have matched them
+	if (snapshot.Phase == "" || snapshot.Phase == PhaseContinuous) && bestBid != nil && bestAsk != nil &&
+		!IsStrictlyGreaterThan(bestAsk, bestBid) {
+		return ErrSnapshotInvalid
+	}
+
+	for side, items := range map[string][]*SnapshotOrder{Bid: snapshot.StopBids, Ask: snapshot.StopAsks} {
+		for _, item := range items {
+			if !checkID(item) {
+				return ErrSnapshotInvalid
+			}
+			quote := item.StopQuote
+			if quote == nil || quote.OrderID != item.OrderID || quote.Side != side ||
+				(quote.Type != StopMarket && quote.Type != StopLimit) || quote.Validate() != nil {
+				return ErrSnapshotInvalid
+			}
+		}
+	}
+	return nil
+}
+
+// quote : the quote that rests the order again, with its displayed quantity only
+func (item *SnapshotOrder) quote(side string) *Quote {
+	quote := &Quote{
+		OrderID:   item.OrderID,
+		Type:      Limit,
+		Side:      side,
+		Price:     CloneBigInt(item.Price),
+		Quantity:  CloneBigInt(item.Quantity),
+		TradeID:   item.TradeID,
+		Timestamp: item.Timestamp,
+	}
+	if item.ExpireTime > 0 {
+		quote.TimeInForce = GTD
+		quote.ExpireTime = item.ExpireTime
+	}
+	return quote
+}
+
+// loadOrders : rest the orders in the tree in the order of the snapshot, so that they keep their priority
+func (orderBook *Orderbook) loadOrders(orderTree *OrderTree, side string, items []*SnapshotOrder) error {
+	for _, item := range items {
+		quote := item.quote(side)
+		if err := orderBook.insertOrder(orderTree, quote); err != nil {
+			return err
+		}
+
+		// the iceberg keeps its peak and what is left of its reserve
+		total := CloneBigInt(quote.Quantity)
+		if item.PeakSize != nil {
+			order := orderTree.GetOrder(GetKeyFromUint64(item.OrderID), quote.Price)
+			orderList := orderTree.PriceList(quote.Price)
+			if order == nil || orderList == nil {
+				return ErrSnapshotInvalid
+			}
+			order.Item.PeakSize = CloneBigInt(item.PeakSize)
+			order.Item.Reserve = CloneBigInt(item.Reserve)
+			total = Add(total, order.Item.Reserve)
+			orderList.SaveOrder(order)
+		}
+		if err := orderBook.addExpiry(quote); err != nil {
+			return err
+		}
+		quote.Quantity = total
+		orderBook.openRecord(quote)
+	}
+	return nil
+}
+
+// loadStopOrders : rest the stop orders in the trigger book with the quotes they release
+func (orderBook *Orderbook) loadStopOrders(items []*SnapshotOrder) error {
+	for _, item := range items {
+		quote := item.StopQuote.Clone()
+		if _, err := orderBook.processStopOrder(quote); err != nil {
+			return err
+		}
+		if err := orderBook.addExpiry(quote); err != nil {
+			return err
+		}
+		orderBook.openRecord(quote)
+	}
+	return nil
+}
+
+// LoadSnapshot : rebuild the book from the snapshot, the book must never have had an order. The whole
+// snapshot is checked before the book is changed. The orders get a new history starting at the time of
+// the snapshot, and no funds are locked for them since balances are not part of the snapshot
+func (orderBook *Orderbook) LoadSnapshot(snapshot *Snapshot) error {
+	if snapshot.Version != SnapshotVersion {
+		return ErrSnapshotVersion
+	}
+	if strings.ToLower(snapshot.PairName) != orderBook.Item.Name {
+		return ErrSnapshotPairName
+	}
+	if orderBook.Item.NextOrderID > 0 || orderBook.Bids.NotEmpty() || orderBook.Asks.NotEmpty() ||
+		orderBook.StopBids.NotEmpty() || orderBook.StopAsks.NotEmpty() {
+		return ErrBookNotEmpty
+	}
+	if err := snapshot.validate(); err != nil {
+		return err
+	}
+
+	// the orders loaded are not changes, the book goes on from the sequence of the snapshot
+	onDelta := orderBook.OnDelta
+	orderBook.OnDelta = nil
+	defer func() { orderBook.OnDelta = onDelta }()
+
+	orderBook.Item.Timestamp = snapshot.Timestamp
+	orderBook.Item.NextOrderID = snapshot.NextOrderID
+	orderBook.Item.NextExecutionID = snapshot.NextExecutionID
+	if snapshot.Phase != "" {
+		orderBook.Item.Phase = snapshot.Phase
+	}
+
+	if err := orderBook.loadOrders(orderBook.Bids, Bid, snapshot.Bids); err != nil {
+		return err
+	}
+	if err := orderBook.loadOrders(orderBook.Asks, Ask, snapshot.Asks); err != nil {
+		return err
+	}
+	if err := orderBook.loadStopOrders(snapshot.StopBids); err != nil {
+		return err
+	}
+	if err := orderBook.loadStopOrders(snapshot.StopAsks); err != nil {
+		return err
+	}
+	orderBook.Item.Sequence = snapshot.Sequence
+	return orderBook.Save()
+}
+
+// GetSnapshot : every resting order of the pair with the sequence of the last book delta, the base
+// a consumer applies the following book deltas on
+func (engine *Engine) GetSnapshot(pairName string) (*Snapshot, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, err
+	}
+	return ob.Snapshot(), nil
+}
+
+// ExportSnapshot : write the snapshot of the pair to the file
+func (engine *Engine) ExportSnapshot(pairName, path string) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return err
+	}
+	return ob.ExportSnapshot(path)
+}
+
+// ImportSnapshot : rebuild the pair of the snapshot file, the pair must be allowed and its book fresh
+func (engine *Engine) ImportSnapshot(path string) (*Snapshot, error) {
+	defer engine.sendEvents()
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(snapshot.PairName)
+	if ob == nil {
+		return nil, err
+	}
+	return snapshot, ob.LoadSnapshot(snapshot)
+}
@@ -0,0 +1,133 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"math/big"
+	"sort"
+)
+
+// TradesPage : one page of the trade tape in sequence order, Next is the sequence the next page
+// starts from, 0 when this is the last page
+type TradesPage struct {
+	Trades []*Trade `json:"trades"`
+	Next   uint64   `json:"next"`
+}
+
+// TapeItem : one trade of the tape
+type TapeItem struct {
+	Trade []byte `json:"trade"` // json encoded trade, a rebate is a negative fee that rlp can not encode
+}
+
+// getTapeKey : trades are appended under their execution id, which is the sequence of the tape
+func (orderBook *Orderbook) getTapeKey(sequence uint64) []byte {
+	return GetKeyFromBig(Add(orderBook.tapeSlot, new(big.Int).SetUint64(sequence)))
+}
+
+// appendTrade : add the trade to the tape of the pair, a stored trade never changes
+func (orderBook *Orderbook) appendTrade(trade *Trade) error {
+	tradeBytes, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+	return orderBook.db.Put(orderBook.getTapeKey(trade.ExecutionID), &TapeItem{Trade: tradeBytes})
+}
+
+// GetTrade : the trade of the tape with the sequence, nil when it is not stored
+func (orderBook *Orderbook) GetTrade(sequence uint64) *Trade {
+	val, err := orderBook.db.Get(orderBook.getTapeKey(sequence), &TapeItem{})
+	if err != nil || val == nil {
+		return nil
+	}
+	trade := &Trade{}
+	if err = json.Unmarshal(val.(*TapeItem).Trade, trade); err != nil {
+		return nil
+	}
+	return trade
+}
+
+// tapeStart : first sequence of the tape, the trades before a snapshot was loaded are not stored
+func (orderBook *Orderbook) tapeStart() uint64 {
+	last := orderBook.Item.NextExecutionID
+	i := sort.Search(int(last), func(i int) bool {
+		found, _ := orderBook.db.Has(orderBook.getTapeKey(uint64(i) + 1))
+		return found
+	})
+	return uint64(i) + 1
+}
+
+// tradesPage : at most limit trades from the sequence on, up to the end time when it is not 0
+func (orderBook *Orderbook) tradesPage(fromSeq, end uint64, limit int) *TradesPage {
+	if limit <= 0 {
+		limit = DefaultPageSize
+	} else if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	page := &TradesPage{}
+	for sequence := fromSeq; sequence <= orderBook.Item.NextExecutionID; sequence++ {
+		trade := orderBook.GetTrade(sequence)
+		if trade == nil {
+			continue
+		}
+		if end > 0 && trade.Timestamp > end {
+			break
+		}
+		if len(page.Trades) == limit {
+			page.Next = sequence
+			break
+		}
+		page.Trades = append(page.Trades, trade)
+	}
+	return page
+}
+
+// GetTrades : one page of the trade tape from the sequence on, 0 is the first page
+func (orderBook *Orderbook) GetTrades(fromSeq uint64, limit int) *TradesPage {
+	if start := orderBook.tapeStart(); fromSeq < start {
+		fromSeq = start
+	}
+	return orderBook.tradesPage(fromSeq, 0, limit)
+}
+
+// GetTradesByTime : one page of the trades printed from start to end included, end 0 means until now.
+// The next pages are asked with the same times from the sequence of the page on. Trades are found by
+// their time with a binary search, the tape is in time order as long as the clock of the node does not go back
+func (orderBook *Orderbook) GetTradesByTime(start, end, fromSeq uint64, limit int) *TradesPage {
+	first := orderBook.tapeStart()
+	last := orderBook.Item.NextExecutionID
+	if first <= last {
+		i := sort.Search(int(last-first+1), func(i int) bool {
+			trade := orderBook.GetTrade(first + uint64(i))
+			return trade == nil || trade.Timestamp >= start
+		})
+		first += uint64(i)
+	}
+	if fromSeq < first {
+		fromSeq = first
+	}
+	return orderBook.tradesPage(fromSeq, end, limit)
+}
+
+// GetTrades : one page of the trade tape of the pair
+func (engine *Engine) GetTrades(pairName string, fromSeq uint64, limit int) (*TradesPage, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, err
+	}
+	return ob.GetTrades(fromSeq, limit), nil
+}
+
+// GetTradesByTime : one page of the trades of the pair printed from start to end
+func (engine *Engine) GetTradesByTime(pairName string, start, end, fromSeq uint64, limit int) (*TradesPage, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, err
+	}
+	return ob.GetTradesByTime(start, end, fromSeq, limit), nil
+}
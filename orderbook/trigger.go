@@ -0,0 +1,123 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// StopOrderItem : the quote that will be released into the orderbook when the stop order is triggered
+type StopOrderItem struct {
+	Quote []byte `json:"quote"` // json encoded quote
+}
+
+func (orderBook *Orderbook) getStopKey(key []byte) []byte {
+	return GetKeyFromBig(Add(orderBook.stopSlot, new(big.Int).SetBytes(key)))
+}
+
+// processStopOrder : put the stop order into the trigger book, buy stop is triggered when a trade prints
+// at or above stop price, sell stop when a trade prints at or below stop price
+func (orderBook *Orderbook) processStopOrder(quote *Quote) (*Quote, error) {
+	quoteBytes, err := json.Marshal(quote)
+	if err != nil {
+		return nil, err
+	}
+
+	// order in the trigger book is keyed by the stop price
+	stopQuote := quote.Clone()
+	stopQuote.Price = CloneBigInt(quote.StopPrice)
+
+	if quote.Side == Bid {
+		err = orderBook.insertOrder(orderBook.StopBids, stopQuote)
+	} else {
+		err = orderBook.insertOrder(orderBook.StopAsks, stopQuote)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := GetKeyFromUint64(quote.OrderID)
+	err = orderBook.db.Put(orderBook.getStopKey(key), &StopOrderItem{Quote: quoteBytes})
+	return quote, err
+}
+
+// triggerStopOrders : move the stop orders triggered by the traded price from the trigger book to the queue
+// buy stops are released from the lowest stop price, sell stops from the highest, then by time priority
+func (orderBook *Orderbook) triggerStopOrders(tradedPrice *big.Int) {
+	for orderBook.StopBids.NotEmpty() && IsEqualOrSmallerThan(orderBook.StopBids.MinPrice(), tradedPrice) {
+		orderBook.releaseStopOrderList(orderBook.StopBids, orderBook.StopBids.MinPriceList())
+	}
+	for orderBook.StopAsks.NotEmpty() && IsEqualOrGreaterThan(orderBook.StopAsks.MaxPrice(), tradedPrice) {
+		orderBook.releaseStopOrderList(orderBook.StopAsks, orderBook.StopAsks.MaxPriceList())
+	}
+}
+
+func (orderBook *Orderbook) releaseStopOrderList(orderTree *OrderTree, orderList *OrderList) {
+	for orderList.Item.Length > 0 {
+		order := orderList.GetOrder(orderList.Item.HeadOrder)
+		if order == nil {
+			panic("headOrder is null")
+		}
+		orderBook.removeOrder(orderTree, orderList, order)
+
+		quote := orderBook.removeStopQuote(order.Key)
+		if quote == nil {
+			continue
+		}
+		if quote.Type == StopMarket {
+			quote.Type = Market
+		} else {
+			quote.Type = Limit
+		}
+		orderBook.triggeredOrders = append(orderBook.triggeredOrders, quote)
+	}
+}
+
+// getStopQuote : the quote stored for the stop order
+func (orderBook *Orderbook) getStopQuote(key []byte) *Quote {
+	val, err := orderBook.db.Get(orderBook.getStopKey(key), &StopOrderItem{})
+	if err != nil || val == nil {
+		return nil
+	}
+
+	quote := &Quote{}
+	if err = json.Unmarshal(val.(*StopOrderItem).Quote, quote); err != nil {
+		return nil
+	}
+	return quote
+}
+
+// removeStopQuote : delete and return the quote stored for the stop order
+func (orderBook *Orderbook) removeStopQuote(key []byte) *Quote {
+	quote := orderBook.getStopQuote(key)
+	orderBook.db.Delete(orderBook.getStopKey(key), true)
+	return quote
+}
+
+// processTriggeredOrders : process released stop orders one by one, orders triggered meanwhile are queued
+func (orderBook *Orderbook) processTriggeredOrders(verbose bool) []*Trade {
+	var trades []*Trade
+	for len(orderBook.triggeredOrders) > 0 {
+		quote := orderBook.triggeredOrders[0]
+		orderBook.triggeredOrders = orderBook.triggeredOrders[1:]
+
+		// GTD stop order may have expired while waiting in the trigger book
+		if quote.Type == Limit && orderBook.validateExpireTime(quote) != nil {
+			orderBook.closeRecord(quote.OrderID, OrderStatusExpired, "")
+			continue
+		}
+
+		if verbose {
+			fmt.Printf("TRIGGER: OrderID - %d, Type - %s, Side - %s, StopPrice - %s\n",
+				quote.OrderID, quote.Type, quote.Side, quote.StopPrice)
+		}
+
+		newTrades, orderInBook, err := orderBook.processOrder(quote, verbose)
+		orderBook.finishRecord(quote, orderInBook, err)
+		if err != nil && verbose {
+			fmt.Printf("Triggered order %d rejected: %v\n", quote.OrderID, err)
+		}
+		trades = append(trades, newTrades...)
+	}
+	return trades
+}
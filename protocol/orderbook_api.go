@@ -1,9 +1,12 @@
 package protocol
 
 import (
+	"context"
 	"math/big"
 	"strconv"
+	"strings"
 	"time"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/novaprotocolio/orderbook/orderbook"
 	demo "github.com/novaprotocolio/orderbook/common"
 )
@@ -28,7 +31,7 @@ func NewOrderbookAPI(v int, orderbookEngine *orderbook.Engine, outC chan<- inter
 	}
 }
 
-func (api *OrderbookAPI) getRecordFromOrder(order *orderbook.Order, ob *orderbook.Orderbook) map[string]string {
+func (api *OrderbookAPI) getRecordFromOrder(order *orderbook.Order) map[string]string {
 	record := make(map[string]string)
 	record["timestamp"] = strconv.FormatUint(order.Item.Timestamp, 10)
 	record["price"] = order.Item.Price.String()
@@ -39,87 +42,266 @@ func (api *OrderbookAPI) getRecordFromOrder(order *orderbook.Order, ob *orderboo
 	return record
 }
 
-func (api *OrderbookAPI) GetBestAskList(pairName string) []map[string]string {
-	ob, _ := api.Engine.GetOrderbook(pairName)
-	if ob == nil {
+func (api *OrderbookAPI) getRecordsFromOrders(orders []*orderbook.Order) []map[string]string {
+	if len(orders) == 0 {
 		return nil
 	}
-	orderList := ob.Asks.MaxPriceList()
-	if orderList == nil {
-		return nil
-	}
-
-	// t.Logf("Best ask List : %s", orderList.String(0))
-	cursor := orderList.Head()
-	// we have length
-	results := make([]map[string]string, orderList.Item.Length)
-	for cursor != nil {
-		record := api.getRecordFromOrder(cursor, ob)
-		results = append(results, record)
-		cursor = cursor.GetNextOrder(orderList)
+	results := make([]map[string]string, 0, len(orders))
+	for _, order := range orders {
+		results = append(results, api.getRecordFromOrder(order))
 	}
 	return results
 }
 
+// GetBestAskList : the orders at the lowest ask, head of the queue first
+func (api *OrderbookAPI) GetBestAskList(pairName string) []map[string]string {
+	orders, _ := api.Engine.GetBestAskList(pairName)
+	return api.getRecordsFromOrders(orders)
+}
+
+// GetBestBidList : the orders at the highest bid, head of the queue first
 func (api *OrderbookAPI) GetBestBidList(pairName string) []map[string]string {
-	ob, _ := api.Engine.GetOrderbook(pairName)
-	if ob == nil {
-		return nil
-	}
-	orderList := ob.Bids.MinPriceList()
-	// t.Logf("Best ask List : %s", orderList.String(0))
-	if orderList == nil {
-		return nil
-	}
-	cursor := orderList.Tail()
-	// we have length
-	results := make([]map[string]string, orderList.Item.Length)
-	for cursor != nil {
-		record := api.getRecordFromOrder(cursor, ob)
-		results = append(results, record)
-		cursor = cursor.GetPrevOrder(orderList)
-	}
-	return results
+	orders, _ := api.Engine.GetBestBidList(pairName)
+	return api.getRecordsFromOrders(orders)
+}
 
+// GetDepth : the best levels of both sides with their volume and number of orders, levels 0 means all
+// of them and prices are grouped by the grouping when it is given
+func (api *OrderbookAPI) GetDepth(pairName string, levels int, grouping string) (*orderbook.Depth, error) {
+	var groupingPrice *big.Int
+	if grouping != "" {
+		var ok bool
+		if groupingPrice, ok = new(big.Int).SetString(grouping, 10); !ok || groupingPrice.Sign() <= 0 {
+			return nil, &orderbook.FieldError{Field: "grouping", Value: grouping}
+		}
+	}
+	return api.Engine.GetDepth(pairName, levels, groupingPrice)
 }
 
 func (api *OrderbookAPI) GetOrder(pairName, orderID string) map[string]string {
 	var result map[string]string
-	ob, _ := api.Engine.GetOrderbook(pairName)
-	if ob == nil {
+	id, err := strconv.ParseUint(orderID, 10, 64)
+	if err != nil {
 		return nil
 	}
-	key := orderbook.GetKeyFromString(orderID)
-	order := ob.GetOrder(key)
+	// the order is found by its id alone, whatever side and price it rests at
+	order, location, _ := api.Engine.GetOrderByID(pairName, id)
 	if order != nil {
-		result = api.getRecordFromOrder(order, ob)
+		result = api.getRecordFromOrder(order)
+		result["side"] = location.Side
+		result["stop"] = strconv.FormatBool(location.Stop)
 	}
 	return result
 }
 
+// GetOrderHistory : lifecycle of the order, also after it was filled, cancelled or expired
+func (api *OrderbookAPI) GetOrderHistory(pairName, orderID string) (*orderbook.OrderRecord, error) {
+	id, err := strconv.ParseUint(orderID, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return api.Engine.GetOrderRecord(pairName, id)
+}
+
+// parseFrom : where a page starts, "" is the first page
+func parseFrom(from string) (uint64, error) {
+	if from == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(from, 10, 64)
+}
+
+// GetOpenOrders : one page of the open orders of the account on the pair, from the order id on ("" is the
+// first page), limit 0 means the default page size
+func (api *OrderbookAPI) GetOpenOrders(account, pairName, fromOrderID string, limit int) (*orderbook.OpenOrdersPage, error) {
+	from, err := parseFrom(fromOrderID)
+	if err != nil {
+		return nil, err
+	}
+	return api.Engine.GetOpenOrders(pairName, account, from, limit)
+}
+
+// GetTrades : one page of the trade tape of the pair from the sequence on ("" is the first page),
+// limit 0 means the default page size
+func (api *OrderbookAPI) GetTrades(pairName, fromSeq string, limit int) (*orderbook.TradesPage, error) {
+	from, err := parseFrom(fromSeq)
+	if err != nil {
+		return nil, err
+	}
+	return api.Engine.GetTrades(pairName, from, limit)
+}
+
+// GetTradesByTime : one page of the trades of the pair printed from start to end in unix seconds, end 0
+// means until now, the next page is asked with the same times from the sequence of the page on
+func (api *OrderbookAPI) GetTradesByTime(pairName string, start, end uint64, fromSeq string, limit int) (*orderbook.TradesPage, error) {
+	from, err := parseFrom(fromSeq)
+	if err != nil {
+		return nil, err
+	}
+	return api.Engine.GetTradesByTime(pairName, start, end, from, limit)
+}
+
+// GetAccountFees : traded amount, fees paid and rebates received by the account on the pair
+func (api *OrderbookAPI) GetAccountFees(pairName, account string) (*orderbook.AccountFeeItem, error) {
+	return api.Engine.GetAccountFees(pairName, account)
+}
+
+// GetBalance : available and locked balance of the account in the asset
+func (api *OrderbookAPI) GetBalance(account, asset string) *orderbook.Balance {
+	return api.Engine.GetBalance(account, asset)
+}
+
+const (
+	// DefaultSubscriptionDepth : levels of each side pushed to a depth subscription that does not choose
+	DefaultSubscriptionDepth = 20
+	// events waiting for a slow subscriber, it is dropped when they are full so the engine never waits
+	subscriptionBuffer = 128
+)
+
+// subscribe : create the subscription and run the loop that pushes the events of the engine to it,
+// the loop must return once the subscriber unsubscribes or disconnects
+func subscribe(ctx context.Context, run func(notifier *rpc.Notifier, rpcSub *rpc.Subscription)) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+	go run(notifier, rpcSub)
+	return rpcSub, nil
+}
+
+// Trades : push subscription orderbook_subscribe("trades", pairName), the execution report of every
+// fill of the pair
+func (api *OrderbookAPI) Trades(ctx context.Context, pairName string) (*rpc.Subscription, error) {
+	if _, err := api.Engine.GetInstrument(pairName); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(pairName)
+	return subscribe(ctx, func(notifier *rpc.Notifier, rpcSub *rpc.Subscription) {
+		tradeC := make(chan *orderbook.Trade, subscriptionBuffer)
+		sub := api.Engine.SubscribeTrades(tradeC)
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case trade := <-tradeC:
+				if trade.PairName == name {
+					notifier.Notify(rpcSub.ID, trade)
+				}
+			case err := <-sub.Err():
+				// the subscriber did not keep up and misses events, it has to subscribe again
+				demo.LogInfo("Subscription dropped", "id", rpcSub.ID, "err", err)
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	})
+}
+
+// Depth : push subscription orderbook_subscribe("depth", pairName, levels), the aggregated depth of the
+// pair every time its book changes, levels is DefaultSubscriptionDepth when it is not given
+func (api *OrderbookAPI) Depth(ctx context.Context, pairName string, levels *int) (*rpc.Subscription, error) {
+	if _, err := api.Engine.GetInstrument(pairName); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(pairName)
+	depthLevels := DefaultSubscriptionDepth
+	if levels != nil {
+		depthLevels = *levels
+	}
+	return subscribe(ctx, func(notifier *rpc.Notifier, rpcSub *rpc.Subscription) {
+		deltaC := make(chan *orderbook.BookDelta, subscriptionBuffer)
+		sub := api.Engine.SubscribeBookDelta(deltaC)
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case delta := <-deltaC:
+				if delta.PairName != name {
+					continue
+				}
+				// one depth for the deltas of the same change
+				for drained := false; !drained; {
+					select {
+					case <-deltaC:
+					default:
+						drained = true
+					}
+				}
+				if depth, err := api.Engine.GetDepth(pairName, depthLevels, nil); err == nil {
+					notifier.Notify(rpcSub.ID, depth)
+				}
+			case err := <-sub.Err():
+				// the subscriber did not keep up and misses events, it has to subscribe again
+				demo.LogInfo("Subscription dropped", "id", rpcSub.ID, "err", err)
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	})
+}
+
+// Orders : push subscription orderbook_subscribe("orders", account), the record of every order of
+// the account on every pair each time its state or its fills change
+func (api *OrderbookAPI) Orders(ctx context.Context, account string) (*rpc.Subscription, error) {
+	return subscribe(ctx, func(notifier *rpc.Notifier, rpcSub *rpc.Subscription) {
+		recordC := make(chan *orderbook.OrderRecord, subscriptionBuffer)
+		sub := api.Engine.SubscribeOrderUpdates(recordC)
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case record := <-recordC:
+				if record.TradeID == account {
+					notifier.Notify(rpcSub.ID, record)
+				}
+			case err := <-sub.Err():
+				// the subscriber did not keep up and misses events, it has to subscribe again
+				demo.LogInfo("Subscription dropped", "id", rpcSub.ID, "err", err)
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	})
+}
+
 func (api *OrderbookAPI) sendMessage(msg interface{}) {
 	api.OutC <- msg
 }
 
-func (api *OrderbookAPI) ProcessOrder(payload map[string]string) map[string]string {
+func (api *OrderbookAPI) ProcessOrder(payload map[string]string) (*orderbook.Quote, error) {
 	// add order at this current node first
 	// get timestamp in milliseconds
 	if payload["timestamp"] == "" {
 		payload["timestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
 	}
 	msg, err := NewOrderbookMsg(payload)
-	if err == nil {
-		// try to store into model, if success then process at local and broad cast
-		trades, orderInBook := api.Engine.ProcessOrder(payload)
-		demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook)
-		
-		// broad cast message
-		go api.sendMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	quote, err := orderbook.NewQuote(payload)
+	if err != nil {
+		return nil, err
+	}
 
-		return orderInBook
+	// try to store into model, if success then process at local and broad cast
+	trades, orderInBook, err := api.Engine.ProcessOrder(quote)
+	demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook, "err", err)
+	if err != nil {
+		// rejected order is not broadcasted
+		return nil, err
 	}
 
-	return nil
+	// broad cast message
+	go api.sendMessage(msg)
+
+	return orderInBook, nil
 }
 
 func (api *OrderbookAPI) CancelOrder(payload map[string]string) error {
@@ -128,8 +310,13 @@ func (api *OrderbookAPI) CancelOrder(payload map[string]string) error {
 	payload["timestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
 	msg, err := NewOrderbookCancelMsg(payload)
 	if err == nil {
+		var quote *orderbook.Quote
+		quote, err = orderbook.NewQuote(payload)
+		if err != nil {
+			return err
+		}
 		// try to store into model, if success then process at local and broad cast
-		err := api.Engine.CancelOrder(payload)
+		err := api.Engine.CancelOrder(quote)
 		demo.LogInfo("Orderbook cancel result", "err", err, "msg", msg)
 
 		// broad cast message
@@ -139,3 +326,35 @@ func (api *OrderbookAPI) CancelOrder(payload map[string]string) error {
 
 	return err
 }
+
+// CancelAll : cancel every order of the pair, of the trade id, or of one side of them, and broadcast it.
+// Cancelling the orders of every owner is only allowed here, for the operator
+func (api *OrderbookAPI) CancelAll(payload map[string]string) ([]*orderbook.Quote, error) {
+	payload["timestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	msg, err := NewOrderbookMassCancelMsg(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelled, err := api.Engine.CancelAll(msg.ToCancelFilter())
+	demo.LogInfo("Orderbook mass cancel result", "cancelled", len(cancelled), "err", err, "msg", msg)
+	if err != nil {
+		// invalid filter is not broadcasted
+		return nil, err
+	}
+
+	// peers do not accept a mass cancel without trade id, the orders are broadcasted one by one
+	if msg.TradeID == "" {
+		go func() {
+			for _, quote := range cancelled {
+				api.sendMessage(NewOrderbookCancelMsgFromQuote(quote))
+			}
+		}()
+		return cancelled, nil
+	}
+
+	// broad cast message
+	go api.sendMessage(msg)
+
+	return cancelled, nil
+}
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -15,17 +16,23 @@ import (
 
 const (
 	OrderbookName = "orderbook"
+	// OrderbookVersion : peers only talk with the same version, the order message gained the time in
+	// force, post-only, stop, iceberg, self-trade, quote quantity and protection fields in version 2
+	OrderbookVersion = 2
 )
 
+var ErrPeerMassCancel = errors.New("mass cancel from a peer needs a trade id")
+
 var (
 	OrderbookProtocol = &protocols.Spec{
 		Name:       OrderbookName,
-		Version:    1,
+		Version:    OrderbookVersion,
 		MaxMsgSize: 1024,
 		Messages: []interface{}{
 			&OrderbookHandshake{},
 			&OrderbookMsg{},
 			&OrderbookCancelMsg{},
+			&OrderbookMassCancelMsg{},
 		},
 	}
 )
@@ -39,16 +46,43 @@ type OrderbookMsg struct {
 	Timestamp uint64 `json:"timestamp" param:"timestamp"`
 	TradeID   string `json:"tradeID" param:"tradeID" validate:"required"`
 	Type      string `json:"type" param:"type" `
+	// GTC, IOC, FOK or GTD, empty means GTC
+	TimeInForce string `json:"timeInForce" param:"timeInForce"`
+	// unix time in seconds, only used by GTD order
+	ExpireTime uint64 `json:"expireTime" param:"expireTime"`
+	// maker only, the order never takes liquidity
+	PostOnly bool `json:"postOnly" param:"postOnly"`
+	// trigger price of stop_market and stop_limit order
+	StopPrice string `json:"stopPrice" param:"stopPrice"`
+	// iceberg order only shows this quantity in the book, empty means all of it
+	DisplayQuantity string `json:"displayQuantity" param:"displayQuantity"`
+	// self-trade prevention mode, empty means the default of the pair
+	SelfTradeMode string `json:"selfTradeMode" param:"selfTradeMode"`
+	// market buy by amount of quote currency, instead of quantity
+	QuoteQuantity string `json:"quoteQuantity" param:"quoteQuantity"`
+	// market order stops at the protection price or this far away from the best price
+	ProtectionPrice string `json:"protectionPrice" param:"protectionPrice"`
+	MaxSlippageBps  uint64 `json:"maxSlippageBps" param:"maxSlippageBps"`
 }
 
 type OrderbookCancelMsg struct {
-	PairName  string `json:"pairName" param:"pairName" validate:"required"`
-	OrderID   string `json:"orderID" param:"orderID" validate:"required"`
-	Price     string `json:"price" param:"price" validate:"required"`
+	PairName string `json:"pairName" param:"pairName" validate:"required"`
+	OrderID  string `json:"orderID" param:"orderID" validate:"required"`
+	// side and price are not needed, the order is found by its id
+	Price     string `json:"price" param:"price"`
 	Side      string `json:"side" param:"side" `
 	Timestamp uint64 `json:"timestamp" param:"timestamp"`
 }
 
+// OrderbookMassCancelMsg : cancel every order matching the filter, empty pair means every pair. Peers
+// only accept it with a trade id
+type OrderbookMassCancelMsg struct {
+	PairName  string `json:"pairName" param:"pairName"`
+	TradeID   string `json:"tradeID" param:"tradeID"`
+	Side      string `json:"side" param:"side"`
+	Timestamp uint64 `json:"timestamp" param:"timestamp"`
+}
+
 func (msg *OrderbookMsg) ToQuote() map[string]string {
 	quote := make(map[string]string)
 	quote["timestamp"] = strconv.FormatUint(msg.Timestamp, 10)
@@ -60,6 +94,19 @@ func (msg *OrderbookMsg) ToQuote() map[string]string {
 	quote["pair_name"] = msg.PairName
 	// if insert id is not used, just for update
 	quote["order_id"] = msg.OrderID
+	quote["time_in_force"] = msg.TimeInForce
+	if msg.ExpireTime > 0 {
+		quote["expire_time"] = strconv.FormatUint(msg.ExpireTime, 10)
+	}
+	quote["post_only"] = strconv.FormatBool(msg.PostOnly)
+	quote["stop_price"] = msg.StopPrice
+	quote["display_quantity"] = msg.DisplayQuantity
+	quote["self_trade_mode"] = msg.SelfTradeMode
+	quote["quote_quantity"] = msg.QuoteQuantity
+	quote["protection_price"] = msg.ProtectionPrice
+	if msg.MaxSlippageBps > 0 {
+		quote["max_slippage_bps"] = strconv.FormatUint(msg.MaxSlippageBps, 10)
+	}
 	return quote
 }
 
@@ -75,18 +122,51 @@ func (msg *OrderbookCancelMsg) ToQuote() map[string]string {
 
 func NewOrderbookMsg(quote map[string]string) (*OrderbookMsg, error) {
 	timestamp, err := strconv.ParseUint(quote["timestamp"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var expireTime uint64
+	if quote["expire_time"] != "" {
+		expireTime, err = strconv.ParseUint(quote["expire_time"], 10, 64)
+	}
+	var maxSlippageBps uint64
+	if err == nil && quote["max_slippage_bps"] != "" {
+		maxSlippageBps, err = strconv.ParseUint(quote["max_slippage_bps"], 10, 64)
+	}
+	// empty value means false
+	postOnly, _ := strconv.ParseBool(quote["post_only"])
 	return &OrderbookMsg{
-		Timestamp: timestamp,
-		Type:      quote["type"],
-		Side:      quote["side"],
-		Quantity:  quote["quantity"],
-		Price:     quote["price"],
-		TradeID:   quote["trade_id"],
-		PairName:  quote["pair_name"],
-		OrderID:   quote["order_id"],
+		Timestamp:       timestamp,
+		Type:            quote["type"],
+		Side:            quote["side"],
+		Quantity:        quote["quantity"],
+		Price:           quote["price"],
+		TradeID:         quote["trade_id"],
+		PairName:        quote["pair_name"],
+		OrderID:         quote["order_id"],
+		TimeInForce:     quote["time_in_force"],
+		ExpireTime:      expireTime,
+		PostOnly:        postOnly,
+		StopPrice:       quote["stop_price"],
+		DisplayQuantity: quote["display_quantity"],
+		SelfTradeMode:   quote["self_trade_mode"],
+		QuoteQuantity:   quote["quote_quantity"],
+		ProtectionPrice: quote["protection_price"],
+		MaxSlippageBps:  maxSlippageBps,
 	}, err
 }
 
+// NewOrderbookCancelMsgFromQuote : cancel message of an order cancelled by the engine
+func NewOrderbookCancelMsgFromQuote(quote *orderbook.Quote) *OrderbookCancelMsg {
+	return &OrderbookCancelMsg{
+		Timestamp: uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		Side:      quote.Side,
+		Price:     quote.Price.String(),
+		PairName:  quote.PairName,
+		OrderID:   strconv.FormatUint(quote.OrderID, 10),
+	}
+}
+
 func NewOrderbookCancelMsg(quote map[string]string) (*OrderbookCancelMsg, error) {
 	timestamp, err := strconv.ParseUint(quote["timestamp"], 10, 64)
 	return &OrderbookCancelMsg{
@@ -98,6 +178,24 @@ func NewOrderbookCancelMsg(quote map[string]string) (*OrderbookCancelMsg, error)
 	}, err
 }
 
+func (msg *OrderbookMassCancelMsg) ToCancelFilter() *orderbook.CancelFilter {
+	return &orderbook.CancelFilter{
+		PairName: msg.PairName,
+		TradeID:  msg.TradeID,
+		Side:     msg.Side,
+	}
+}
+
+func NewOrderbookMassCancelMsg(payload map[string]string) (*OrderbookMassCancelMsg, error) {
+	timestamp, err := strconv.ParseUint(payload["timestamp"], 10, 64)
+	return &OrderbookMassCancelMsg{
+		Timestamp: timestamp,
+		PairName:  payload["pair_name"],
+		TradeID:   payload["trade_id"],
+		Side:      payload["side"],
+	}, err
+}
+
 type OrderbookHandshake struct {
 	Nick string
 	V    uint
@@ -134,8 +232,13 @@ func (orderbookHandler *OrderbookHandler) handleOrderbookMsg(message *OrderbookM
 	payload := message.ToQuote()
 	demo.LogInfo("-> Add order", "payload", payload)
 
-	trades, orderInBook := orderbookHandler.Engine.ProcessOrder(payload)
-	demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook)
+	quote, err := orderbook.NewQuote(payload)
+	if err != nil {
+		demo.LogInfo("Invalid order", "payload", payload, "err", err)
+		return nil
+	}
+	trades, orderInBook, err := orderbookHandler.Engine.ProcessOrder(quote)
+	demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook, "err", err)
 	return nil
 }
 
@@ -146,11 +249,29 @@ func (orderbookHandler *OrderbookHandler) handleOrderbookCancelMsg(message *Orde
 	payload := message.ToQuote()
 	demo.LogInfo("-> Cancel order", "payload", payload)
 
-	err := orderbookHandler.Engine.CancelOrder(payload)
+	quote, err := orderbook.NewQuote(payload)
+	if err != nil {
+		demo.LogInfo("Invalid cancel order", "payload", payload, "err", err)
+		return nil
+	}
+	err = orderbookHandler.Engine.CancelOrder(quote)
 	demo.LogInfo("Orderbook result", "err", err)
 	return nil
 }
 
+func (orderbookHandler *OrderbookHandler) handleOrderbookMassCancelMsg(message *OrderbookMassCancelMsg) error {
+	demo.LogDebug("Received mass cancel", "mass_cancel", message, "peer", orderbookHandler.Peer)
+
+	// a peer can only cancel the orders of one owner, the pair-wide form is left to the operator
+	if message.TradeID == "" {
+		demo.LogInfo("Invalid mass cancel", "mass_cancel", message, "err", ErrPeerMassCancel)
+		return nil
+	}
+	cancelled, err := orderbookHandler.Engine.CancelAll(message.ToCancelFilter())
+	demo.LogInfo("Orderbook mass cancel result", "cancelled", len(cancelled), "err", err)
+	return nil
+}
+
 func (orderbookHandler *OrderbookHandler) handleOrderbookHandshake(orderbookhs *OrderbookHandshake) error {
 	demo.LogDebug("Processing handshake", "from", orderbookhs.Nick, "version", orderbookhs.V)
 
@@ -160,8 +281,8 @@ func (orderbookHandler *OrderbookHandler) handleOrderbookHandshake(orderbookhs *
 			select {
 			case payload := <-orderbookHandler.InC:
 				// demo.LogInfo("Internal received", "payload", payload)
-				inmsg, ok := payload.(*OrderbookMsg)
-				if ok {
+				switch inmsg := payload.(type) {
+				case *OrderbookMsg, *OrderbookCancelMsg, *OrderbookMassCancelMsg:
 					// maybe we have to use map[]chan
 					// databytes, err := rlp.EncodeToBytes(inmsg)
 					// databytes, err := json.Marshal(inmsg)
@@ -189,6 +310,8 @@ func (orderbookHandler *OrderbookHandler) handle(ctx context.Context, msg interf
 		return orderbookHandler.handleOrderbookMsg(msg.(*OrderbookMsg))
 	case *OrderbookCancelMsg:
 		return orderbookHandler.handleOrderbookCancelMsg(msg.(*OrderbookCancelMsg))
+	case *OrderbookMassCancelMsg:
+		return orderbookHandler.handleOrderbookMassCancelMsg(msg.(*OrderbookMassCancelMsg))
 	case *OrderbookHandshake:
 		return orderbookHandler.handleOrderbookHandshake(msg.(*OrderbookHandshake))
 	default:
@@ -201,7 +324,7 @@ func (orderbookHandler *OrderbookHandler) handle(ctx context.Context, msg interf
 func NewProtocol(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine *orderbook.Engine) *p2p.Protocol {
 	return &p2p.Protocol{
 		Name:    "Orderbook",
-		Version: 1,
+		Version: OrderbookVersion,
 		// we may use more 1 custom message code
 		Length: uint64(len(OrderbookProtocol.Messages)),
 		// Length: 2,
@@ -216,7 +339,7 @@ func NewProtocol(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine
 			// send the message, then handle it to make sure protocol success
 			go func() {
 				outmsg := &OrderbookHandshake{
-					V: 1,
+					V: OrderbookVersion,
 					// shortened hex string for terminal logging
 					Nick: p.Name(),
 				}
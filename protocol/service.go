@@ -1,12 +1,23 @@
 package protocol
 
 import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/node"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/rpc"
+	demo "github.com/novaprotocolio/orderbook/common"
 	"github.com/novaprotocolio/orderbook/orderbook"
 )
 
+const (
+	// expiryInterval : how often expired good till date orders are cancelled
+	expiryInterval = time.Second
+	// broadcastQueueSize : engine cancels waiting for a peer, later ones are dropped when it is full
+	broadcastQueueSize = 256
+)
+
 // the service we want to offer on the node
 // it must implement the node.Service interface
 type OrderbookService struct {
@@ -14,6 +25,9 @@ type OrderbookService struct {
 	Engine *orderbook.Engine
 	protos []p2p.Protocol
 	OutC chan<- interface{}
+
+	cancelSub event.Subscription
+	quitC     chan struct{}
 }
 
 // APIs : api service
@@ -36,13 +50,66 @@ func (service *OrderbookService) Protocols() []p2p.Protocol {
 }
 
 func (service *OrderbookService) Start(srv *p2p.Server) error {
+	// orders cancelled by the engine are broadcasted like user cancels, in the order they happened
+	cancelC := make(chan *orderbook.CancelEvent)
+	queue := make(chan interface{}, broadcastQueueSize)
+	service.quitC = make(chan struct{})
+	service.cancelSub = service.Engine.SubscribeCancelEvent(cancelC)
+	go service.broadcastCancels(cancelC, queue, service.cancelSub)
+	go service.sendMessages(queue)
+
+	service.Engine.StartExpiryScheduler(expiryInterval)
 	return nil
 }
 
 func (service *OrderbookService) Stop() error {
+	service.Engine.StopExpiryScheduler()
+	if service.cancelSub != nil {
+		service.cancelSub.Unsubscribe()
+	}
+	if service.quitC != nil {
+		close(service.quitC)
+		service.quitC = nil
+	}
 	return nil
 }
 
+// broadcastCancels : queue the cancels of the engine, the engine must not wait for a peer so a
+// cancel is dropped when the queue is full
+func (service *OrderbookService) broadcastCancels(cancelC <-chan *orderbook.CancelEvent, queue chan<- interface{}, sub event.Subscription) {
+	for {
+		select {
+		case ev := <-cancelC:
+			msg := NewOrderbookCancelMsgFromQuote(ev.Quote)
+			select {
+			case queue <- msg:
+				demo.LogInfo("-> Broadcast cancel", "reason", ev.Reason, "msg", msg)
+			default:
+				demo.LogWarn("Broadcast queue is full, cancel dropped", "reason", ev.Reason, "msg", msg)
+			}
+		case <-sub.Err():
+			return
+		}
+	}
+}
+
+// sendMessages : the only sender of the queue, the channel is only drained once a peer is connected
+func (service *OrderbookService) sendMessages(queue <-chan interface{}) {
+	quitC := service.quitC
+	for {
+		select {
+		case msg := <-queue:
+			select {
+			case service.OutC <- msg:
+			case <-quitC:
+				return
+			}
+		case <-quitC:
+			return
+		}
+	}
+}
+
 // NewService: wrapper function for servicenode to start the service, both APIs and Protocols
 func NewService(quitC <-chan struct{}, orderbookEngine *orderbook.Engine) func(ctx *node.ServiceContext) (node.Service, error) {
 	